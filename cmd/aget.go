@@ -0,0 +1,31 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"strings"
+
+	"github.com/jatalocks/opsilon/pkg/artifacts"
+	"github.com/spf13/cobra"
+)
+
+// agetCmd represents the artifacts get command
+var agetCmd = &cobra.Command{
+	Use:   "get <run id> <stage id>[/<path>]",
+	Short: "Download a file or a directory saved by a stage of a run",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		initConfig()
+		stage, name, _ := strings.Cut(args[1], "/")
+		artifacts.Get(args[0], stage, name, artifactOutput)
+	},
+}
+
+var artifactOutput string
+
+func init() {
+	artifactsCmd.AddCommand(agetCmd)
+
+	agetCmd.Flags().StringVarP(&artifactOutput, "output", "o", "", "Where to save the artifact (default is its name in the working directory)")
+}
@@ -0,0 +1,24 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"github.com/jatalocks/opsilon/pkg/artifacts"
+	"github.com/spf13/cobra"
+)
+
+// alsCmd represents the artifacts ls command
+var alsCmd = &cobra.Command{
+	Use:   "ls <run id>",
+	Short: "List the artifacts of a run with their sizes and checksums",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		initConfig()
+		artifacts.Ls(args[0])
+	},
+}
+
+func init() {
+	artifactsCmd.AddCommand(alsCmd)
+}
@@ -0,0 +1,18 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// artifactsCmd represents the artifacts command
+var artifactsCmd = &cobra.Command{
+	Use:   "artifacts",
+	Short: "List and download the artifacts of workflow runs",
+}
+
+func init() {
+	rootCmd.AddCommand(artifactsCmd)
+}
@@ -0,0 +1,43 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"strings"
+
+	internalgraph "github.com/jatalocks/opsilon/internal/graph"
+	"github.com/jatalocks/opsilon/pkg/graph"
+	"github.com/spf13/cobra"
+)
+
+// graphCmd represents the graph command
+var graphCmd = &cobra.Command{
+	Use:   "graph",
+	Short: "Show the stages of a workflow and the order they run in",
+	Long: `Show the stages of a workflow as a graph of the stages they need, annotated
+with their images, if conditions and imports, without running it.
+The ascii format prints a tree, dot can be rendered by Graphviz
+(opsilon graph -r repo -w workflow -f dot -o graph.dot && dot -Tsvg graph.dot)
+and mermaid by Markdown viewers that support it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		initConfig()
+		graph.Graph(repoNameGraph, workflowNameGraph, graphFormat, graphOutput)
+	},
+}
+
+var (
+	repoNameGraph     string
+	workflowNameGraph string
+	graphFormat       string
+	graphOutput       string
+)
+
+func init() {
+	rootCmd.AddCommand(graphCmd)
+
+	graphCmd.Flags().StringVarP(&repoNameGraph, "repo", "r", "", "Repository Name")
+	graphCmd.Flags().StringVarP(&workflowNameGraph, "workflow", "w", "", "ID of the workflow")
+	graphCmd.Flags().StringVarP(&graphFormat, "format", "f", "ascii", "Output format: "+strings.Join(internalgraph.Formats, ", "))
+	graphCmd.Flags().StringVarP(&graphOutput, "output", "o", "", "File to write the graph to, instead of printing it")
+}
@@ -48,6 +48,7 @@ func init() {
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.opsilon.yaml)")
 	rootCmd.PersistentFlags().Bool("kubernetes", false, "Run in Kubernetes instead of Docker. You must be connected to a Kubernetes Context")
+	rootCmd.PersistentFlags().String("executor", "docker", "Backend to run stages with: docker, kubernetes or shell (host processes, no container runtime needed)")
 
 	rootCmd.PersistentFlags().Bool("local", true, "Run using a local file as config. Not a database. True for CLI.")
 
@@ -61,6 +62,17 @@ func init() {
 	rootCmd.PersistentFlags().String("consul_uri", "localhost:8500", "Consul URI. Can be set using ENV variable.")
 
 	rootCmd.PersistentFlags().String("consul_key", "default", "Consul Config Key. Can be set using ENV variable.")
+
+	rootCmd.PersistentFlags().String("artifact_store", "fs", "Where stage artifacts are kept: fs (local disk) or s3 (S3 compatible object storage). Can be set using ENV variable.")
+	rootCmd.PersistentFlags().String("artifact_path", "artifacts", "Directory of the fs artifact store. Can be set using ENV variable.")
+	rootCmd.PersistentFlags().String("s3_endpoint", "", "Endpoint of the s3 artifact store, e.g. s3.amazonaws.com or http://localhost:9000. Can be set using ENV variable.")
+	rootCmd.PersistentFlags().String("s3_bucket", "", "Bucket of the s3 artifact store. Can be set using ENV variable.")
+	rootCmd.PersistentFlags().String("s3_access_key", "", "Access key of the s3 artifact store, defaults to AWS_ACCESS_KEY_ID. Can be set using ENV variable.")
+	rootCmd.PersistentFlags().String("s3_secret_key", "", "Secret key of the s3 artifact store, defaults to AWS_SECRET_ACCESS_KEY. Can be set using ENV variable.")
+	rootCmd.PersistentFlags().String("s3_region", "", "Region of the s3 artifact store. Can be set using ENV variable.")
+	rootCmd.PersistentFlags().Bool("s3_insecure", false, "Connect to the s3 artifact store over plain HTTP. Can be set using ENV variable.")
+	rootCmd.PersistentFlags().String("vault_address", "", "Address of the Vault server of vault secrets, defaults to VAULT_ADDR. Can be set using ENV variable.")
+	rootCmd.PersistentFlags().String("vault_token", "", "Token for the Vault server of vault secrets, defaults to VAULT_TOKEN. Can be set using ENV variable.")
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	// rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
@@ -120,12 +132,16 @@ func initConfig() {
 	}
 
 	viper.BindPFlag("kubernetes", rootCmd.Flags().Lookup("kubernetes"))
+	viper.BindPFlag("executor", rootCmd.Flags().Lookup("executor"))
 	viper.BindPFlag("local", rootCmd.Flags().Lookup("local"))
 	viper.BindPFlag("database", rootCmd.Flags().Lookup("database"))
 	viper.BindPFlag("consul", rootCmd.Flags().Lookup("consul"))
 	viper.BindPFlag("mongodb_uri", rootCmd.Flags().Lookup("mongodb_uri"))
 	viper.BindPFlag("consul_uri", rootCmd.Flags().Lookup("consul_uri"))
 	viper.BindPFlag("consul_key", rootCmd.Flags().Lookup("consul_key"))
+	for _, flag := range []string{"artifact_store", "artifact_path", "s3_endpoint", "s3_bucket", "s3_access_key", "s3_secret_key", "s3_region", "s3_insecure", "vault_address", "vault_token"} {
+		viper.BindPFlag(flag, rootCmd.Flags().Lookup(flag))
+	}
 
 	if err != nil {
 		logger.Error("It seems that you don't yet have a repository config file. Please run:")
@@ -14,7 +14,7 @@ var runCmd = &cobra.Command{
 	Short: "Run an available workflow",
 	Run: func(cmd *cobra.Command, args []string) {
 		initConfig()
-		run.Select(repoNameRun, workflowName, inputs, confirm)
+		run.Select(repoNameRun, workflowName, inputs, confirm, dryRun)
 	},
 }
 
@@ -23,6 +23,7 @@ var (
 	workflowName string
 	inputs       map[string]string
 	confirm      bool
+	dryRun       bool
 )
 
 func init() {
@@ -35,6 +36,7 @@ func init() {
 	runCmd.Flags().StringVarP(&repoNameRun, "repo", "r", "", "Repository Name")
 	runCmd.Flags().StringVarP(&workflowName, "workflow", "w", "", "ID of the workflow to run")
 	runCmd.Flags().BoolVar(&confirm, "confirm", false, "Start running without confirmation")
+	runCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print what the run would do (images, env, conditions and artifacts of every stage) without running it")
 	runCmd.Flags().StringToStringVarP(&inputs, "args", "a", nil, "Comma separated list of key=value arguments for the workflow input")
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
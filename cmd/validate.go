@@ -0,0 +1,33 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"github.com/jatalocks/opsilon/pkg/validate"
+	"github.com/spf13/cobra"
+)
+
+// validateCmd represents the validate command
+var validateCmd = &cobra.Command{
+	Use:   "validate [path|repo]",
+	Short: "Check workflows for problems, with their files and lines",
+	Long: `Check the workflows of a repository, or of a folder or workflow file, for
+problems: unknown keys, duplicate stage IDs, needs of unknown stages,
+dependency cycles, imports from stages that are not needed and invalid if
+expressions. Checks all repositories when no argument is given, and exits
+with 1 when there are problems.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		initConfig()
+		target := ""
+		if len(args) > 0 {
+			target = args[0]
+		}
+		validate.Validate(target)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
@@ -0,0 +1,293 @@
+package artifacts
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// ErrNotFound is returned when loading an artifact that was never saved.
+var ErrNotFound = errors.New("artifact not found")
+
+// ErrInvalidRunID is returned when listing the artifacts of a run ID that
+// could not have been generated, such as one holding glob patterns or
+// slashes.
+var ErrInvalidRunID = errors.New("invalid run ID")
+
+// SaveError is returned when a file of a stage could not be saved to the
+// store, which fails the stage.
+type SaveError struct {
+	Key Key
+	Err error
+}
+
+func (e *SaveError) Error() string {
+	return fmt.Sprintf("saving artifact %s: %v", e.Key.Path(), e.Err)
+}
+
+func (e *SaveError) Unwrap() error {
+	return e.Err
+}
+
+var runIDPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+// CheckRunID returns ErrInvalidRunID for run IDs that are not made of
+// letters, digits, dashes and underscores.
+func CheckRunID(runID string) error {
+	if !runIDPattern.MatchString(runID) {
+		return fmt.Errorf("%w %q", ErrInvalidRunID, runID)
+	}
+	return nil
+}
+
+// Key addresses a single artifact of a stage run.
+type Key struct {
+	Repo     string
+	Workflow string
+	RunID    string
+	Stage    string
+	// Name is the path of the artifact in the stage workspace, e.g. testdir or testdir/test.txt.
+	Name string
+}
+
+// Path returns the slash separated path of the artifact inside a store.
+func (k Key) Path() string {
+	return path.Join(k.Repo, k.Workflow, k.RunID, k.Stage, filepath.ToSlash(k.Name))
+}
+
+// Object is a single file of an artifact.
+type Object struct {
+	Repo     string `json:"repo"`
+	Workflow string `json:"workflow"`
+	Stage    string `json:"stage"`
+	// Path is the slash separated path of the file in the stage workspace.
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Checksum is only set by Checksums, computing it can be expensive.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// Key returns the key of the object, which can be loaded on its own.
+func (o Object) Key(runID string) Key {
+	return Key{Repo: o.Repo, Workflow: o.Workflow, RunID: runID, Stage: o.Stage, Name: o.Path}
+}
+
+// Scope is where the stages of a run save their artifacts. The stages of a
+// nested run, started by a stage that uses a workflow, save theirs under
+// that stage of the top-level run, in a directory named after the nested
+// stage, so that they are listed with the run the user started.
+type Scope struct {
+	Repo     string
+	Workflow string
+	RunID    string
+	// Stage of the top-level run that uses the workflow, empty for
+	// top-level runs.
+	Stage string
+	// Prefix is the slash separated path of the nested stages that use
+	// workflows, below Stage.
+	Prefix string
+}
+
+// Nested returns the scope of the run started by the stage id, which uses a
+// workflow.
+func (s Scope) Nested(id string) Scope {
+	if s.Stage == "" {
+		s.Stage = id
+	} else {
+		s.Prefix = path.Join(s.Prefix, id)
+	}
+	return s
+}
+
+// Key returns the key of the artifact name saved by stage.
+func (s Scope) Key(stage, name string) Key {
+	if s.Stage == "" {
+		return Key{Repo: s.Repo, Workflow: s.Workflow, RunID: s.RunID, Stage: stage, Name: name}
+	}
+	return Key{Repo: s.Repo, Workflow: s.Workflow, RunID: s.RunID, Stage: s.Stage, Name: path.Join(s.Prefix, stage, name)}
+}
+
+// Names returns the paths of the files among objects that stage saved,
+// relative to its workspace.
+func (s Scope) Names(objects []Object, stage string) []string {
+	key := s.Key(stage, "")
+	names := []string{}
+	for _, o := range objects {
+		if o.Repo != key.Repo || o.Workflow != key.Workflow || o.Stage != key.Stage {
+			continue
+		}
+		if key.Name == "" {
+			names = append(names, o.Path)
+		} else if strings.HasPrefix(o.Path, key.Name+"/") {
+			names = append(names, strings.TrimPrefix(o.Path, key.Name+"/"))
+		}
+	}
+	return names
+}
+
+// Store keeps the artifacts stages save, so that later stages can import
+// them and users can download them. An artifact is a file or a directory.
+type Store interface {
+	// Save copies the file or directory at src to the artifact.
+	Save(ctx context.Context, key Key, src string) error
+	// Load copies the artifact to dst, which becomes a file or a directory
+	// like the saved one. It returns ErrNotFound if there is no such artifact.
+	Load(ctx context.Context, key Key, dst string) error
+	// List returns every file saved by the stages of a run, sorted by stage
+	// and path, without their checksums. It returns ErrInvalidRunID for run
+	// IDs CheckRunID refuses.
+	List(ctx context.Context, runID string) ([]Object, error)
+	// Checksum returns the checksum of the file of an artifact.
+	Checksum(ctx context.Context, key Key) (string, error)
+}
+
+// Checksums sets the checksums of the objects of the run.
+func Checksums(ctx context.Context, store Store, runID string, objects []Object) error {
+	for i, o := range objects {
+		sum, err := store.Checksum(ctx, o.Key(runID))
+		if err != nil {
+			return err
+		}
+		objects[i].Checksum = sum
+	}
+	return nil
+}
+
+// FromConfig returns the store configured with artifact_store: fs (default)
+// or s3.
+func FromConfig() (Store, error) {
+	switch viper.GetString("artifact_store") {
+	case "", "fs":
+		root := viper.GetString("artifact_path")
+		if root == "" {
+			root = "artifacts"
+		}
+		return NewFSStore(root)
+	case "s3":
+		return NewS3Store(S3Config{
+			Endpoint:  viper.GetString("s3_endpoint"),
+			Bucket:    viper.GetString("s3_bucket"),
+			AccessKey: viper.GetString("s3_access_key"),
+			SecretKey: viper.GetString("s3_secret_key"),
+			Region:    viper.GetString("s3_region"),
+			Insecure:  viper.GetBool("s3_insecure"),
+		})
+	default:
+		return nil, fmt.Errorf("unknown artifact store %s, use fs or s3", viper.GetString("artifact_store"))
+	}
+}
+
+// Find returns the files of the run under the artifact path of a stage: the
+// file itself, or every file of a directory. It returns ErrNotFound if there
+// are none.
+func Find(ctx context.Context, store Store, runID, stage, name string) ([]Object, error) {
+	objects, err := store.List(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+	name = CleanName(name)
+	found := []Object{}
+	for _, o := range objects {
+		if o.Stage == stage && (name == "" || o.Path == name || strings.HasPrefix(o.Path, name+"/")) {
+			found = append(found, o)
+		}
+	}
+	if len(found) == 0 {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+// CleanName returns the artifact path name relative to the stage workspace,
+// slash separated and without leading or trailing slashes.
+func CleanName(name string) string {
+	return strings.Trim(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+func checksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func sortObjects(objects []Object) {
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Stage != objects[j].Stage {
+			return objects[i].Stage < objects[j].Stage
+		}
+		return objects[i].Path < objects[j].Path
+	})
+}
+
+// Copy copies the file or directory src to dst. src should be a full path.
+func Copy(src, dst string) error {
+
+	return filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// copy to this path
+		outpath := filepath.Join(dst, strings.TrimPrefix(path, src))
+
+		if info.IsDir() {
+			os.MkdirAll(outpath, info.Mode())
+			return nil // means recursive
+		}
+
+		// handle irregular files
+		if !info.Mode().IsRegular() {
+			switch info.Mode().Type() & os.ModeType {
+			case os.ModeSymlink:
+				link, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				return os.Symlink(link, outpath)
+			}
+			return nil
+		}
+
+		// copy contents of regular file efficiently
+
+		// open input
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		// create output
+		fh, err := os.Create(outpath)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+
+		// make it the same
+		fh.Chmod(info.Mode())
+
+		// copy content
+		_, err = io.Copy(fh, in)
+		return err
+	})
+}
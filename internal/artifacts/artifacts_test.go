@@ -0,0 +1,132 @@
+package artifacts
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestScope(t *testing.T) {
+	top := Scope{Repo: "r", Workflow: "w", RunID: "run"}
+	tests := []struct {
+		name  string
+		scope Scope
+		key   Key
+	}{
+		{
+			name:  "top-level run",
+			scope: top,
+			key:   Key{Repo: "r", Workflow: "w", RunID: "run", Stage: "build", Name: "dist/app"},
+		},
+		{
+			name:  "nested run",
+			scope: top.Nested("call"),
+			key:   Key{Repo: "r", Workflow: "w", RunID: "run", Stage: "call", Name: "build/dist/app"},
+		},
+		{
+			name:  "run nested in a nested run",
+			scope: top.Nested("call").Nested("inner"),
+			key:   Key{Repo: "r", Workflow: "w", RunID: "run", Stage: "call", Name: "inner/build/dist/app"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.scope.Key("build", "dist/app"); got != tt.key {
+				t.Errorf("Key() = %+v, want %+v", got, tt.key)
+			}
+		})
+	}
+}
+
+func TestScopeNames(t *testing.T) {
+	objects := []Object{
+		{Repo: "r", Workflow: "w", Stage: "build", Path: "dist/app"},
+		{Repo: "r", Workflow: "w", Stage: "build", Path: "dist/app.sha256"},
+		{Repo: "r", Workflow: "other", Stage: "build", Path: "other"},
+		{Repo: "r", Workflow: "w", Stage: "call", Path: "build/out.txt"},
+		{Repo: "r", Workflow: "w", Stage: "call", Path: "builder/out.txt"},
+		{Repo: "r", Workflow: "w", Stage: "call", Path: "inner/build/deep.txt"},
+	}
+	top := Scope{Repo: "r", Workflow: "w", RunID: "run"}
+	tests := []struct {
+		name  string
+		scope Scope
+		stage string
+		want  []string
+	}{
+		{name: "top-level stage", scope: top, stage: "build", want: []string{"dist/app", "dist/app.sha256"}},
+		{name: "stage using a workflow", scope: top, stage: "call", want: []string{"build/out.txt", "builder/out.txt", "inner/build/deep.txt"}},
+		{name: "nested stage", scope: top.Nested("call"), stage: "build", want: []string{"out.txt"}},
+		{name: "deeper nested stage", scope: top.Nested("call").Nested("inner"), stage: "build", want: []string{"deep.txt"}},
+		{name: "stage without artifacts", scope: top, stage: "test", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.scope.Names(objects, tt.stage); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Names() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanName(t *testing.T) {
+	tests := map[string]string{
+		"":                 "",
+		"/":                "",
+		"dist":             "dist",
+		"/dist/":           "dist",
+		"dist//bin/./app":  "dist/bin/app",
+		"../../etc/passwd": "etc/passwd",
+		"dist/../app":      "app",
+	}
+	for name, want := range tests {
+		if got := CleanName(name); got != want {
+			t.Errorf("CleanName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t, map[Key]string{
+		{Repo: "r", Workflow: "w", RunID: "run", Stage: "build", Name: "dist/app"}:        "app",
+		{Repo: "r", Workflow: "w", RunID: "run", Stage: "build", Name: "dist/app.sha256"}: "sum",
+		{Repo: "r", Workflow: "w", RunID: "run", Stage: "build", Name: "distro.txt"}:      "distro",
+		{Repo: "r", Workflow: "w", RunID: "run", Stage: "test", Name: "dist/report.xml"}:  "<ok/>",
+	})
+	tests := []struct {
+		name, stage, path string
+		want              []string
+	}{
+		{name: "whole stage", stage: "build", want: []string{"dist/app", "dist/app.sha256", "distro.txt"}},
+		{name: "directory", stage: "build", path: "/dist/", want: []string{"dist/app", "dist/app.sha256"}},
+		{name: "file", stage: "build", path: "dist/app", want: []string{"dist/app"}},
+		{name: "missing file", stage: "build", path: "dist/ap"},
+		{name: "missing stage", stage: "deploy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := Find(ctx, store, "run", tt.stage, tt.path)
+			if tt.want == nil {
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("Find() = %+v, %v, want %v", found, err, ErrNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths := []string{}
+			for _, o := range found {
+				paths = append(paths, o.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.want) {
+				t.Errorf("Find() = %v, want %v", paths, tt.want)
+			}
+		})
+	}
+	if _, err := Find(ctx, store, "../run", "build", ""); !errors.Is(err, ErrInvalidRunID) {
+		t.Errorf("Find() with an invalid run ID = %v, want %v", err, ErrInvalidRunID)
+	}
+}
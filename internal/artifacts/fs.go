@@ -0,0 +1,91 @@
+package artifacts
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FSStore keeps artifacts in a directory on the local disk, under
+// <root>/<repo>/<workflow>/<runid>/<stage>/<artifact>.
+type FSStore struct {
+	root string
+}
+
+// NewFSStore returns a store rooted at root. A relative root is resolved
+// against the working directory.
+func NewFSStore(root string) (*FSStore, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	return &FSStore{root: abs}, nil
+}
+
+func (s *FSStore) path(key Key) string {
+	return filepath.Join(s.root, filepath.FromSlash(key.Path()))
+}
+
+func (s *FSStore) Save(ctx context.Context, key Key, src string) error {
+	to := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		return err
+	}
+	return Copy(src, to)
+}
+
+func (s *FSStore) Load(ctx context.Context, key Key, dst string) error {
+	from := s.path(key)
+	if _, err := os.Stat(from); errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return Copy(from, dst)
+}
+
+func (s *FSStore) List(ctx context.Context, runID string) ([]Object, error) {
+	if err := CheckRunID(runID); err != nil {
+		return nil, err
+	}
+	runs, err := filepath.Glob(filepath.Join(s.root, "*", "*", runID))
+	if err != nil {
+		return nil, err
+	}
+	objects := []Object{}
+	for _, run := range runs {
+		workflow := filepath.Dir(run)
+		repo := filepath.Dir(workflow)
+		err := filepath.Walk(run, func(file string, info fs.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(run, file)
+			if err != nil {
+				return err
+			}
+			stage, name, _ := strings.Cut(filepath.ToSlash(rel), "/")
+			objects = append(objects, Object{
+				Repo:     filepath.Base(repo),
+				Workflow: filepath.Base(workflow),
+				Stage:    stage,
+				Path:     name,
+				Size:     info.Size(),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sortObjects(objects)
+	return objects, nil
+}
+
+func (s *FSStore) Checksum(ctx context.Context, key Key) (string, error) {
+	return checksum(s.path(key))
+}
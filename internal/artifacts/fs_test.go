@@ -0,0 +1,133 @@
+package artifacts
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newStore returns a store in a temporary directory holding the files, by
+// key.
+func newStore(t *testing.T, files map[Key]string) *FSStore {
+	t.Helper()
+	store, err := NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	for key, content := range files {
+		file := filepath.Join(src, key.Stage, key.Name)
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Save(context.Background(), key, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestFSStoreSaveLoad(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t, nil)
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "dist", "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "dist", "bin", "app"), []byte("app"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	key := Key{Repo: "r", Workflow: "w", RunID: "run", Stage: "build", Name: "dist"}
+	if err := store.Save(ctx, key, filepath.Join(src, "dist")); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "imported", "dist")
+	if err := store.Load(ctx, key, dst); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(dst, "bin", "app"))
+	if err != nil || string(content) != "app" {
+		t.Errorf("loaded dist/bin/app = %q, %v, want app", content, err)
+	}
+	file := Key{Repo: "r", Workflow: "w", RunID: "run", Stage: "build", Name: "dist/bin/app"}
+	if err := store.Load(ctx, file, filepath.Join(t.TempDir(), "app")); err != nil {
+		t.Errorf("loading a file of a saved directory: %v", err)
+	}
+	missing := Key{Repo: "r", Workflow: "w", RunID: "run", Stage: "test", Name: "dist"}
+	if err := store.Load(ctx, missing, t.TempDir()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Load() of a missing artifact = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestFSStoreList(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t, map[Key]string{
+		{Repo: "r", Workflow: "w", RunID: "run", Stage: "test", Name: "report.xml"}:   "<ok/>",
+		{Repo: "r", Workflow: "w", RunID: "run", Stage: "build", Name: "dist/app"}:    "app",
+		{Repo: "r", Workflow: "other", RunID: "run", Stage: "build", Name: "out.txt"}: "out",
+		{Repo: "r", Workflow: "w", RunID: "older", Stage: "build", Name: "dist/app"}:  "old",
+	})
+	got, err := store.List(ctx, "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Object{
+		{Repo: "r", Workflow: "w", Stage: "build", Path: "dist/app", Size: 3},
+		{Repo: "r", Workflow: "other", Stage: "build", Path: "out.txt", Size: 3},
+		{Repo: "r", Workflow: "w", Stage: "test", Path: "report.xml", Size: 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %+v, want %+v", got, want)
+	}
+	if got, err := store.List(ctx, "never"); err != nil || len(got) != 0 {
+		t.Errorf("List() of a run without artifacts = %+v, %v, want none", got, err)
+	}
+	for _, runID := range []string{"*", "run/..", "../run", ""} {
+		if _, err := store.List(ctx, runID); !errors.Is(err, ErrInvalidRunID) {
+			t.Errorf("List(%q) = %v, want %v", runID, err, ErrInvalidRunID)
+		}
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t, map[Key]string{
+		{Repo: "r", Workflow: "w", RunID: "run", Stage: "build", Name: "app"}: "hello",
+	})
+	objects, err := store.List(ctx, "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Checksums(ctx, store, "run", objects); err != nil {
+		t.Fatal(err)
+	}
+	// sha256 of "hello".
+	want := "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if len(objects) != 1 || objects[0].Checksum != want {
+		t.Errorf("Checksums() = %+v, want %s", objects, want)
+	}
+	objects = append(objects, Object{Repo: "r", Workflow: "w", Stage: "build", Path: "missing"})
+	if err := Checksums(ctx, store, "run", objects); err == nil {
+		t.Error("Checksums() of a missing file succeeded")
+	}
+}
+
+func TestCheckRunID(t *testing.T) {
+	for _, runID := range []string{"a1b2c3", "run_1", "2024-01-01"} {
+		if err := CheckRunID(runID); err != nil {
+			t.Errorf("CheckRunID(%q) = %v, want nil", runID, err)
+		}
+	}
+	for _, runID := range []string{"", "-run", "a/b", "..", "run*", "run?", "[run]"} {
+		if err := CheckRunID(runID); !errors.Is(err, ErrInvalidRunID) {
+			t.Errorf("CheckRunID(%q) = %v, want %v", runID, err, ErrInvalidRunID)
+		}
+	}
+}
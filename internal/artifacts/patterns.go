@@ -0,0 +1,140 @@
+package artifacts
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+)
+
+// ErrNoFiles is returned when a pattern matches no files and the stage
+// policy for it is error.
+var ErrNoFiles = errors.New("no files found")
+
+// Patterns selects artifact files with doublestar glob patterns relative to
+// the stage workspace, such as dist/*.tar.gz or reports/**/*.xml. Patterns
+// starting with ! exclude the files they match. A pattern matching a
+// directory selects every file below it.
+type Patterns struct {
+	include []string
+	exclude []string
+}
+
+// NewPatterns parses the artifacts of a stage or an import.
+func NewPatterns(patterns []string) Patterns {
+	p := Patterns{}
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "!") {
+			p.exclude = append(p.exclude, CleanName(strings.TrimPrefix(pattern, "!")))
+		} else {
+			p.include = append(p.include, CleanName(pattern))
+		}
+	}
+	return p
+}
+
+// Validate returns an error for the first pattern that is not a valid glob.
+func (p Patterns) Validate() error {
+	for _, pattern := range append(append([]string{}, p.include...), p.exclude...) {
+		if !doublestar.ValidatePattern(pattern) {
+			return fmt.Errorf("invalid artifact pattern %s", pattern)
+		}
+	}
+	return nil
+}
+
+// Match reports whether the file at the slash separated path name is
+// selected by an include pattern and not by an exclude pattern.
+func (p Patterns) Match(name string) bool {
+	return matchAny(p.include, name) && !matchAny(p.exclude, name)
+}
+
+// Select returns the names selected by the patterns, and the include
+// patterns that selected none of them.
+func (p Patterns) Select(names []string) ([]string, []string) {
+	selected := []string{}
+	matched := make(map[string]bool)
+	for _, name := range names {
+		if matchAny(p.exclude, name) {
+			continue
+		}
+		found := false
+		for _, pattern := range p.include {
+			if match(pattern, name) {
+				matched[pattern] = true
+				found = true
+			}
+		}
+		if found {
+			selected = append(selected, name)
+		}
+	}
+	unmatched := []string{}
+	for _, pattern := range p.include {
+		if !matched[pattern] {
+			unmatched = append(unmatched, pattern)
+		}
+	}
+	return selected, unmatched
+}
+
+// Files returns the slash separated paths of the regular files and
+// symlinks under dir.
+func Files(dir string) ([]string, error) {
+	names := []string{}
+	err := filepath.Walk(dir, func(file string, info fs.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	return names, err
+}
+
+// NoFiles applies the if_no_files_found policy of a stage to the patterns
+// that matched nothing: error returns ErrNoFiles, warn returns a warning to
+// print and ignore returns nothing.
+func NoFiles(policy string, unmatched []string) (string, error) {
+	if len(unmatched) == 0 {
+		return "", nil
+	}
+	switch policy {
+	case internaltypes.NoFilesIgnore:
+		return "", nil
+	case internaltypes.NoFilesError:
+		return "", fmt.Errorf("%w for %s", ErrNoFiles, strings.Join(unmatched, ", "))
+	default:
+		return fmt.Sprintf("No files found for %s, ignoring", strings.Join(unmatched, ", ")), nil
+	}
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if match(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether the pattern matches the name or one of its parent
+// directories.
+func match(pattern, name string) bool {
+	for name != "." && name != "/" && name != "" {
+		if ok, _ := doublestar.Match(pattern, name); ok {
+			return true
+		}
+		name = path.Dir(name)
+	}
+	return false
+}
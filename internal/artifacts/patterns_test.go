@@ -0,0 +1,151 @@
+package artifacts
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+)
+
+func TestPatternsMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		file     string
+		want     bool
+	}{
+		{name: "literal file", patterns: []string{"out.txt"}, file: "out.txt", want: true},
+		{name: "cleaned pattern", patterns: []string{"./dist//app"}, file: "dist/app", want: true},
+		{name: "star", patterns: []string{"dist/*.tar.gz"}, file: "dist/app.tar.gz", want: true},
+		{name: "star does not cross directories", patterns: []string{"dist/*.tar.gz"}, file: "dist/linux/app.tar.gz", want: false},
+		{name: "double star", patterns: []string{"reports/**/*.xml"}, file: "reports/unit/a/junit.xml", want: true},
+		{name: "directory selects files below it", patterns: []string{"dist"}, file: "dist/linux/app", want: true},
+		{name: "no include", patterns: []string{"!dist/*.log"}, file: "dist/app", want: false},
+		{name: "excluded file", patterns: []string{"dist/**", "!dist/*.log"}, file: "dist/build.log", want: false},
+		{name: "not excluded file", patterns: []string{"dist/**", "!dist/*.log"}, file: "dist/app", want: true},
+		{name: "excluded directory", patterns: []string{"dist", "!dist/tmp"}, file: "dist/tmp/cache", want: false},
+		{name: "exclude before include", patterns: []string{"!**/*.map", "**/*.js"}, file: "web/app.js.map", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewPatterns(tt.patterns).Match(tt.file); got != tt.want {
+				t.Errorf("Match(%q) with %v = %v, want %v", tt.file, tt.patterns, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPatternsSelect(t *testing.T) {
+	names := []string{"dist/app", "dist/app.sha256", "dist/build.log", "reports/junit.xml", "README.md"}
+	tests := []struct {
+		name      string
+		patterns  []string
+		selected  []string
+		unmatched []string
+	}{
+		{
+			name:      "everything",
+			patterns:  []string{"**"},
+			selected:  names,
+			unmatched: []string{},
+		},
+		{
+			name:      "exclusions",
+			patterns:  []string{"dist", "!**/*.log", "!dist/*.sha256"},
+			selected:  []string{"dist/app"},
+			unmatched: []string{},
+		},
+		{
+			name:      "unmatched include patterns",
+			patterns:  []string{"reports/*.xml", "coverage/**", "*.txt"},
+			selected:  []string{"reports/junit.xml"},
+			unmatched: []string{"coverage/**", "*.txt"},
+		},
+		{
+			name:      "patterns whose files are all excluded are matched",
+			patterns:  []string{"dist/*.log", "!dist/build.log"},
+			selected:  []string{},
+			unmatched: []string{"dist/*.log"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selected, unmatched := NewPatterns(tt.patterns).Select(names)
+			if !reflect.DeepEqual(selected, tt.selected) {
+				t.Errorf("Select() selected = %v, want %v", selected, tt.selected)
+			}
+			if !reflect.DeepEqual(unmatched, tt.unmatched) {
+				t.Errorf("Select() unmatched = %v, want %v", unmatched, tt.unmatched)
+			}
+		})
+	}
+}
+
+func TestPatternsValidate(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		wantErr  bool
+	}{
+		{patterns: []string{"dist/**/*.tar.gz", "!dist/*.log"}},
+		{patterns: []string{"dist/{a,b}/[0-9]*"}},
+		{patterns: []string{"dist/[a-"}, wantErr: true},
+		{patterns: []string{"dist", "!{a,b"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := NewPatterns(tt.patterns).Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate() with %v error = %v, wantErr %v", tt.patterns, err, tt.wantErr)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "dist/app", "dist/linux/app"} {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "empty"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Files(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if want := []string{"a.txt", "dist/app", "dist/linux/app"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Files() = %v, want %v", got, want)
+	}
+}
+
+func TestNoFiles(t *testing.T) {
+	tests := []struct {
+		policy      string
+		unmatched   []string
+		wantWarning bool
+		wantErr     bool
+	}{
+		{policy: internaltypes.NoFilesError, unmatched: nil},
+		{policy: internaltypes.NoFilesError, unmatched: []string{"dist/*"}, wantErr: true},
+		{policy: internaltypes.NoFilesWarn, unmatched: []string{"dist/*"}, wantWarning: true},
+		{policy: "", unmatched: []string{"dist/*"}, wantWarning: true},
+		{policy: internaltypes.NoFilesIgnore, unmatched: []string{"dist/*"}},
+	}
+	for _, tt := range tests {
+		warning, err := NoFiles(tt.policy, tt.unmatched)
+		if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrNoFiles)) {
+			t.Errorf("NoFiles(%q, %v) error = %v, wantErr %v", tt.policy, tt.unmatched, err, tt.wantErr)
+		}
+		if (warning != "") != tt.wantWarning {
+			t.Errorf("NoFiles(%q, %v) warning = %q, wantWarning %v", tt.policy, tt.unmatched, warning, tt.wantWarning)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package artifacts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"golang.org/x/exp/slices"
+)
+
+// S3Config configures an S3Store.
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Region    string
+	// Insecure connects to the endpoint over plain HTTP, e.g. a local MinIO.
+	Insecure bool
+}
+
+// checksumMeta is the object metadata holding the checksum of the file,
+// computed on upload since ETags are not checksums for multipart uploads.
+const checksumMeta = "Checksum"
+
+// S3Store keeps artifacts in a bucket of an S3 compatible object storage,
+// under the key <repo>/<workflow>/<runid>/<stage>/<artifact>. A directory
+// artifact is saved as one object per file below that key.
+type S3Store struct {
+	client *minio.Client
+	bucket string
+	// runs holds the <repo>/<workflow>/ prefixes of the runs this store saved
+	// or listed artifacts of, by run ID, so that listing them again does not
+	// walk the bucket.
+	runs sync.Map
+}
+
+// NewS3Store returns a store for the configured bucket. Without an access
+// key, credentials are read from the AWS environment variables.
+func NewS3Store(c S3Config) (*S3Store, error) {
+	if c.Endpoint == "" || c.Bucket == "" {
+		return nil, errors.New("the s3 artifact store needs s3_endpoint and s3_bucket")
+	}
+	creds := credentials.NewEnvAWS()
+	if c.AccessKey != "" {
+		creds = credentials.NewStaticV4(c.AccessKey, c.SecretKey, "")
+	}
+	endpoint := strings.TrimPrefix(strings.TrimPrefix(c.Endpoint, "https://"), "http://")
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: !c.Insecure && !strings.HasPrefix(c.Endpoint, "http://"),
+		Region: c.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3Store{client: client, bucket: c.Bucket}, nil
+}
+
+func (s *S3Store) Save(ctx context.Context, key Key, src string) error {
+	s.runs.LoadOrStore(key.RunID, []string{key.Repo + "/" + key.Workflow + "/"})
+	prefix := key.Path()
+	return filepath.Walk(src, func(file string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		object := prefix
+		if rel != "." {
+			object = path.Join(prefix, filepath.ToSlash(rel))
+		}
+		sum, err := checksum(file)
+		if err != nil {
+			return err
+		}
+		opts := minio.PutObjectOptions{UserMetadata: map[string]string{checksumMeta: sum}}
+		if _, err := s.client.FPutObject(ctx, s.bucket, object, file, opts); err != nil {
+			return fmt.Errorf("upload %s: %w", object, err)
+		}
+		return nil
+	})
+}
+
+func (s *S3Store) Load(ctx context.Context, key Key, dst string) error {
+	prefix := key.Path()
+	if _, err := s.client.StatObject(ctx, s.bucket, prefix, minio.StatObjectOptions{}); err == nil {
+		return s.client.FGetObject(ctx, s.bucket, prefix, dst, minio.GetObjectOptions{})
+	}
+	found := false
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix + "/", Recursive: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+		found = true
+		to := filepath.Join(dst, filepath.FromSlash(strings.TrimPrefix(object.Key, prefix+"/")))
+		if err := s.client.FGetObject(ctx, s.bucket, object.Key, to, minio.GetObjectOptions{}); err != nil {
+			return fmt.Errorf("download %s: %w", object.Key, err)
+		}
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return os.MkdirAll(dst, 0o755)
+}
+
+func (s *S3Store) List(ctx context.Context, runID string) ([]Object, error) {
+	if err := CheckRunID(runID); err != nil {
+		return nil, err
+	}
+	workflows, err := s.runWorkflows(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+	objects := []Object{}
+	found := []string{}
+	for _, workflow := range workflows {
+		prefix := workflow + runID + "/"
+		for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+			if object.Err != nil {
+				return nil, object.Err
+			}
+			if !slices.Contains(found, workflow) {
+				found = append(found, workflow)
+			}
+			repo, _, _ := strings.Cut(workflow, "/")
+			stage, name, _ := strings.Cut(strings.TrimPrefix(object.Key, prefix), "/")
+			objects = append(objects, Object{
+				Repo:     repo,
+				Workflow: path.Base(workflow),
+				Stage:    stage,
+				Path:     name,
+				Size:     object.Size,
+			})
+		}
+	}
+	if len(found) > 0 {
+		s.runs.LoadOrStore(runID, found)
+	}
+	sortObjects(objects)
+	return objects, nil
+}
+
+// runWorkflows returns the <repo>/<workflow>/ prefixes that may hold
+// artifacts of the run. Keys start with <repo>/<workflow>/<runid>/, unknown
+// runs are looked for in the first two levels instead of listing the whole
+// bucket.
+func (s *S3Store) runWorkflows(ctx context.Context, runID string) ([]string, error) {
+	if workflows, ok := s.runs.Load(runID); ok {
+		return workflows.([]string), nil
+	}
+	repos, err := s.prefixes(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	all := []string{}
+	for _, repo := range repos {
+		workflows, err := s.prefixes(ctx, repo)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, workflows...)
+	}
+	return all, nil
+}
+
+func (s *S3Store) Checksum(ctx context.Context, key Key) (string, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, key.Path(), minio.StatObjectOptions{})
+	if err != nil {
+		return "", err
+	}
+	return info.UserMetadata[checksumMeta], nil
+}
+
+// prefixes returns the "directories" directly under prefix, with a trailing slash.
+func (s *S3Store) prefixes(ctx context.Context, prefix string) ([]string, error) {
+	prefixes := []string{}
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		if strings.HasSuffix(object.Key, "/") {
+			prefixes = append(prefixes, object.Key)
+		}
+	}
+	return prefixes, nil
+}
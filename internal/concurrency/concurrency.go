@@ -4,8 +4,11 @@ import (
 	"archive/zip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -14,60 +17,506 @@ import (
 
 	"github.com/docker/docker/client"
 	"github.com/google/uuid"
+	"github.com/jatalocks/opsilon/internal/artifacts"
+	"github.com/jatalocks/opsilon/internal/condition"
 	"github.com/jatalocks/opsilon/internal/config"
 	"github.com/jatalocks/opsilon/internal/db"
 	"github.com/jatalocks/opsilon/internal/engine"
+	"github.com/jatalocks/opsilon/internal/executor"
+	"github.com/jatalocks/opsilon/internal/get"
+	"github.com/jatalocks/opsilon/internal/graph"
 	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"github.com/jatalocks/opsilon/internal/interpolate"
 	"github.com/jatalocks/opsilon/internal/kubengine"
 	"github.com/jatalocks/opsilon/internal/logger"
-	"github.com/kendru/darwin/go/depgraph"
+	"github.com/jatalocks/opsilon/internal/matrix"
+	"github.com/jatalocks/opsilon/internal/secrets"
+	"github.com/jatalocks/opsilon/internal/shellengine"
 	"github.com/labstack/echo/v4"
 	"github.com/mitchellh/hashstructure/v2"
 	"github.com/slack-go/slack"
 	"github.com/spf13/viper"
 	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/exp/slices"
 )
 
-func workflowToGraph(g *depgraph.Graph, w internaltypes.Workflow) {
-	for _, s := range w.Stages {
-		needSplit := strings.Split(s.Needs, ",")
-		for _, v := range needSplit {
-			g.DependOn(s.ID, v)
+// runState is shared by all the stages of a single run.
+type runState struct {
+	mu            sync.Mutex
+	hash          string
+	checkout      string
+	store         artifacts.Store
+	scope         artifacts.Scope
+	secrets       []internaltypes.Env
+	masker        *logger.Masker
+	allOutputs    map[string][]internaltypes.Env
+	skippedStages []string
+	failedStages  []string
+	// statuses holds the status of every finished stage, and of matrix
+	// stages once their instances finished.
+	statuses map[string]string
+	// prefix is prepended to the stage names in the logs of nested runs.
+	prefix string
+}
+
+func newExecutor(registries []internaltypes.Registry) (executor.Executor, func(), error) {
+	switch executorName() {
+	case "kubernetes":
+		cli, err := kubengine.NewClient(registries)
+		return cli, func() {}, err
+	case "shell":
+		return shellengine.NewExecutor(), func() {}, nil
+	default:
+		cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		if err != nil {
+			return nil, func() {}, err
 		}
+		return engine.NewExecutor(cli, registries), func() { cli.Close() }, nil
 	}
 }
 
-func runStageGroupDocker(wg *sync.WaitGroup, stageIDs []string, cli *client.Client, ctx context.Context, w internaltypes.Workflow, allOutputs map[string][]internaltypes.Env, skippedStages *[]string, results chan internaltypes.Result, runid string) {
-	for _, id := range stageIDs {
-		go engine.Engine(cli, ctx, w, id, allOutputs, wg, skippedStages, results, runid)
+func executorName() string {
+	if viper.GetBool("kubernetes") {
+		return "kubernetes"
+	}
+	if name := viper.GetString("executor"); name != "" {
+		return name
 	}
+	return "docker"
 }
 
-// cli, wg, layer, cli, ctx, w, vol, allOutputs, &skippedStages
-// func runStageGroupKubernetes(cli *kubengine.Client, wg *sync.WaitGroup, stageIDs []string, ctx context.Context, w internaltypes.Workflow, vol string, claim *v1.PersistentVolumeClaim, allOutputs map[string][]internaltypes.Env, skippedStages *[]string, results chan internaltypes.Result) {
-func runStageGroupKubernetes(cli *kubengine.Client, wg *sync.WaitGroup, stageIDs []string, ctx context.Context, w internaltypes.Workflow, allOutputs map[string][]internaltypes.Env, skippedStages *[]string, results chan internaltypes.Result, runid string) {
+func runStageGroup(exec executor.Executor, wg *sync.WaitGroup, stageIDs []string, ctx context.Context, w internaltypes.Workflow, state *runState, results chan internaltypes.Result, runid string) {
 	for _, id := range stageIDs {
-		// go cli.KubeEngine(wg, id, ctx, w, vol, claim, allOutputs, skippedStages, results)
-		go cli.KubeEngine(wg, id, ctx, w, allOutputs, skippedStages, results, runid)
+		go runStage(exec, wg, id, ctx, w, state, results, runid)
+	}
+}
+
+func runStage(exec executor.Executor, wg *sync.WaitGroup, sID string, ctx context.Context, w internaltypes.Workflow, state *runState, results chan internaltypes.Result, runid string) {
+	defer wg.Done()
+	idx := slices.IndexFunc(w.Stages, func(c internaltypes.Stage) bool { return c.ID == sID })
+	stage := w.Stages[idx]
+	result := internaltypes.Result{Stage: stage}
+
+	state.mu.Lock()
+	// ${{ }} references are resolved before the stage runs, so that they see
+	// the outputs of the stages it needs.
+	resolvedW, resolved, resolveErr := interpolate.Resolve(w, stage, state.allOutputs)
+	allEnvs, needSplit, LwWhite, LwCrossed, LwRed := engine.PrepareStage(engine.MergeEnv(w.Env, state.secrets), resolved.Env, w.Input, stage.Needs, state.allOutputs, state.prefix+stage.Stage, stage.ID, &result, runid, state.hash, state.masker)
+	toSkip := false
+	needsFailed := false
+	needStatuses := make(map[string]string)
+	for _, need := range needSplit {
+		if slices.Contains(state.skippedStages, need) {
+			toSkip = true
+		}
+		if slices.Contains(state.failedStages, need) {
+			needsFailed = true
+		}
+		if status, ok := state.statuses[need]; ok {
+			needStatuses[need] = status
+		}
+	}
+	state.mu.Unlock()
+	// always(), failure() and status() in the if condition opt into running
+	// after a needed stage was skipped or failed.
+	handlesFailure := condition.HandlesFailure(stage.If)
+	conditionCtx := condition.Context{Values: allEnvs, Needs: needStatuses, NeedsFailed: needsFailed, NeedsSkipped: toSkip}
+
+	if ctx.Err() != nil {
+		result.Status = internaltypes.StatusCancelled
+		LwCrossed.Println("Stage Cancelled")
+	} else if toSkip && !handlesFailure {
+		result.Skipped = true
+		result.Status = internaltypes.StatusSkipped
+		LwCrossed.Println("Stage Skipped due to needed stage skipped")
+	} else if needsFailed && !handlesFailure {
+		result.Skipped = true
+		result.Status = internaltypes.StatusSkipped
+		LwCrossed.Println("Stage Skipped due to needed stage failed")
+	} else if ok, err := evaluateCondition(stage.If, conditionCtx, LwWhite); err != nil {
+		result.Status = internaltypes.StatusFailure
+		LwRed.Write([]byte(err.Error() + "\n"))
+		LwCrossed.Println("Stage Failed due to IF condition error")
+	} else if !ok {
+		result.Skipped = true
+		result.Status = internaltypes.StatusSkipped
+		LwCrossed.Println("Stage Skipped due to IF condition")
+	} else if resolveErr != nil {
+		result.Status = internaltypes.StatusFailure
+		LwRed.Write([]byte(resolveErr.Error() + "\n"))
+		LwCrossed.Println("Stage Failed due to unresolved references")
+	} else {
+		LwWhite.Write([]byte(fmt.Sprintf("Running Stage with the following variables: %s\n", engine.GenEnv(allEnvs))))
+		if stage.Uses != "" {
+			runUses(ctx, resolved, state, &result, LwWhite, LwRed)
+		} else {
+			run := executor.StageRun{Stage: resolved, Workflow: resolvedW, RunID: runid, Env: allEnvs, LwWhite: LwWhite, LwRed: LwRed, Artifacts: state.store, Scope: state.scope}
+			if !internaltypes.IsTrue(stage.Clean) {
+				run.Checkout = state.checkout
+			}
+			runAttempts(exec, ctx, run, &result, LwCrossed)
+		}
+		result.Result = (result.Status == internaltypes.StatusSuccess)
+		if !result.Result && internaltypes.IsTrue(stage.ContinueOnError) {
+			LwCrossed.Println("Stage Failed, continuing due to continue_on_error")
+		}
+	}
+
+	state.mu.Lock()
+	if result.Skipped {
+		state.skippedStages = append(state.skippedStages, stage.ID)
+	} else if FailsRun(result) {
+		state.failedStages = append(state.failedStages, stage.ID)
+	}
+	state.allOutputs[stage.ID] = result.Outputs
+	state.statuses[stage.ID] = result.Status
+	if stage.MatrixOf != "" {
+		recordMatrixInstance(w, state, stage.MatrixOf, FailsRun(result))
+	}
+	state.mu.Unlock()
+	// Needing stages read the outputs from state, the result is printed and
+	// stored.
+	result.Outputs = maskEnv(state.masker, result.Outputs)
+	results <- result
+}
+
+// maskEnv returns a copy of envs with secret values masked.
+func maskEnv(masker *logger.Masker, envs []internaltypes.Env) []internaltypes.Env {
+	masked := make([]internaltypes.Env, len(envs))
+	for i, e := range envs {
+		masked[i] = internaltypes.Env{Name: e.Name, Value: masker.Mask(e.Value)}
+	}
+	return masked
+}
+
+// recordMatrixInstance updates the matrix stage an instance was expanded from,
+// so that stages needing it see the aggregated outputs of all its instances.
+// The matrix stage fails as soon as one instance fails and is skipped when
+// every instance was skipped. state.mu must be held.
+func recordMatrixInstance(w internaltypes.Workflow, state *runState, parent string, failed bool) {
+	instances := matrix.Instances(w, parent)
+	outputs := [][]internaltypes.Env{}
+	allSkipped := true
+	for _, id := range instances {
+		outputs = append(outputs, state.allOutputs[id])
+		if !slices.Contains(state.skippedStages, id) {
+			allSkipped = false
+		}
+	}
+	state.allOutputs[parent] = matrix.Aggregate(outputs)
+	if failed && !slices.Contains(state.failedStages, parent) {
+		state.failedStages = append(state.failedStages, parent)
+	}
+	if allSkipped {
+		state.skippedStages = append(state.skippedStages, parent)
+	}
+	switch {
+	case slices.Contains(state.failedStages, parent):
+		state.statuses[parent] = internaltypes.StatusFailure
+	case allSkipped:
+		state.statuses[parent] = internaltypes.StatusSkipped
+	default:
+		state.statuses[parent] = internaltypes.StatusSuccess
+	}
+}
+
+// caller is set on the context of a nested run, started by a stage that
+// uses a workflow, to prefix its logs and hand back its results. The nested
+// run is part of the calling run: it has its run ID, its history and its
+// artifacts.
+type caller struct {
+	prefix  string
+	masker  *logger.Masker // Of the calling run, whose secrets stay masked.
+	hash    string
+	scope   artifacts.Scope
+	results []internaltypes.Result
+	// outputs of the stages of the workflow, in the order they are defined.
+	outputs []internaltypes.Env
+}
+
+type callerKey struct{}
+
+// runUses runs the workflow the stage uses as a nested run, with the with
+// values of the stage as its inputs. The outputs of the nested stages become
+// the outputs of the stage, and their logs are added to its logs.
+func runUses(ctx context.Context, stage internaltypes.Stage, state *runState, result *internaltypes.Result, LwWhite, LwRed *logger.MyLogWriter) {
+	result.Attempts = 1
+	w, err := get.GetWorkflow(stage.Uses)
+	if err == nil {
+		err = withInputs(&w, stage.With)
+	}
+	if err != nil {
+		result.Status = internaltypes.StatusFailure
+		LwRed.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	ctx, cancel, err := withTimeout(ctx, stage.Timeout)
+	if err != nil {
+		result.Status = internaltypes.StatusFailure
+		LwRed.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	defer cancel()
+	c := &caller{prefix: state.prefix + stage.ID + "/", masker: state.masker, hash: state.hash, scope: state.scope.Nested(stage.ID)}
+	LwWhite.Write([]byte(fmt.Sprintf("Running workflow %s\n", stage.Uses)))
+	success := ToGraph(context.WithValue(ctx, callerKey{}, c), w, nil, internaltypes.SlackMesseger{})
+	for _, r := range c.results {
+		result.Logs = append(result.Logs, r.Logs...)
+	}
+	result.Outputs = c.outputs
+	switch {
+	case ctx.Err() != nil:
+		result.Status = interruptedStatus(ctx)
+	case success:
+		result.Status = internaltypes.StatusSuccess
+	default:
+		result.Status = internaltypes.StatusFailure
+		LwRed.Write([]byte(fmt.Sprintf("Workflow %s failed\n", stage.Uses)))
+	}
+}
+
+// withInputs sets the inputs of a used workflow from the with values of the
+// stage. Inputs that are not optional need a value or a default.
+func withInputs(w *internaltypes.Workflow, with map[string]string) error {
+	for name := range with {
+		if slices.IndexFunc(w.Input, func(i internaltypes.Input) bool { return i.Name == name }) == -1 {
+			return fmt.Errorf("workflow %s/%s has no input named %s", w.Repo, w.ID, name)
+		}
+	}
+	for i, input := range w.Input {
+		value, ok := with[input.Name]
+		if !ok {
+			if !input.Optional && input.Default == "" {
+				return fmt.Errorf("input %s of workflow %s/%s is mandatory but none was provided", input.Name, w.Repo, w.ID)
+			}
+			continue
+		}
+		if value != "" {
+			checked, err := input.Check(value)
+			if err != nil {
+				return fmt.Errorf("input %s of workflow %s/%s: %w", input.Name, w.Repo, w.ID, err)
+			}
+			value = checked
+		}
+		w.Input[i].Default = value
+	}
+	return nil
+}
+
+// evaluateCondition evaluates the if condition of a stage, logging it with
+// the variables it can read.
+func evaluateCondition(cond string, ctx condition.Context, LwWhite *logger.MyLogWriter) (bool, error) {
+	if cond == "" {
+		return true, nil
+	}
+	LwWhite.Write([]byte(fmt.Sprintf("Evaluating If Statement: %s, with the following variables: %s\n", cond, ctx.Values)))
+	return condition.Evaluate(cond, ctx)
+}
+
+// FailsRun reports whether the stage result makes the whole run fail.
+// Skipped stages and stages with continue_on_error never do.
+func FailsRun(r internaltypes.Result) bool {
+	return !r.Skipped && !r.Result && !internaltypes.IsTrue(r.Stage.ContinueOnError)
+}
+
+// runAttempts runs the stage, re-running it in a fresh container, pod or
+// workspace as long as its retry policy allows. It sets the outputs, status
+// and image digest of the last attempt on the result, along with the number
+// of attempts made.
+func runAttempts(exec executor.Executor, ctx context.Context, run executor.StageRun, result *internaltypes.Result, LwCrossed *log.Logger) {
+	stage := run.Stage
+	attempts := 1
+	var backoff time.Duration
+	if stage.Retry != nil {
+		if stage.Retry.Attempts > 1 {
+			attempts = stage.Retry.Attempts
+		}
+		backoff, _ = time.ParseDuration(stage.Retry.Backoff)
+	}
+	for attempt := 1; ; attempt++ {
+		if attempts > 1 {
+			run.LwWhite.Write([]byte(fmt.Sprintf("Attempt %d of %d\n", attempt, attempts)))
+		}
+		// Every attempt gets its own copy, RunStage sets the workspace on it.
+		attemptRun := run
+		outputs, status, exitCode, runErr := runAttempt(exec, ctx, &attemptRun, result, LwCrossed)
+		result.Outputs, result.Status, result.Attempts = outputs, status, attempt
+		if status == internaltypes.StatusSuccess || ctx.Err() != nil || attempt >= attempts || !retryable(stage.Retry, status, exitCode, runErr) {
+			return
+		}
+		run.LwWhite.Write([]byte(fmt.Sprintf("Attempt %d failed, retrying in %s\n", attempt, backoff)))
+		select {
+		case <-ctx.Done():
+			LwCrossed.Println("Stage Cancelled")
+			result.Status = interruptedStatus(ctx)
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// runAttempt runs the stage once and returns its outputs, status and exit
+// code. The digest of the image that ran is set on the result.
+func runAttempt(exec executor.Executor, ctx context.Context, run *executor.StageRun, result *internaltypes.Result, LwCrossed *log.Logger) ([]internaltypes.Env, string, int, error) {
+	LwRed := run.LwRed
+	stageCtx, cancelStage, err := withTimeout(ctx, run.Stage.Timeout)
+	if err != nil {
+		LwRed.Write([]byte(err.Error() + "\n"))
+		return nil, internaltypes.StatusFailure, -1, err
+	}
+	defer cancelStage()
+	exitCode, runErr := exec.RunStage(stageCtx, run)
+	if run.ImageDigest != "" {
+		result.ImageDigest = run.ImageDigest
+	}
+	if runErr != nil && stageCtx.Err() == nil {
+		LwRed.Write([]byte(runErr.Error() + "\n"))
+	}
+	// The stage context may already be done, containers and pods
+	// still have to be collected and removed.
+	cleanupCtx := context.Background()
+	outputs, collectErr := exec.Collect(cleanupCtx, run)
+	if collectErr != nil {
+		LwRed.Write([]byte(collectErr.Error() + "\n"))
+	}
+	exec.Cleanup(cleanupCtx, run)
+	if stageCtx.Err() != nil {
+		status := interruptedStatus(stageCtx)
+		if status == internaltypes.StatusTimeout {
+			LwCrossed.Println("Stage Timed Out")
+		} else {
+			LwCrossed.Println("Stage Cancelled")
+		}
+		return outputs, status, exitCode, stageCtx.Err()
+	}
+	if runErr == nil && exitCode == 0 {
+		// Artifacts that were not found fail the stage when its
+		// if_no_files_found policy is error, artifacts that were not
+		// saved always do.
+		var saveErr *artifacts.SaveError
+		if errors.Is(collectErr, artifacts.ErrNoFiles) || errors.As(collectErr, &saveErr) {
+			return outputs, internaltypes.StatusFailure, exitCode, collectErr
+		}
+		return outputs, internaltypes.StatusSuccess, exitCode, nil
+	}
+	if runErr == nil {
+		LwRed.Write([]byte(fmt.Sprintf("Stage exited with code %d\n", exitCode)))
+	}
+	return outputs, internaltypes.StatusFailure, exitCode, runErr
+}
+
+// retryable reports whether a failed attempt should be retried. Without an
+// exit code filter every failure is retried, including timeouts.
+func retryable(retry *internaltypes.Retry, status string, exitCode int, err error) bool {
+	if retry == nil || status == internaltypes.StatusCancelled {
+		return false
 	}
+	if len(retry.ExitCodes) == 0 {
+		return true
+	}
+	return err == nil && slices.Contains(retry.ExitCodes, exitCode)
+}
+
+// withTimeout returns a context that is done after the given duration.
+// An empty timeout means the context is only done when its parent is.
+func withTimeout(parent context.Context, timeout string) (context.Context, context.CancelFunc, error) {
+	if timeout == "" {
+		ctx, cancel := context.WithCancel(parent)
+		return ctx, cancel, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid timeout %s: %w", timeout, err)
+	}
+	ctx, cancel := context.WithTimeout(parent, d)
+	return ctx, cancel, nil
 }
 
-func ToGraph(w internaltypes.Workflow, c echo.Context, slacker internaltypes.SlackMesseger) {
-	skippedStages := make([]string, 0)
-	ctx := context.Background()
-	k8s := viper.GetBool("kubernetes")
-	fmt.Println("K8S", k8s)
+// interruptedStatus returns the status of a stage whose context is done.
+func interruptedStatus(ctx context.Context) string {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return internaltypes.StatusTimeout
+	}
+	return internaltypes.StatusCancelled
+}
+
+// CancelRunAction is the action ID of the Slack button that cancels a run.
+const CancelRunAction = "cancel-run"
+
+var (
+	runsMu sync.Mutex
+	runs   = make(map[string]context.CancelFunc)
+)
+
+// Cancel stops the run with the given ID. Running containers and pods are
+// removed and every stage that did not finish is marked as cancelled.
+// It returns false if no such run is in progress.
+func Cancel(runid string) bool {
+	runsMu.Lock()
+	defer runsMu.Unlock()
+	cancel, ok := runs[runid]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// ToGraph runs the workflow and reports whether the run succeeded: it was not
+// cancelled or timed out and no stage failed without continue_on_error.
+// Nested runs, started by a stage that uses a workflow, run as part of the
+// calling run: the caller records and prints their results.
+func ToGraph(parent context.Context, w internaltypes.Workflow, c echo.Context, slacker internaltypes.SlackMesseger) bool {
+	nested, _ := parent.Value(callerKey{}).(*caller)
+	ctx, cancel, err := withTimeout(parent, w.Timeout)
+	if err != nil {
+		logger.Error("Workflow", w.ID, "cannot run:", err.Error())
+		return false
+	}
+	defer cancel()
 	results := make(chan internaltypes.Result)
 	resultsArray := []internaltypes.Result{}
-	u, err := uuid.NewUUID()
+	runid := ""
+	if nested != nil {
+		runid = nested.scope.RunID
+	} else {
+		logger.Info("Executor", executorName())
+		u, err := uuid.NewUUID()
+		logger.HandleErr(err)
+		runid = fmt.Sprint(u)
+
+		runsMu.Lock()
+		runs[runid] = cancel
+		runsMu.Unlock()
+		defer func() {
+			runsMu.Lock()
+			delete(runs, runid)
+			runsMu.Unlock()
+		}()
+	}
+
+	if c != nil {
+		c.Response().Header().Set("X-Run-Id", runid)
+		c.Response().WriteHeader(http.StatusOK)
+	}
+	if slacker.Callback != nil {
+		if err := postCancelButton(slacker, w, runid); err != nil {
+			fmt.Printf("Error encountered when posting cancel button: %+v\n", err)
+		}
+	}
+
+	// The hash identifies the workflow in the history, so it is taken
+	// before matrix stages are expanded.
+	tempW := w
+	tempW.Input = []internaltypes.Input{}
+	hash, err := hashstructure.Hash(tempW, hashstructure.FormatV2, nil)
+	strHash := fmt.Sprint(hash)
 	logger.HandleErr(err)
+	if nested != nil {
+		strHash = nested.hash
+	}
 
-	if viper.GetBool("database") {
-		tempW := w
-		tempW.Input = []internaltypes.Input{}
-		hash, err := hashstructure.Hash(tempW, hashstructure.FormatV2, nil)
-		strHash := fmt.Sprint(hash)
-		logger.HandleErr(err)
+	if viper.GetBool("database") && nested == nil {
 		ticker := time.NewTicker(1 * time.Second)
 		tickerTime := 0
 		quit := make(chan struct{})
@@ -75,10 +524,10 @@ func ToGraph(w internaltypes.Workflow, c echo.Context, slacker internaltypes.Sla
 			for {
 				select {
 				case <-ticker.C:
-					go db.InsertOne("logs", internaltypes.RunLog{Log: fmt.Sprint(tickerTime), Stage: "system", RunID: fmt.Sprint(u), Workflow: strHash, CreatedDate: time.Now(), UpdatedDate: time.Now()})
+					go db.InsertOne("logs", internaltypes.RunLog{Log: fmt.Sprint(tickerTime), Stage: "system", RunID: runid, Workflow: strHash, CreatedDate: time.Now(), UpdatedDate: time.Now()})
 					tickerTime += 1
 				case <-quit:
-					go db.InsertOne("logs", internaltypes.RunLog{Log: "done", Stage: "system", RunID: fmt.Sprint(u), Workflow: strHash, CreatedDate: time.Now(), UpdatedDate: time.Now()})
+					go db.InsertOne("logs", internaltypes.RunLog{Log: "done", Stage: "system", RunID: runid, Workflow: strHash, CreatedDate: time.Now(), UpdatedDate: time.Now()})
 					ticker.Stop()
 					return
 				}
@@ -88,76 +537,155 @@ func ToGraph(w internaltypes.Workflow, c echo.Context, slacker internaltypes.Sla
 
 	}
 
-	if !k8s {
-		cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-		logger.HandleErr(err)
-		defer cli.Close()
-		engine.PullImage(w.Image, ctx, cli)
+	definition := w
+	w, err = matrix.Expand(w)
+	if err != nil {
+		logger.Error("Run", runid, "Failed:", err.Error())
+		return false
+	}
+
+	checkout := ""
+	if internaltypes.IsTrue(w.Mount) {
+		checkout, err = get.Checkout(w)
+		if err != nil {
+			logger.Error("Run", runid, "Failed to check out repository", w.Repo+":", err.Error())
+			return false
+		}
+		defer os.RemoveAll(checkout)
+	}
 
-		// vol, dir := engine.CreateVolume(cli, ctx)
+	store, err := artifacts.FromConfig()
+	if err != nil {
+		logger.Error("Run", runid, "Failed to open the artifact store:", err.Error())
+		return false
+	}
 
-		// defer engine.RemoveVolume(vol.Name, ctx, cli)
-		// defer os.RemoveAll(dir)
+	secretEnv, err := secrets.Resolve(ctx, config.Secrets(w.Repo), w.Secrets)
+	if err != nil {
+		logger.Error("Run", runid, "Failed to read secrets:", err.Error())
+		return false
+	}
+	// Secrets are masked in the logs of this run only, and in the logs of
+	// the runs it nests, which may receive them as inputs.
+	masker := logger.NewMasker()
+	if nested != nil {
+		masker.Add(nested.masker.Values()...)
+	}
+	for _, e := range secretEnv {
+		masker.Add(e.Value)
+	}
+	for _, i := range w.Input {
+		if i.Secret {
+			masker.Add(i.Default)
+		}
+	}
+	defer masker.Activate()()
 
-		allOutputs := make(map[string][]internaltypes.Env, 0)
+	exec, closeExec, err := newExecutor(config.Registries(w.Repo))
+	logger.HandleErr(err)
+	defer closeExec()
+	defer exec.Finish(context.Background())
+	if err := exec.Prepare(ctx, w, runid); err != nil {
+		logger.Error("Run", runid, "Failed to prepare the run:", err.Error())
+		return false
+	}
 
-		wg := new(sync.WaitGroup)
-		g := depgraph.New()
-		workflowToGraph(g, w)
+	state := &runState{hash: strHash, checkout: checkout, store: store, scope: artifacts.Scope{Repo: w.Repo, Workflow: w.ID, RunID: runid}, secrets: secretEnv, masker: masker, allOutputs: make(map[string][]internaltypes.Env, 0), skippedStages: make([]string, 0), statuses: make(map[string]string)}
+	if nested != nil {
+		state.prefix = nested.prefix
+		state.scope = nested.scope
+	}
 
-		for _, layer := range g.TopoSortedLayers() {
-			if (len(layer) > 0) && (layer[0] != "") {
-				fmt.Printf("Running in Parallel: %s\n", strings.Join(layer, ", "))
-				wg.Add(len(layer))
-				go processResults(&results, &resultsArray, c, w, slacker, u)
-				go runStageGroupDocker(wg, layer, cli, ctx, w, allOutputs, &skippedStages, results, fmt.Sprint(u))
-				wg.Wait()
-			}
+	processed := make(chan struct{})
+	go func() {
+		processResults(&results, &resultsArray, c, definition, slacker, runid, nested == nil)
+		close(processed)
+	}()
+
+	wg := new(sync.WaitGroup)
+	for _, layer := range graph.Layers(w) {
+		fmt.Printf("Running in Parallel: %s\n", strings.Join(layer, ", "))
+		wg.Add(len(layer))
+		go runStageGroup(exec, wg, layer, ctx, w, state, results, runid)
+		wg.Wait()
+	}
+	close(results)
+	<-processed
+	success := ctx.Err() == nil
+	for _, r := range resultsArray {
+		if FailsRun(r) {
+			success = false
 		}
-	} else {
-		cli, err := kubengine.NewClient()
-		logger.HandleErr(err)
-		// defer cli.DeleteNamespace(ctx)
-		// vol, claim := cli.CreateVolume(ctx)
-		allOutputs := make(map[string][]internaltypes.Env, 0)
-
-		wg := new(sync.WaitGroup)
-		g := depgraph.New()
-		workflowToGraph(g, w)
-		for _, layer := range g.TopoSortedLayers() {
-			if (len(layer) > 0) && (layer[0] != "") {
-				fmt.Printf("Running in Parallel: %s\n", strings.Join(layer, ", "))
-				wg.Add(len(layer))
-
-				go processResults(&results, &resultsArray, c, w, slacker, u)
-				// go runStageGroupKubernetes(cli, wg, layer, ctx, w, vol, claim, allOutputs, &skippedStages, results)
-				go runStageGroupKubernetes(cli, wg, layer, ctx, w, allOutputs, &skippedStages, results, fmt.Sprint(u))
-				wg.Wait()
-			}
+	}
+	if nested != nil {
+		nested.results = resultsArray
+		for _, s := range definition.Stages {
+			nested.outputs = engine.MergeEnv(nested.outputs, state.allOutputs[s.ID])
 		}
-		// cli.RemoveVolume(ctx, vol, claim)
-		time.Sleep(1 * time.Second)
+		return success
 	}
+
 	config.PrintStageResults(resultsArray)
+	if ctx.Err() != nil {
+		if interruptedStatus(ctx) == internaltypes.StatusTimeout {
+			logger.Error("Run", runid, "Timed Out after", w.Timeout)
+		} else {
+			logger.Error("Run", runid, "Cancelled")
+		}
+	} else if success {
+		logger.Success("Run", runid, "Succeeded")
+	} else {
+		logger.Error("Run", runid, "Failed")
+	}
 	if slacker.Callback != nil {
+		if success {
+			streamResultToSlackContext(slacker, fmt.Sprint(":white_check_mark: Workflow ", w.ID, " Succeeded"))
+		} else {
+			streamResultToSlackContext(slacker, fmt.Sprint(":x: Workflow ", w.ID, " Failed"))
+		}
 		var logs []string
-		var artifacts []string
-		current, _ := os.Getwd()
+		var uploads []string
+		// Artifacts may live in a remote store, load them into a temporary
+		// directory before uploading.
+		dir, err := os.MkdirTemp("", "opsilon-slack")
+		logger.HandleErr(err)
+		defer os.RemoveAll(dir)
 
+		// Artifacts are patterns, the files they selected are the ones the
+		// stages saved.
+		objects, err := store.List(context.Background(), runid)
+		if err != nil {
+			fmt.Printf("Error encountered when listing artifacts: %+v\n", err)
+		}
 		for _, r := range resultsArray {
 			logs = append(logs, r.Logs...)
-			for _, v := range r.Stage.Artifacts {
-				to := filepath.Join(current, r.Stage.ID, v)
-				artifacts = append(artifacts, to)
+			patterns := r.Stage.Artifacts
+			if r.Stage.Uses != "" {
+				// The stages of the used workflow saved their artifacts
+				// under the stage.
+				patterns = []string{"**"}
+			}
+			if len(patterns) == 0 {
+				continue
+			}
+			selected, _ := artifacts.NewPatterns(patterns).Select(state.scope.Names(objects, r.Stage.ID))
+			for _, name := range selected {
+				to := filepath.Join(dir, r.Stage.ID, filepath.FromSlash(name))
+				key := state.scope.Key(r.Stage.ID, name)
+				if err := store.Load(context.Background(), key, to); err != nil {
+					fmt.Printf("Error encountered when loading artifact %s: %+v\n", key.Path(), err)
+					continue
+				}
+				uploads = append(uploads, to)
 			}
 		}
 		slacker.Slacker.Client().PostMessage(slacker.Callback.Channel.ID, slack.MsgOptionText("Uploading logs ...", false))
-		_, err := slacker.Slacker.Client().UploadFile(slack.FileUploadParameters{Content: strings.Join(logs, "\n"), Channels: []string{slacker.Callback.Channel.ID}})
+		_, err = slacker.Slacker.Client().UploadFile(slack.FileUploadParameters{Content: strings.Join(logs, "\n"), Channels: []string{slacker.Callback.Channel.ID}})
 		if err != nil {
 			fmt.Printf("Error encountered when uploading logs: %+v\n", err)
 		}
 		slacker.Slacker.Client().PostMessage(slacker.Callback.Channel.ID, slack.MsgOptionText("Uploading artifacts ...", false))
-		for _, v := range artifacts {
+		for _, v := range uploads {
 
 			fileInfo, err := os.Stat(v)
 			if err != nil {
@@ -165,8 +693,7 @@ func ToGraph(w internaltypes.Workflow, c echo.Context, slacker internaltypes.Sla
 			} else {
 				fmt.Printf("Trying to upload %v", v)
 				if fileInfo.IsDir() {
-					defer os.Remove(v + ".zip")
-					if err := zipSource(v, v+".zip"); err != nil {
+					if err := ZipSource(v, v+".zip"); err != nil {
 						fmt.Printf("Error encountered when zipping artifact: %+v\n", err)
 					}
 					_, err := slacker.Slacker.Client().UploadFile(slack.FileUploadParameters{File: v + ".zip", Channels: []string{slacker.Callback.Channel.ID}})
@@ -174,7 +701,6 @@ func ToGraph(w internaltypes.Workflow, c echo.Context, slacker internaltypes.Sla
 						fmt.Printf("Error encountered when uploading artifact: %+v\n", err)
 					}
 				} else {
-					defer os.Remove(v)
 					_, err := slacker.Slacker.Client().UploadFile(slack.FileUploadParameters{File: v, Channels: []string{slacker.Callback.Channel.ID}})
 					if err != nil {
 						fmt.Printf("Error encountered when uploading artifact: %+v\n", err)
@@ -183,8 +709,11 @@ func ToGraph(w internaltypes.Workflow, c echo.Context, slacker internaltypes.Sla
 			}
 		}
 	}
+	return success
 }
-func zipSource(source, target string) error {
+
+// ZipSource writes the file or directory source to the zip file target.
+func ZipSource(source, target string) error {
 	// 1. Create a ZIP file and zip.Writer
 	f, err := os.Create(target)
 	if err != nil {
@@ -240,7 +769,9 @@ func zipSource(source, target string) error {
 	})
 }
 
-func processResults(results *chan internaltypes.Result, resultsArray *[]internaltypes.Result, c echo.Context, w internaltypes.Workflow, slacker internaltypes.SlackMesseger, u uuid.UUID) {
+// processResults collects the stage results of a run as they finish and
+// reports them. Results of top-level runs are recorded in the history.
+func processResults(results *chan internaltypes.Result, resultsArray *[]internaltypes.Result, c echo.Context, w internaltypes.Workflow, slacker internaltypes.SlackMesseger, runid string, record bool) {
 	CreatedDate := time.Now()
 	for str := range *results {
 		*resultsArray = append(*resultsArray, str)
@@ -250,15 +781,17 @@ func processResults(results *chan internaltypes.Result, resultsArray *[]internal
 		strHash := fmt.Sprint(hash)
 		logger.HandleErr(err)
 		str.Workflow = strHash
-		go func() {
-			go db.ReplaceOne("workflows", bson.M{"_id": strHash}, tempW)
-			logger.HandleErr(err)
-			str.RunID = u.String()
-			str.CreatedDate = CreatedDate
-			str.UpdatedDate = time.Now()
-			go db.InsertOne("results", str)
-			logger.HandleErr(err)
-		}()
+		str.RunID = runid
+		if record {
+			go func() {
+				go db.ReplaceOne("workflows", bson.M{"_id": strHash}, tempW)
+				logger.HandleErr(err)
+				str.CreatedDate = CreatedDate
+				str.UpdatedDate = time.Now()
+				go db.InsertOne("results", str)
+				logger.HandleErr(err)
+			}()
+		}
 		if str.Result {
 			logger.Success("Stage", str.Stage.ID, "Success")
 			if slacker.Callback != nil {
@@ -270,6 +803,16 @@ func processResults(results *chan internaltypes.Result, resultsArray *[]internal
 				if slacker.Callback != nil {
 					streamResultToSlackContext(slacker, fmt.Sprint(":ballot_box_with_check: Stage ", str.Stage.ID, " Skipped"))
 				}
+			} else if str.Status == internaltypes.StatusTimeout {
+				logger.Error("Stage", str.Stage.ID, "Timed Out")
+				if slacker.Callback != nil {
+					streamResultToSlackContext(slacker, fmt.Sprint(":hourglass: Stage ", str.Stage.ID, " Timed Out"))
+				}
+			} else if str.Status == internaltypes.StatusCancelled {
+				logger.Error("Stage", str.Stage.ID, "Cancelled")
+				if slacker.Callback != nil {
+					streamResultToSlackContext(slacker, fmt.Sprint(":no_entry_sign: Stage ", str.Stage.ID, " Cancelled"))
+				}
 			} else {
 				logger.Error("Stage", str.Stage.ID, "Failed")
 				if slacker.Callback != nil {
@@ -300,6 +843,17 @@ func streamResultToEchoContext(c echo.Context, result internaltypes.Result) {
 	c.Response().Flush()
 }
 
+func postCancelButton(slacker internaltypes.SlackMesseger, w internaltypes.Workflow, runid string) error {
+	text := slack.NewTextBlockObject(slack.MarkdownType, fmt.Sprintf("Running *%s* (run `%s`)", w.ID, runid), false, false)
+	btn := slack.NewButtonBlockElement(CancelRunAction, runid, slack.NewTextBlockObject(slack.PlainTextType, "Cancel", false, false))
+	btn.Style = slack.StyleDanger
+	_, _, err := slacker.Slacker.Client().PostMessage(slacker.Callback.Channel.ID, slack.MsgOptionBlocks(
+		slack.NewSectionBlock(text, nil, nil),
+		slack.NewActionBlock(CancelRunAction, btn),
+	))
+	return err
+}
+
 func streamResultToSlackContext(slacker internaltypes.SlackMesseger, str string) error {
 	_, _, err := slacker.Slacker.Client().PostMessage(slacker.Callback.Channel.ID, slack.MsgOptionText(str, false),
 		slack.MsgOptionReplaceOriginal(slacker.Callback.ResponseURL))
@@ -0,0 +1,349 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jatalocks/opsilon/internal/artifacts"
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"github.com/spf13/viper"
+	"golang.org/x/exp/slices"
+)
+
+func TestWithTimeout(t *testing.T) {
+	ctx, cancel, err := withTimeout(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("withTimeout() without a timeout set a deadline")
+	}
+	cancel()
+	if ctx.Err() == nil {
+		t.Error("cancel() did not cancel the context")
+	}
+
+	ctx, cancel, err = withTimeout(context.Background(), "1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Hour {
+		t.Errorf("withTimeout(1h) deadline = %v, %v", deadline, ok)
+	}
+
+	if _, _, err := withTimeout(context.Background(), "ten minutes"); err == nil {
+		t.Error("withTimeout() with an invalid timeout succeeded")
+	}
+}
+
+// runNested runs w with the shell executor, as a nested run so that the
+// results of its stages are kept, and returns whether it succeeded and the
+// results by stage ID.
+func runNested(t *testing.T, ctx context.Context, w internaltypes.Workflow) (bool, map[string]internaltypes.Result) {
+	t.Helper()
+	viper.Set("executor", "shell")
+	viper.Set("artifact_path", t.TempDir())
+	t.Cleanup(viper.Reset)
+	w.Repo, w.ID = "repo", "test"
+	c := &caller{scope: artifacts.Scope{Repo: w.Repo, Workflow: w.ID, RunID: "run"}}
+	success := ToGraph(context.WithValue(ctx, callerKey{}, c), w, nil, internaltypes.SlackMesseger{})
+	results := make(map[string]internaltypes.Result)
+	for _, r := range c.results {
+		results[r.Stage.ID] = r
+	}
+	return success, results
+}
+
+func script(s string) []string {
+	return []string{"sh", "-c", s}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func statuses(results map[string]internaltypes.Result) map[string]string {
+	s := make(map[string]string, len(results))
+	for id, r := range results {
+		s[id] = r.Status
+	}
+	return s
+}
+
+func TestFailurePropagation(t *testing.T) {
+	tests := []struct {
+		name     string
+		stages   []internaltypes.Stage
+		success  bool
+		statuses map[string]string
+	}{
+		{
+			name: "dependents of failed and skipped stages are skipped",
+			stages: []internaltypes.Stage{
+				{ID: "a", Script: script("exit 1")},
+				{ID: "b", Needs: "a", Script: script("true")},
+				{ID: "c", Needs: "b", Script: script("true")},
+				{ID: "d", Script: script("true")},
+			},
+			statuses: map[string]string{"a": internaltypes.StatusFailure, "b": internaltypes.StatusSkipped, "c": internaltypes.StatusSkipped, "d": internaltypes.StatusSuccess},
+		},
+		{
+			name: "conditions that handle failures run",
+			stages: []internaltypes.Stage{
+				{ID: "a", Script: script("exit 1")},
+				{ID: "cleanup", Needs: "a", If: "always()", Script: script("true")},
+				{ID: "report", Needs: "a", If: "failure()", Script: script("true")},
+				{ID: "deploy", Needs: "a", If: "success()", Script: script("true")},
+			},
+			statuses: map[string]string{"a": internaltypes.StatusFailure, "cleanup": internaltypes.StatusSuccess, "report": internaltypes.StatusSuccess, "deploy": internaltypes.StatusSkipped},
+		},
+		{
+			name: "continue_on_error keeps dependents and the run going",
+			stages: []internaltypes.Stage{
+				{ID: "a", Script: script("exit 1"), ContinueOnError: boolPtr(true)},
+				{ID: "b", Needs: "a", Script: script("true")},
+			},
+			success:  true,
+			statuses: map[string]string{"a": internaltypes.StatusFailure, "b": internaltypes.StatusSuccess},
+		},
+		{
+			name: "skipped stages do not fail the run",
+			stages: []internaltypes.Stage{
+				{ID: "a", If: `$target == "prod"`, Script: script("true")},
+				{ID: "b", Needs: "a", Script: script("true")},
+			},
+			success:  true,
+			statuses: map[string]string{"a": internaltypes.StatusSkipped, "b": internaltypes.StatusSkipped},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := internaltypes.Workflow{Env: []internaltypes.Env{{Name: "target", Value: "dev"}}, Stages: tt.stages}
+			success, results := runNested(t, context.Background(), w)
+			if success != tt.success {
+				t.Errorf("ToGraph() = %v, want %v", success, tt.success)
+			}
+			if got := statuses(results); !reflect.DeepEqual(got, tt.statuses) {
+				t.Errorf("statuses = %v, want %v", got, tt.statuses)
+			}
+		})
+	}
+}
+
+func TestFailsRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		result internaltypes.Result
+		want   bool
+	}{
+		{name: "success", result: internaltypes.Result{Result: true}},
+		{name: "failure", result: internaltypes.Result{}, want: true},
+		{name: "skipped", result: internaltypes.Result{Skipped: true}},
+		{name: "failure with continue_on_error", result: internaltypes.Result{Stage: internaltypes.Stage{ContinueOnError: boolPtr(true)}}},
+		{name: "failure with continue_on_error false", result: internaltypes.Result{Stage: internaltypes.Stage{ContinueOnError: boolPtr(false)}}, want: true},
+	}
+	for _, tt := range tests {
+		if got := FailsRun(tt.result); got != tt.want {
+			t.Errorf("FailsRun(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	// The script fails until it ran the given number of times.
+	counter := func(succeedAt int, exitCode int) []string {
+		file := filepath.Join(t.TempDir(), "count")
+		return script(fmt.Sprintf(`n=$(($(cat %[1]s 2>/dev/null || echo 0) + 1)); echo $n > %[1]s; [ $n -ge %[2]d ] || exit %[3]d`, file, succeedAt, exitCode))
+	}
+	tests := []struct {
+		name     string
+		stage    internaltypes.Stage
+		status   string
+		attempts int
+		logs     []string
+	}{
+		{
+			name:     "no retries",
+			stage:    internaltypes.Stage{Script: counter(2, 1)},
+			status:   internaltypes.StatusFailure,
+			attempts: 1,
+		},
+		{
+			name:     "succeeds after retries with a doubling backoff",
+			stage:    internaltypes.Stage{Script: counter(3, 1), Retry: &internaltypes.Retry{Attempts: 4, Backoff: "10ms"}},
+			status:   internaltypes.StatusSuccess,
+			attempts: 3,
+			logs:     []string{"Attempt 1 failed, retrying in 10ms", "Attempt 2 failed, retrying in 20ms"},
+		},
+		{
+			name:     "gives up after the last attempt",
+			stage:    internaltypes.Stage{Script: counter(5, 1), Retry: &internaltypes.Retry{Attempts: 2}},
+			status:   internaltypes.StatusFailure,
+			attempts: 2,
+		},
+		{
+			name:     "exit codes that are not retried",
+			stage:    internaltypes.Stage{Script: counter(2, 1), Retry: &internaltypes.Retry{Attempts: 3, ExitCodes: []int{2}}},
+			status:   internaltypes.StatusFailure,
+			attempts: 1,
+		},
+		{
+			name:     "exit codes that are retried",
+			stage:    internaltypes.Stage{Script: counter(2, 2), Retry: &internaltypes.Retry{Attempts: 3, ExitCodes: []int{2}}},
+			status:   internaltypes.StatusSuccess,
+			attempts: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.stage.ID = "s"
+			_, results := runNested(t, context.Background(), internaltypes.Workflow{Stages: []internaltypes.Stage{tt.stage}})
+			r := results["s"]
+			if r.Status != tt.status || r.Attempts != tt.attempts {
+				t.Errorf("stage = %s after %d attempts, want %s after %d", r.Status, r.Attempts, tt.status, tt.attempts)
+			}
+			for _, want := range tt.logs {
+				if slices.IndexFunc(r.Logs, func(l string) bool { return strings.Contains(l, want) }) == -1 {
+					t.Errorf("logs %q do not contain %q", r.Logs, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	errRun := errors.New("container did not start")
+	tests := []struct {
+		name     string
+		retry    *internaltypes.Retry
+		status   string
+		exitCode int
+		err      error
+		want     bool
+	}{
+		{name: "no retry", status: internaltypes.StatusFailure, exitCode: 1},
+		{name: "any failure", retry: &internaltypes.Retry{Attempts: 2}, status: internaltypes.StatusFailure, exitCode: 1, want: true},
+		{name: "timeout", retry: &internaltypes.Retry{Attempts: 2}, status: internaltypes.StatusTimeout, exitCode: -1, want: true},
+		{name: "cancelled", retry: &internaltypes.Retry{Attempts: 2}, status: internaltypes.StatusCancelled, exitCode: -1},
+		{name: "listed exit code", retry: &internaltypes.Retry{Attempts: 2, ExitCodes: []int{137}}, status: internaltypes.StatusFailure, exitCode: 137, want: true},
+		{name: "other exit code", retry: &internaltypes.Retry{Attempts: 2, ExitCodes: []int{137}}, status: internaltypes.StatusFailure, exitCode: 1},
+		{name: "error with exit codes", retry: &internaltypes.Retry{Attempts: 2, ExitCodes: []int{137}}, status: internaltypes.StatusFailure, exitCode: -1, err: errRun},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.retry, tt.status, tt.exitCode, tt.err); got != tt.want {
+			t.Errorf("retryable(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	w := internaltypes.Workflow{Stages: []internaltypes.Stage{
+		{ID: "slow", Timeout: "100ms", Script: script("sleep 10")},
+		{ID: "fast", Timeout: "10s", Script: script("true")},
+	}}
+	start := time.Now()
+	success, results := runNested(t, context.Background(), w)
+	want := map[string]string{"slow": internaltypes.StatusTimeout, "fast": internaltypes.StatusSuccess}
+	if got := statuses(results); success || !reflect.DeepEqual(got, want) {
+		t.Errorf("ToGraph() = %v, %v, want false, %v", success, got, want)
+	}
+
+	w = internaltypes.Workflow{Timeout: "200ms", Stages: []internaltypes.Stage{
+		{ID: "slow", Script: script("sleep 10")},
+		{ID: "next", Needs: "slow", Script: script("true")},
+	}}
+	success, results = runNested(t, context.Background(), w)
+	want = map[string]string{"slow": internaltypes.StatusTimeout, "next": internaltypes.StatusCancelled}
+	if got := statuses(results); success || !reflect.DeepEqual(got, want) {
+		t.Errorf("ToGraph() = %v, %v, want false, %v", success, got, want)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timed out runs took %s", elapsed)
+	}
+
+	w = internaltypes.Workflow{Stages: []internaltypes.Stage{{ID: "s", Timeout: "soon", Script: script("true")}}}
+	if _, results := runNested(t, context.Background(), w); results["s"].Status != internaltypes.StatusFailure {
+		t.Errorf("stage with an invalid timeout = %s, want failure", results["s"].Status)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	if Cancel("unknown") {
+		t.Error("Cancel() of an unknown run succeeded")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	runsMu.Lock()
+	runs["run"] = cancel
+	runsMu.Unlock()
+	t.Cleanup(func() {
+		runsMu.Lock()
+		delete(runs, "run")
+		runsMu.Unlock()
+	})
+	if !Cancel("run") || ctx.Err() == nil {
+		t.Error("Cancel() did not cancel the run")
+	}
+}
+
+func TestCancelledRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := internaltypes.Workflow{Stages: []internaltypes.Stage{
+		{ID: "slow", Script: script("sleep 10")},
+		{ID: "next", Needs: "slow", Script: script("true")},
+	}}
+	time.AfterFunc(200*time.Millisecond, cancel)
+	success, results := runNested(t, ctx, w)
+	want := map[string]string{"slow": internaltypes.StatusCancelled, "next": internaltypes.StatusCancelled}
+	if got := statuses(results); success || !reflect.DeepEqual(got, want) {
+		t.Errorf("ToGraph() = %v, %v, want false, %v", success, got, want)
+	}
+}
+
+func TestWithInputs(t *testing.T) {
+	workflow := func() internaltypes.Workflow {
+		return internaltypes.Workflow{Repo: "repo", ID: "release", Input: []internaltypes.Input{
+			{Name: "version"},
+			{Name: "region", Default: "eu"},
+			{Name: "notes", Optional: true},
+			{Name: "replicas", Type: internaltypes.InputNumber, Optional: true},
+		}}
+	}
+	tests := []struct {
+		name    string
+		with    map[string]string
+		want    []string // The defaults of the inputs.
+		wantErr bool
+	}{
+		{name: "values and defaults", with: map[string]string{"version": "1.2", "replicas": "3"}, want: []string{"1.2", "eu", "", "3"}},
+		{name: "values replace defaults", with: map[string]string{"version": "1.2", "region": "us"}, want: []string{"1.2", "us", "", ""}},
+		{name: "mandatory input missing", with: map[string]string{"region": "us"}, wantErr: true},
+		{name: "unknown input", with: map[string]string{"version": "1.2", "zone": "a"}, wantErr: true},
+		{name: "invalid value", with: map[string]string{"version": "1.2", "replicas": "many"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := workflow()
+			err := withInputs(&w, tt.with)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("withInputs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := []string{}
+			for _, in := range w.Input {
+				got = append(got, in.Default)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("inputs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package condition
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Knetic/govaluate"
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"golang.org/x/exp/slices"
+)
+
+// Context is what a condition can read when it is evaluated.
+type Context struct {
+	// Values are the variables of the stage, read with $name.
+	Values []internaltypes.Env
+	// Needs holds the status of every needed stage by ID, read with
+	// status("id"). Outputs of needed stages are read with
+	// $needs.<id>.<key> from the NEEDS_<ID>_<KEY> values.
+	Needs map[string]string
+	// NeedsFailed is the value of failure(): whether a needed stage failed.
+	NeedsFailed bool
+	// NeedsSkipped is whether a needed stage was skipped.
+	NeedsSkipped bool
+}
+
+// Expression is a parsed if condition.
+type Expression struct {
+	rewritten string
+	variables []string
+	statusOf  []string
+}
+
+var (
+	// variable is a $name, $name.with.dots or $needs.<stage id>.<key>.
+	variable = regexp.MustCompile(`^\$[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z0-9_-]+)*`)
+	statusFn = regexp.MustCompile(`\bstatus\(\s*["']([^"']*)["']\s*\)`)
+	// handlesFailure matches the functions that opt into running after a
+	// needed stage failed or was skipped.
+	handlesFailure = regexp.MustCompile(`\b(always|failure|status)\(`)
+	// readsNeeds matches the functions that read the status of needed
+	// stages.
+	readsNeeds = regexp.MustCompile(`\b(success|failure|status)\(`)
+)
+
+// Parse parses a condition, reporting syntax errors and unknown functions.
+func Parse(condition string) (*Expression, error) {
+	rewritten, variables, err := rewrite(condition)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := govaluate.NewEvaluableExpressionWithFunctions(rewritten, functions(Context{})); err != nil {
+		return nil, fmt.Errorf("invalid condition %s: %w", condition, err)
+	}
+	e := &Expression{rewritten: rewritten, variables: variables}
+	for _, m := range statusFn.FindAllStringSubmatch(condition, -1) {
+		e.statusOf = append(e.statusOf, m[1])
+	}
+	return e, nil
+}
+
+// Check parses the condition of a stage and verifies that every
+// $needs.<id>.<key> and status("id") refers to a stage in needs, and that
+// every other variable is in known. Stages with needs can also read the
+// outputs of the stages they need, which are only known once those run, so
+// their other variables are not checked.
+func Check(condition string, needs []string, known []string) error {
+	if condition == "" {
+		return nil
+	}
+	e, err := Parse(condition)
+	if err != nil {
+		return err
+	}
+	hasNeeds := slices.IndexFunc(needs, func(n string) bool { return n != "" }) != -1
+	referenced := append([]string{}, e.statusOf...)
+	unknown := []string{}
+	for _, v := range e.variables {
+		if id, _, ok := needsVariable(v); ok {
+			referenced = append(referenced, id)
+		} else if !hasNeeds && !slices.Contains(known, v) && !slices.Contains(unknown, "$"+v) {
+			unknown = append(unknown, "$"+v)
+		}
+	}
+	for _, id := range referenced {
+		if !slices.Contains(needs, id) {
+			return fmt.Errorf("condition %s refers to stage %s, which is not in needs", condition, id)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("condition %s uses unknown variables %s", condition, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// HandlesFailure reports whether the condition explicitly opts into running
+// after a needed stage failed or was skipped, by calling always(),
+// failure() or status().
+func HandlesFailure(condition string) bool {
+	return handlesFailure.MatchString(condition)
+}
+
+// Static reports whether the condition can be evaluated before the stages
+// it needs run: it does not read their status with success(), failure() or
+// status(), and every variable it reads is in values.
+func Static(condition string, values []internaltypes.Env) bool {
+	e, err := Parse(condition)
+	if err != nil || readsNeeds.MatchString(condition) {
+		return false
+	}
+	for _, v := range e.variables {
+		name := v
+		if id, key, ok := needsVariable(v); ok {
+			name = NeedsEnvName(id, key)
+		}
+		if _, found := lookup(values, name); !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Evaluate evaluates the condition. An empty condition is true. Missing
+// variables, syntax errors and conditions that are not true or false are
+// returned as errors.
+func Evaluate(condition string, ctx Context) (bool, error) {
+	if condition == "" {
+		return true, nil
+	}
+	e, err := Parse(condition)
+	if err != nil {
+		return false, err
+	}
+	parameters := make(map[string]interface{}, len(e.variables))
+	missing := []string{}
+	for _, v := range e.variables {
+		name := v
+		if id, key, ok := needsVariable(v); ok {
+			name = NeedsEnvName(id, key)
+		}
+		value, found := lookup(ctx.Values, name)
+		if !found {
+			missing = append(missing, "$"+v)
+			continue
+		}
+		parameters[v] = value
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return false, fmt.Errorf("condition %s uses undefined variables %s", condition, strings.Join(missing, ", "))
+	}
+	evaluable, err := govaluate.NewEvaluableExpressionWithFunctions(e.rewritten, functions(ctx))
+	if err != nil {
+		return false, err
+	}
+	result, err := evaluable.Evaluate(parameters)
+	if err != nil {
+		return false, fmt.Errorf("condition %s: %w", condition, err)
+	}
+	b, ok := result.(bool)
+	if !ok {
+		return false, fmt.Errorf("condition %s must be true or false, got %v", condition, result)
+	}
+	return b, nil
+}
+
+// rewrite replaces every $variable outside string literals with [variable],
+// the govaluate syntax for variable names with any character, and returns
+// the variable names.
+func rewrite(condition string) (string, []string, error) {
+	out := strings.Builder{}
+	variables := []string{}
+	var quote byte
+	for i := 0; i < len(condition); i++ {
+		c := condition[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && i+1 < len(condition) {
+				out.WriteByte(c)
+				i++
+				c = condition[i]
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '$':
+			name := variable.FindString(condition[i:])
+			if name == "" {
+				return "", nil, fmt.Errorf("invalid condition %s: $ must be followed by a variable name", condition)
+			}
+			name = strings.TrimPrefix(name, "$")
+			out.WriteString("[" + name + "]")
+			variables = append(variables, name)
+			i += len(name)
+			continue
+		}
+		out.WriteByte(c)
+	}
+	if quote != 0 {
+		return "", nil, fmt.Errorf("invalid condition %s: unterminated string", condition)
+	}
+	return out.String(), variables, nil
+}
+
+// needsVariable splits needs.<id>.<key> into the stage ID and the key.
+func needsVariable(v string) (string, string, bool) {
+	parts := strings.SplitN(v, ".", 3)
+	if len(parts) != 3 || parts[0] != "needs" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+var invalidEnvChars = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// NeedsEnvName returns the name of the variable holding the output key of
+// the needed stage id: NEEDS_<ID>_<KEY> in upper case, with characters that
+// are not valid in variable names replaced by _.
+func NeedsEnvName(id, key string) string {
+	return invalidEnvChars.ReplaceAllString(strings.ToUpper("NEEDS_"+id+"_"+key), "_")
+}
+
+func lookup(values []internaltypes.Env, name string) (string, bool) {
+	for _, v := range values {
+		if v.Name == name {
+			return v.Value, true
+		}
+	}
+	return "", false
+}
+
+func functions(ctx Context) map[string]govaluate.ExpressionFunction {
+	return map[string]govaluate.ExpressionFunction{
+		"always": func(args ...interface{}) (interface{}, error) {
+			return true, nil
+		},
+		"success": func(args ...interface{}) (interface{}, error) {
+			return !ctx.NeedsFailed && !ctx.NeedsSkipped, nil
+		},
+		"failure": func(args ...interface{}) (interface{}, error) {
+			return ctx.NeedsFailed, nil
+		},
+		"status": func(args ...interface{}) (interface{}, error) {
+			id, err := stringArgs("status", 1, args)
+			if err != nil {
+				return nil, err
+			}
+			status, ok := ctx.Needs[id[0]]
+			if !ok {
+				return nil, fmt.Errorf("status(%q): %s is not a needed stage", id[0], id[0])
+			}
+			return status, nil
+		},
+		"contains": func(args ...interface{}) (interface{}, error) {
+			s, err := stringArgs("contains", 2, args)
+			if err != nil {
+				return nil, err
+			}
+			return strings.Contains(s[0], s[1]), nil
+		},
+		"startsWith": func(args ...interface{}) (interface{}, error) {
+			s, err := stringArgs("startsWith", 2, args)
+			if err != nil {
+				return nil, err
+			}
+			return strings.HasPrefix(s[0], s[1]), nil
+		},
+		"endsWith": func(args ...interface{}) (interface{}, error) {
+			s, err := stringArgs("endsWith", 2, args)
+			if err != nil {
+				return nil, err
+			}
+			return strings.HasSuffix(s[0], s[1]), nil
+		},
+		"matches": func(args ...interface{}) (interface{}, error) {
+			s, err := stringArgs("matches", 2, args)
+			if err != nil {
+				return nil, err
+			}
+			re, err := regexp.Compile(s[1])
+			if err != nil {
+				return nil, err
+			}
+			return re.MatchString(s[0]), nil
+		},
+	}
+}
+
+// stringArgs checks the number of arguments of a function and formats them
+// as strings, so that numbers can be compared with string functions.
+func stringArgs(name string, n int, args []interface{}) ([]string, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf("%s takes %d arguments, got %d", name, n, len(args))
+	}
+	s := make([]string, n)
+	for i, a := range args {
+		if a == nil {
+			return nil, errors.New(name + " does not take null arguments")
+		}
+		s[i] = fmt.Sprint(a)
+	}
+	return s, nil
+}
@@ -0,0 +1,172 @@
+package condition
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		condition string
+		wantErr   bool
+	}{
+		{condition: `$a == "x" && !startsWith($b, "y")`},
+		{condition: `$needs.build-1.tag != "" || always()`},
+		{condition: `status("build") == "failure" && matches($tag, "-rc$")`},
+		{condition: `contains("$notavariable", "$")`},
+		{condition: `$a > 3 || ($b == 'it\'s' && success())`},
+		{condition: `$a ==`, wantErr: true},
+		{condition: `$ == "x"`, wantErr: true},
+		{condition: `$a == "x`, wantErr: true},
+		{condition: `unknown($a)`, wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(tt.condition); (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%s) error = %v, wantErr %v", tt.condition, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	known := []string{"a", "b", "image.tag"}
+	tests := []struct {
+		name      string
+		condition string
+		needs     []string
+		wantErr   string
+	}{
+		{name: "empty", condition: ""},
+		{name: "known variables", condition: `$a == $b && $image.tag != ""`},
+		{name: "syntax error", condition: `$a ==`, wantErr: "invalid condition"},
+		{name: "unknown variables", condition: `$c == "x" || $a == $d || $c == ""`, wantErr: "uses unknown variables $c, $d"},
+		{name: "empty needs", condition: `$c == "x"`, needs: []string{""}, wantErr: "uses unknown variables $c"},
+		{name: "outputs of needed stages", condition: `$c == "x"`, needs: []string{"build"}},
+		{name: "namespaced outputs", condition: `$needs.build.tag == "x"`, needs: []string{"test", "build"}},
+		{name: "namespaced outputs of other stages", condition: `$needs.other.tag == "x"`, needs: []string{"build"}, wantErr: "refers to stage other"},
+		{name: "status", condition: `status("build") == "success"`, needs: []string{"build"}},
+		{name: "status of other stages", condition: `status("other") == "success"`, needs: []string{"build"}, wantErr: "refers to stage other"},
+		{name: "quoted variables", condition: `$a == "$c"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Check(tt.condition, tt.needs, known)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Check() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Check() error = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	values := []internaltypes.Env{
+		{Name: "branch", Value: "release/1.2"},
+		{Name: "count", Value: "3"},
+		{Name: "empty", Value: ""},
+		{Name: "NEEDS_BUILD_1_TAG", Value: "v1.2-rc1"},
+	}
+	tests := []struct {
+		name      string
+		condition string
+		ctx       Context
+		want      bool
+		wantErr   bool
+	}{
+		{name: "empty", condition: "", want: true},
+		{name: "equal", condition: `$branch == "release/1.2"`, want: true},
+		{name: "numbers are strings", condition: `$count == "3"`, want: true},
+		{name: "empty value", condition: `$empty == ""`, want: true},
+		{name: "contains", condition: `contains($branch, "release")`, want: true},
+		{name: "startsWith", condition: `startsWith($branch, "main")`, want: false},
+		{name: "endsWith", condition: `endsWith($branch, "1.2")`, want: true},
+		{name: "matches", condition: `matches($needs.build-1.tag, "-rc[0-9]+$")`, want: true},
+		{name: "invalid regular expression", condition: `matches($branch, "[")`, wantErr: true},
+		{name: "wrong number of arguments", condition: `contains($branch)`, wantErr: true},
+		{name: "always", condition: `always()`, ctx: Context{NeedsFailed: true}, want: true},
+		{name: "success", condition: `success()`, want: true},
+		{name: "success after a failure", condition: `success()`, ctx: Context{NeedsFailed: true}, want: false},
+		{name: "success after a skip", condition: `success()`, ctx: Context{NeedsSkipped: true}, want: false},
+		{name: "failure", condition: `failure()`, ctx: Context{NeedsFailed: true}, want: true},
+		{name: "status", condition: `status("build") == "skipped"`, ctx: Context{Needs: map[string]string{"build": "skipped"}}, want: true},
+		{name: "status of a stage that is not needed", condition: `status("other") == "success"`, wantErr: true},
+		{name: "undefined variable", condition: `$missing == ""`, wantErr: true},
+		{name: "not a boolean", condition: `$count`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := tt.ctx
+			ctx.Values = values
+			got, err := Evaluate(tt.condition, ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Evaluate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Evaluate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatic(t *testing.T) {
+	values := []internaltypes.Env{{Name: "a", Value: "1"}, {Name: "NEEDS_BUILD_TAG", Value: "v1"}}
+	tests := []struct {
+		condition string
+		want      bool
+	}{
+		{condition: `$a == "1"`, want: true},
+		{condition: `$needs.build.tag == "v1"`, want: true},
+		{condition: `$b == "1"`, want: false},
+		{condition: `always()`, want: true},
+		{condition: `success() && $a == "1"`, want: false},
+		{condition: `status("build") == "success"`, want: false},
+		{condition: `$a ==`, want: false},
+	}
+	for _, tt := range tests {
+		if got := Static(tt.condition, values); got != tt.want {
+			t.Errorf("Static(%s) = %v, want %v", tt.condition, got, tt.want)
+		}
+	}
+}
+
+func TestHandlesFailure(t *testing.T) {
+	tests := []struct {
+		condition string
+		want      bool
+	}{
+		{condition: `always()`, want: true},
+		{condition: `failure() || $a == "1"`, want: true},
+		{condition: `status("build") != "success"`, want: true},
+		{condition: `success()`, want: false},
+		{condition: `$a == "1"`, want: false},
+		{condition: ``, want: false},
+	}
+	for _, tt := range tests {
+		if got := HandlesFailure(tt.condition); got != tt.want {
+			t.Errorf("HandlesFailure(%s) = %v, want %v", tt.condition, got, tt.want)
+		}
+	}
+}
+
+func TestNeedsEnvName(t *testing.T) {
+	tests := []struct {
+		id, key string
+		want    string
+	}{
+		{id: "build", key: "tag", want: "NEEDS_BUILD_TAG"},
+		{id: "build-linux", key: "image.tag", want: "NEEDS_BUILD_LINUX_IMAGE_TAG"},
+		{id: "b.1", key: "my-key", want: "NEEDS_B_1_MY_KEY"},
+		{id: "Test_A", key: "Out", want: "NEEDS_TEST_A_OUT"},
+	}
+	for _, tt := range tests {
+		if got := NeedsEnvName(tt.id, tt.key); got != tt.want {
+			t.Errorf("NeedsEnvName(%q, %q) = %q, want %q", tt.id, tt.key, got, tt.want)
+		}
+	}
+}
@@ -27,10 +27,18 @@ type Repo struct {
 	Name        string   `json:"name" xml:"name" form:"name" query:"name" mapstructure:"name" validate:"nonzero"`
 	Description string   `json:"description" xml:"description" form:"description" query:"description" mapstructure:"description"`
 	Location    Location `json:"location" xml:"location" form:"location" query:"location" mapstructure:"location" validate:"nonzero"`
+	// Registries are used for the images of this repository's workflows,
+	// before the global registries.
+	Registries []internaltypes.Registry `json:"-" mapstructure:"registries,omitempty" yaml:"registries,omitempty"`
+	// Secrets can be used by this repository's workflows, before the
+	// global secrets.
+	Secrets []internaltypes.Secret `json:"-" mapstructure:"secrets,omitempty" yaml:"secrets,omitempty"`
 }
 
 type RepoFile struct {
-	Repositories []Repo `mapstructure:"repositories" validate:"nonzero"`
+	Repositories []Repo                   `mapstructure:"repositories" validate:"nonzero"`
+	Registries   []internaltypes.Registry `mapstructure:"registries,omitempty" yaml:"registries,omitempty"`
+	Secrets      []internaltypes.Secret   `mapstructure:"secrets,omitempty" yaml:"secrets,omitempty"`
 }
 
 var C RepoFile
@@ -68,12 +76,12 @@ func PrintStageResults(results []internaltypes.Result) {
 		// for _, v := range r.Logs {
 		// 	fmt.Println(r.Stage.ID, v)
 		// }
-		row := []string{r.Stage.Stage, r.Stage.ID, fmt.Sprint(r.Result), fmt.Sprint(r.Skipped), fmt.Sprint(engine.GenEnv(r.Outputs)), fmt.Sprint(len(r.Logs))}
+		row := []string{r.Stage.Stage, r.Stage.ID, fmt.Sprint(r.Result), fmt.Sprint(r.Skipped), r.Status, fmt.Sprint(r.Attempts), fmt.Sprint(engine.GenEnv(r.Outputs)), fmt.Sprint(len(r.Logs))}
 		data = append(data, row)
 	}
 
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"Stage", "ID", "Result", "Skipped", "Outputs", "Log Lines"})
+	table.SetHeader([]string{"Stage", "ID", "Result", "Skipped", "Status", "Attempts", "Outputs", "Log Lines"})
 
 	for _, v := range data {
 		table.Append(v)
@@ -172,6 +180,34 @@ func SaveToConfig(r RepoFile) {
 	}
 }
 
+// Registries returns the registry credentials for the workflows of a
+// repository: the ones of the repository first, then the global ones.
+func Registries(repo string) []internaltypes.Registry {
+	err2 := viper.Unmarshal(&C)
+	logger.HandleErr(err2)
+	registries := []internaltypes.Registry{}
+	for _, r := range C.Repositories {
+		if r.Name == repo {
+			registries = append(registries, r.Registries...)
+		}
+	}
+	return append(registries, C.Registries...)
+}
+
+// Secrets returns the secrets the workflows of a repository can use: the
+// ones of the repository first, then the global ones.
+func Secrets(repo string) []internaltypes.Secret {
+	err2 := viper.Unmarshal(&C)
+	logger.HandleErr(err2)
+	secrets := []internaltypes.Secret{}
+	for _, r := range C.Repositories {
+		if r.Name == repo {
+			secrets = append(secrets, r.Secrets...)
+		}
+	}
+	return append(secrets, C.Secrets...)
+}
+
 func GetRepoList() []string {
 	temp := []string{}
 	err2 := viper.Unmarshal(&C)
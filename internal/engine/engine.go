@@ -2,34 +2,43 @@ package engine
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/fs"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
-	"sync"
 	"time"
-	"unicode/utf8"
 
-	"github.com/Knetic/govaluate"
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/mount"
+	networktypes "github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/fatih/color"
+	"github.com/google/uuid"
+	"github.com/jatalocks/opsilon/internal/artifacts"
+	"github.com/jatalocks/opsilon/internal/condition"
 	"github.com/jatalocks/opsilon/internal/db"
+	"github.com/jatalocks/opsilon/internal/executor"
 	"github.com/jatalocks/opsilon/internal/internaltypes"
 	"github.com/jatalocks/opsilon/internal/logger"
-	"github.com/mitchellh/hashstructure/v2"
+	"github.com/jatalocks/opsilon/internal/registry"
 	"github.com/spf13/viper"
 	"golang.org/x/exp/slices"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 func GenEnv(e []internaltypes.Env) []string {
@@ -40,6 +49,25 @@ func GenEnv(e []internaltypes.Env) []string {
 	return envs
 }
 
+// MergeEnv merges lists of variables, keeping a single variable per name.
+// The value comes from the last list holding the name, the order from the
+// first.
+func MergeEnv(lists ...[]internaltypes.Env) []internaltypes.Env {
+	merged := []internaltypes.Env{}
+	index := make(map[string]int)
+	for _, list := range lists {
+		for _, e := range list {
+			if i, ok := index[e.Name]; ok {
+				merged[i].Value = e.Value
+				continue
+			}
+			index[e.Name] = len(merged)
+			merged = append(merged, e)
+		}
+	}
+	return merged
+}
+
 func GenEnvFromArgs(e []internaltypes.Input) []internaltypes.Env {
 	envs := make([]internaltypes.Env, len(e))
 	for i, v := range e {
@@ -49,23 +77,81 @@ func GenEnvFromArgs(e []internaltypes.Input) []internaltypes.Env {
 	return envs
 }
 
-func ImageExists(image string, ctx context.Context, cli *client.Client) bool {
-	images, err := cli.ImageList(ctx, types.ImageListOptions{})
-	logger.HandleErr(err)
+// dockerResources maps the stage resources to Docker: limits become hard
+// cpu and memory limits, the memory request becomes a soft limit and the cpu
+// request becomes cpu shares (1 cpu = 1024 shares).
+func dockerResources(r internaltypes.Resources) (container.Resources, error) {
+	resources := container.Resources{}
+	if r.Limits.CPU != "" {
+		q, err := resource.ParseQuantity(r.Limits.CPU)
+		if err != nil {
+			return resources, err
+		}
+		resources.NanoCPUs = q.MilliValue() * 1e6
+	}
+	if r.Limits.Memory != "" {
+		q, err := resource.ParseQuantity(r.Limits.Memory)
+		if err != nil {
+			return resources, err
+		}
+		resources.Memory = q.Value()
+	}
+	if r.Requests.CPU != "" {
+		q, err := resource.ParseQuantity(r.Requests.CPU)
+		if err != nil {
+			return resources, err
+		}
+		resources.CPUShares = q.MilliValue() * 1024 / 1000
+		if resources.CPUShares < 2 {
+			resources.CPUShares = 2
+		}
+	}
+	if r.Requests.Memory != "" {
+		q, err := resource.ParseQuantity(r.Requests.Memory)
+		if err != nil {
+			return resources, err
+		}
+		resources.MemoryReservation = q.Value()
+	}
+	return resources, nil
+}
+
+// ImageExists reports whether the image is present locally. The image can
+// be referenced by name, name and tag, digest or ID.
+func ImageExists(image string, ctx context.Context, cli *client.Client) (bool, error) {
+	_, _, err := cli.ImageInspectWithRaw(ctx, image)
+	if client.IsErrNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
 
-	for _, extImage := range images {
-		if strings.Join(extImage.RepoTags[:], ":") == image {
-			// logger.Info("Image Already Exists -", image)
-			return true
+// ImageDigest returns the digest reference of a local image, such as
+// alpine@sha256:..., or its ID if it was never pulled from a registry.
+func ImageDigest(image string, ctx context.Context, cli *client.Client) (string, error) {
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return "", err
+	}
+	if len(inspect.RepoDigests) == 0 {
+		return inspect.ID, nil
+	}
+	if named, err := reference.ParseNormalizedNamed(image); err == nil {
+		for _, digest := range inspect.RepoDigests {
+			if d, err := reference.ParseNormalizedNamed(digest); err == nil && d.Name() == named.Name() {
+				return digest, nil
+			}
 		}
 	}
-	return false
+	return inspect.RepoDigests[0], nil
 }
 
+// ContainerClean removes the container, killing it first if it is still running.
 func ContainerClean(id string, ctx context.Context, cli *client.Client) {
-	err := cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{})
-
-	logger.HandleErr(err)
+	err := cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true})
+	if err != nil {
+		log.Printf("Error removing container %s: %v", id, err)
+	}
 }
 
 func FindVolume(name string, ctx context.Context, cli *client.Client) (volume *types.Volume, err error) {
@@ -101,152 +187,445 @@ func RemoveVolume(name string, ctx context.Context, cli *client.Client) (removed
 	return true, nil
 }
 
-// CopyDir copies the content of src to dst. src should be a full path.
-func Copy(src, dst string) error {
-
-	return filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
+// LoadImportsIntoStage loads the artifact files the stage imports from the
+// store into targetDir. Import patterns that match no files are handled by
+// the if_no_files_found policy of the stage.
+func LoadImportsIntoStage(ctx context.Context, run *executor.StageRun, targetDir string) error {
+	s := run.Stage
+	if len(s.Import) == 0 {
+		return nil
+	}
+	objects, err := run.Artifacts.List(ctx, run.Scope.RunID)
+	if err != nil {
+		return err
+	}
+	for _, v := range s.Import {
+		selected, unmatched := artifacts.NewPatterns(v.Artifacts).Select(run.Scope.Names(objects, v.From))
+		warning, err := artifacts.NoFiles(s.IfNoFilesFound, unmatched)
+		if warning != "" {
+			run.LwRed.Write([]byte(fmt.Sprintf("Import from %s: %s\n", v.From, warning)))
 		}
-
-		// copy to this path
-		outpath := filepath.Join(dst, strings.TrimPrefix(path, src))
-
-		if info.IsDir() {
-			os.MkdirAll(outpath, info.Mode())
-			return nil // means recursive
+		if err != nil {
+			return fmt.Errorf("import from %s: %w", v.From, err)
 		}
-
-		// handle irregular files
-		if !info.Mode().IsRegular() {
-			switch info.Mode().Type() & os.ModeType {
-			case os.ModeSymlink:
-				link, err := os.Readlink(path)
-				if err != nil {
-					return err
-				}
-				return os.Symlink(link, outpath)
+		for _, name := range selected {
+			key := run.Scope.Key(v.From, name)
+			to := filepath.Join(targetDir, filepath.FromSlash(name))
+			run.LwWhite.Write([]byte(fmt.Sprintf("Copying %s To %s\n", key.Path(), to)))
+			if err := run.Artifacts.Load(ctx, key, to); err != nil {
+				return fmt.Errorf("import %s from %s: %w", name, v.From, err)
 			}
-			return nil
 		}
+	}
+	return nil
+}
 
-		// copy contents of regular file efficiently
+// Executor runs stages as Docker containers.
+type Executor struct {
+	cli        *client.Client
+	registries []internaltypes.Registry
+	// network is the network of the run, set by Prepare when the workflow
+	// has services. They keep running until Finish.
+	network  string
+	services []runningService
+}
 
-		// open input
-		in, _ := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer in.Close()
+type runningService struct {
+	name string
+	id   string
+}
 
-		// create output
-		fh, err := os.Create(outpath)
-		if err != nil {
-			return err
-		}
-		defer fh.Close()
+type workspace struct {
+	vol         types.Volume
+	dir         string
+	volOutput   types.Volume
+	dirOutput   string
+	containerID string
+	// network is created for stages with services of their own. The
+	// workflow services are connected to it as well.
+	network   string
+	services  []string
+	connected []string
+}
 
-		// make it the same
-		fh.Chmod(info.Mode())
+// NewExecutor returns an Executor that pulls images with the credentials of
+// the given registries, falling back to the docker config file.
+func NewExecutor(cli *client.Client, registries []internaltypes.Registry) *Executor {
+	return &Executor{cli: cli, registries: registries}
+}
 
-		// copy content
-		_, err = io.Copy(fh, in)
+// Prepare creates the network of the run and starts the workflow services
+// on it, shared by all the stages. Stage images are pulled by every stage
+// according to its pull policy.
+func (e *Executor) Prepare(ctx context.Context, w internaltypes.Workflow, runid string) error {
+	if len(w.Services) == 0 {
+		return nil
+	}
+	network, err := CreateNetwork(e.cli, ctx, runid)
+	if err != nil {
 		return err
-	})
+	}
+	e.network = network
+	run := executor.StageRun{Workflow: w}
+	services := append([]internaltypes.Service{}, w.Services...)
+	for i := range services {
+		if services[i].Pull == "" {
+			services[i].Pull = run.PullPolicy(services[i].Image)
+		}
+	}
+	LwWhite := logger.NewLogWriter(func(str string, col color.Attribute) {
+		logger.Custom(col, str)
+	}, color.FgWhite)
+	ids, err := e.startServices(ctx, network, services, LwWhite)
+	for i, id := range ids {
+		e.services = append(e.services, runningService{name: services[i].Name, id: id})
+	}
+	return err
 }
-func LoadImportsIntoStage(s internaltypes.Stage, targetDir, runid string, w internaltypes.Workflow) {
-	current, _ := os.Getwd()
-	for _, v := range s.Import {
-		for _, a := range v.Artifacts {
-			from := filepath.Join(current, "artifacts", w.Repo, w.ID, runid, v.From, a)
-			to := filepath.Join(targetDir, a)
-			fmt.Println("Copying", from, "To", to)
-			err := Copy(from, to)
-			if err != nil {
-				fmt.Println(err)
-			}
+
+// Finish removes the workflow services and the network of the run.
+func (e *Executor) Finish(ctx context.Context) {
+	for _, service := range e.services {
+		ContainerClean(service.id, ctx, e.cli)
+	}
+	if e.network != "" {
+		if err := e.cli.NetworkRemove(ctx, e.network); err != nil {
+			log.Printf("Error removing network %s: %v", e.network, err)
 		}
 	}
 }
 
-func RunStage(s internaltypes.Stage, ctx context.Context, cli *client.Client, envs []internaltypes.Env, globalImage string, volume types.Volume, dir string, volumeOutput types.Volume, dirOutput string, LwWhite *logger.MyLogWriter, LwRed *logger.MyLogWriter, runid string, w internaltypes.Workflow) bool {
-	PullImage(s.Image, ctx, cli)
-	if s.Image != "" {
-		globalImage = s.Image
+func (e *Executor) RunStage(ctx context.Context, s *executor.StageRun) (int, error) {
+	ws := &workspace{}
+	s.Workspace = ws
+	ws.volOutput, ws.dirOutput = CreateVolume(e.cli, ctx)
+	err := os.WriteFile(path.Join(ws.dirOutput, "output"), nil, 0o644)
+	if err != nil {
+		return -1, err
 	}
+	ws.vol, ws.dir = CreateVolume(e.cli, ctx)
 
-	hostConfig := container.HostConfig{}
+	if err := PullImage(s.Image(), s.PullPolicy(s.Image()), e.registries, ctx, e.cli); err != nil {
+		return -1, err
+	}
+	s.ImageDigest, err = ImageDigest(s.Image(), ctx, e.cli)
+	if err != nil {
+		return -1, err
+	}
+	s.LwWhite.Write([]byte(fmt.Sprintf("Using image %s\n", s.ImageDigest)))
 
-	//	hostConfig.Mounts = make([]mount.Mount,0);
+	resources, err := dockerResources(s.Resources())
+	if err != nil {
+		return -1, err
+	}
+	hostConfig := container.HostConfig{Resources: resources}
 
 	var mounts []mount.Mount
 
-	// for _, volume := range volumes {
 	mounts = append(mounts, mount.Mount{
 		Type:   mount.TypeVolume,
-		Source: volume.Name,
+		Source: ws.vol.Name,
 		Target: "/app",
 	}, mount.Mount{
 		Type:   mount.TypeVolume,
-		Source: volumeOutput.Name,
+		Source: ws.volOutput.Name,
 		Target: "/output",
 	})
-	// }
-	LoadImportsIntoStage(s, dir, runid, w)
+	if s.Checkout != "" {
+		if err := artifacts.Copy(s.Checkout, ws.dir); err != nil {
+			return -1, err
+		}
+	}
+	if err := LoadImportsIntoStage(ctx, s, ws.dir); err != nil {
+		return -1, err
+	}
 
 	hostConfig.Mounts = mounts
-	allEnvs := GenEnv(envs)
-	LwWhite.Write([]byte(fmt.Sprintf("Running Stage with the following variables: %s\n", allEnvs)))
-	allEnvs = append(allEnvs, []string{fmt.Sprintf("OUTPUT=/output/output")}...)
-	resp, err := cli.ContainerCreate(ctx, &container.Config{
-		Image:      globalImage,
+	if err := e.startStageServices(ctx, s, ws); err != nil {
+		return -1, err
+	}
+	if ws.network != "" {
+		hostConfig.NetworkMode = container.NetworkMode(ws.network)
+	} else if e.network != "" {
+		hostConfig.NetworkMode = container.NetworkMode(e.network)
+	}
+	allEnvs := GenEnv(s.Env)
+	allEnvs = append(allEnvs, []string{fmt.Sprintf("OUTPUT=/output/output"), fmt.Sprintf("OUTPUT_JSON=/output/output.json")}...)
+	resp, err := e.cli.ContainerCreate(ctx, &container.Config{
+		Image:      s.Image(),
 		Env:        allEnvs,
-		Cmd:        s.Script,
+		Cmd:        s.Stage.Script,
 		WorkingDir: "/app",
 		Tty:        false,
 	}, &hostConfig, nil, nil, "")
-	logger.HandleErr(err)
-
-	defer ExtractArtifacts(dir, s, runid, w)
-	defer ContainerClean(resp.ID, ctx, cli)
+	if err != nil {
+		return -1, err
+	}
+	ws.containerID = resp.ID
 
-	if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-		panic(err)
+	if err := e.cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return -1, err
 	}
-	statusCh, errCh := cli.ContainerWait(ctx, resp.ID, container.WaitConditionNextExit)
+	statusCh, errCh := e.cli.ContainerWait(ctx, resp.ID, container.WaitConditionNextExit)
 
-	out, err := cli.ContainerLogs(ctx, resp.ID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
-	logger.HandleErr(err)
-	stdcopy.StdCopy(LwWhite, LwRed, out)
+	out, err := e.cli.ContainerLogs(ctx, resp.ID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if err != nil {
+		return -1, err
+	}
+	stdcopy.StdCopy(s.LwWhite, s.LwRed, out)
 
 	select {
 	case err := <-errCh:
-		logger.Error(err.Error())
+		return -1, err
 	case status := <-statusCh:
-		// stat, err := cli.ContainerInspect(ctx, resp.ID)
-		// if err != nil {
-		// 	fmt.Println(err)
-		// }
-		// fmt.Println("STAT", stat.State)
-		return status.StatusCode == 0
+		return int(status.StatusCode), nil
+	}
+}
+
+// startStageServices starts the services of the stage on a network of its
+// own, to which the workflow services it does not replace are connected, so
+// that each service is reachable by its name.
+func (e *Executor) startStageServices(ctx context.Context, s *executor.StageRun, ws *workspace) error {
+	services := s.StageServices()
+	if len(services) == 0 {
+		return nil
+	}
+	network, err := CreateNetwork(e.cli, ctx, s.RunID)
+	if err != nil {
+		return err
+	}
+	ws.network = network
+	for _, service := range e.services {
+		if slices.IndexFunc(services, func(o internaltypes.Service) bool { return o.Name == service.name }) != -1 {
+			continue
+		}
+		if err := e.cli.NetworkConnect(ctx, network, service.id, &networktypes.EndpointSettings{Aliases: []string{service.name}}); err != nil {
+			return err
+		}
+		ws.connected = append(ws.connected, service.id)
+	}
+	ws.services, err = e.startServices(ctx, network, services, s.LwWhite)
+	return err
+}
+
+// startServices starts the services on the network, each reachable by its
+// name, and returns their containers once every service is running and
+// healthy. On error, the containers started so far are returned to be
+// removed.
+func (e *Executor) startServices(ctx context.Context, network string, services []internaltypes.Service, LwWhite io.Writer) ([]string, error) {
+	ids := []string{}
+	for _, service := range services {
+		if err := PullImage(service.Image, service.Pull, e.registries, ctx, e.cli); err != nil {
+			return ids, err
+		}
+		config := &container.Config{
+			Image: service.Image,
+			Env:   GenEnv(service.Env),
+			Cmd:   service.Command,
+		}
+		if service.HealthCheck != nil {
+			interval, timeout, retries := service.HealthCheck.Settings()
+			config.Healthcheck = &container.HealthConfig{
+				Test:     append([]string{"CMD"}, service.HealthCheck.Command...),
+				Interval: interval,
+				Timeout:  timeout,
+				Retries:  retries,
+			}
+		}
+		resp, err := e.cli.ContainerCreate(ctx, config, &container.HostConfig{}, &networktypes.NetworkingConfig{
+			EndpointsConfig: map[string]*networktypes.EndpointSettings{
+				network: {Aliases: []string{service.Name}},
+			},
+		}, nil, "")
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, resp.ID)
+		if err := e.cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+			return ids, err
+		}
 	}
+	for i, service := range services {
+		LwWhite.Write([]byte(fmt.Sprintf("Waiting for service %s\n", service.Name)))
+		if err := e.waitHealthy(ctx, ids[i], service.Name); err != nil {
+			return ids, err
+		}
+	}
+	return ids, nil
+}
+
+// waitHealthy waits until the service container is healthy. Containers
+// without a health check only have to be running.
+func (e *Executor) waitHealthy(ctx context.Context, id string, name string) error {
+	for {
+		inspect, err := e.cli.ContainerInspect(ctx, id)
+		if err != nil {
+			return err
+		}
+		state := inspect.State
+		if !state.Running {
+			return fmt.Errorf("service %s exited with code %d", name, state.ExitCode)
+		}
+		if state.Health == nil || state.Health.Status == types.Healthy {
+			return nil
+		}
+		if state.Health.Status == types.Unhealthy {
+			output := ""
+			if n := len(state.Health.Log); n > 0 {
+				output = strings.TrimSpace(state.Health.Log[n-1].Output)
+			}
+			return fmt.Errorf("service %s is unhealthy: %s", name, output)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
 
-	return false
+func (e *Executor) Collect(ctx context.Context, s *executor.StageRun) ([]internaltypes.Env, error) {
+	ws, ok := s.Workspace.(*workspace)
+	if !ok {
+		return []internaltypes.Env{}, nil
+	}
+	artifactsErr := ExtractArtifacts(ctx, s, ws.dir)
+	outputs, err := ReadOutputs(ws.dirOutput)
+	if artifactsErr != nil {
+		return outputs, artifactsErr
+	}
+	return outputs, err
 }
 
-func PullImage(image string, ctx context.Context, cli *client.Client) {
-	if image != "" {
-		if !ImageExists(image, ctx, cli) {
-			logger.Info("Pulling Image", image)
-			reader, err := cli.ImagePull(ctx, image, types.ImagePullOptions{})
-			logger.HandleErr(err)
-			defer reader.Close()
-			logger.Info("Image", image, "Pulled Successfully")
+func (e *Executor) Cleanup(ctx context.Context, s *executor.StageRun) {
+	ws, ok := s.Workspace.(*workspace)
+	if !ok {
+		return
+	}
+	if ws.containerID != "" {
+		ContainerClean(ws.containerID, ctx, e.cli)
+	}
+	for _, id := range ws.services {
+		ContainerClean(id, ctx, e.cli)
+	}
+	for _, id := range ws.connected {
+		if err := e.cli.NetworkDisconnect(ctx, ws.network, id, true); err != nil {
+			log.Printf("Error disconnecting service from network %s: %v", ws.network, err)
+		}
+	}
+	if ws.network != "" {
+		if err := e.cli.NetworkRemove(ctx, ws.network); err != nil {
+			log.Printf("Error removing network %s: %v", ws.network, err)
 		}
-		// io.Copy(os.Stdout, reader)
 	}
+	RemoveVolume(ws.vol.Name, ctx, e.cli)
+	RemoveVolume(ws.volOutput.Name, ctx, e.cli)
+	os.RemoveAll(ws.dir)
+	os.RemoveAll(ws.dirOutput)
 }
 
+// PullImage pulls the image according to the pull policy: always,
+// if-not-present or never. With never, the image has to be present.
+func PullImage(image string, policy string, registries []internaltypes.Registry, ctx context.Context, cli *client.Client) error {
+	if image == "" {
+		return nil
+	}
+	if policy != internaltypes.PullAlways {
+		exists, err := ImageExists(image, ctx, cli)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+		if policy == internaltypes.PullNever {
+			return fmt.Errorf("image %s is not present and the pull policy is never", image)
+		}
+	}
+	logger.Info("Pulling Image", image)
+	options := types.ImagePullOptions{}
+	if r, ok := registry.Find(registries, image); ok && (r.Username != "" || r.Password != "") {
+		auth, err := RegistryAuth(r)
+		if err != nil {
+			return err
+		}
+		options.RegistryAuth = auth
+	}
+	reader, err := cli.ImagePull(ctx, image, options)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	// The pull only completes once the progress stream is read to the end,
+	// errors are reported in the stream.
+	if err := jsonmessage.DisplayJSONMessagesStream(reader, io.Discard, 0, false, nil); err != nil {
+		return err
+	}
+	logger.Info("Image", image, "Pulled Successfully")
+	return nil
+}
+
+// RegistryAuth encodes the registry credentials for the Docker API.
+func RegistryAuth(r internaltypes.Registry) (string, error) {
+	data, err := json.Marshal(types.AuthConfig{Username: r.Username, Password: r.Password, ServerAddress: r.Server})
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+// ReadOutputs reads the outputs a stage wrote to the output directory: the
+// $OUTPUT file (output) and the optional $OUTPUT_JSON file (output.json).
+func ReadOutputs(dir string) ([]internaltypes.Env, error) {
+	config, err := ReadPropertiesFile(filepath.Join(dir, "output"))
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "output.json"))
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(strings.TrimSpace(string(data))) == 0) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	jsonOutputs, err := ReadJSONOutputs(data)
+	if err != nil {
+		return config, err
+	}
+	return append(config, jsonOutputs...), nil
+}
+
+// ReadJSONOutputs turns every key of a JSON object into an output. Strings
+// are used as is, other values as their JSON encoding.
+func ReadJSONOutputs(data []byte) ([]internaltypes.Env, error) {
+	object := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, fmt.Errorf("$OUTPUT_JSON must hold a JSON object: %w", err)
+	}
+	keys := make([]string, 0, len(object))
+	for k := range object {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	config := []internaltypes.Env{}
+	for _, k := range keys {
+		value := ""
+		if err := json.Unmarshal(object[k], &value); err != nil {
+			compact := bytes.Buffer{}
+			if err := json.Compact(&compact, object[k]); err != nil {
+				return nil, err
+			}
+			if value = compact.String(); value == "null" {
+				value = ""
+			}
+		}
+		config = append(config, internaltypes.Env{Name: k, Value: value})
+	}
+	return config, nil
+}
+
+// ReadPropertiesFile reads key=value lines. A value spanning several lines
+// is written as key<<DELIMITER, the lines, and DELIMITER on a line of its own.
 func ReadPropertiesFile(filename string) ([]internaltypes.Env, error) {
 	config := []internaltypes.Env{}
 
@@ -260,9 +639,33 @@ func ReadPropertiesFile(filename string) ([]internaltypes.Env, error) {
 	defer file.Close()
 
 	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
 	for scanner.Scan() {
 		line := scanner.Text()
-		if equal := strings.Index(line, "="); equal >= 0 {
+		heredoc := strings.Index(line, "<<")
+		equal := strings.Index(line, "=")
+		if heredoc > 0 && (equal < 0 || heredoc < equal) {
+			key := strings.TrimSpace(line[:heredoc])
+			delimiter := strings.TrimSpace(line[heredoc+2:])
+			if key == "" || delimiter == "" {
+				continue
+			}
+			lines := []string{}
+			closed := false
+			for scanner.Scan() {
+				if scanner.Text() == delimiter {
+					closed = true
+					break
+				}
+				lines = append(lines, scanner.Text())
+			}
+			if !closed {
+				return nil, fmt.Errorf("output %s is missing its closing delimiter %s", key, delimiter)
+			}
+			config = append(config, internaltypes.Env{Name: key, Value: strings.Join(lines, "\n")})
+			continue
+		}
+		if equal >= 0 {
 			if key := strings.TrimSpace(line[:equal]); len(key) > 0 {
 				value := ""
 				if len(line) > equal {
@@ -280,18 +683,28 @@ func ReadPropertiesFile(filename string) ([]internaltypes.Env, error) {
 	return config, nil
 }
 
-func PrepareStage(wEnv []internaltypes.Env, sEnv []internaltypes.Env, inputs []internaltypes.Input, needs string, allOutputs map[string][]internaltypes.Env, stage string, id string, result *internaltypes.Result, runid, hash string) ([]internaltypes.Env, []string, *logger.MyLogWriter, *log.Logger, *logger.MyLogWriter) {
-	allEnvs := append(wEnv, sEnv...)
-	allEnvs = append(allEnvs, GenEnvFromArgs(inputs)...)
+// PrepareStage returns the variables of a stage, with the outputs of the
+// stages it needs, and its log writers, which mask the secret values of
+// masker. When names collide, inputs override the stage env, which
+// overrides the workflow env, which overrides outputs. Outputs of later
+// needs override outputs of earlier ones. Every output is also available as
+// NEEDS_<STAGE ID>_<KEY>, which nothing overrides.
+func PrepareStage(wEnv []internaltypes.Env, sEnv []internaltypes.Env, inputs []internaltypes.Input, needs string, allOutputs map[string][]internaltypes.Env, stage string, id string, result *internaltypes.Result, runid, hash string, masker *logger.Masker) ([]internaltypes.Env, []string, *logger.MyLogWriter, *log.Logger, *logger.MyLogWriter) {
+	outputs := []internaltypes.Env{}
+	namespaced := []internaltypes.Env{}
 	needSplit := strings.Split(needs, ",")
 	if needs != "" {
 		for _, v := range needSplit {
 			if val, ok := allOutputs[v]; ok {
-				allEnvs = append(allEnvs, val...)
+				outputs = append(outputs, val...)
+				for _, o := range val {
+					namespaced = append(namespaced, internaltypes.Env{Name: condition.NeedsEnvName(v, o.Name), Value: o.Value})
+				}
 			}
 		}
 	}
-	LwWhite := logger.NewLogWriter(func(str string, color color.Attribute) {
+	allEnvs := MergeEnv(outputs, wEnv, sEnv, GenEnvFromArgs(inputs), namespaced)
+	LwWhite := logger.NewMaskedLogWriter(func(str string, color color.Attribute) {
 		logger.Custom(color, fmt.Sprintf("[%s:%s] %s", stage, id, str))
 		if viper.GetBool("database") {
 			for _, log := range result.Logs {
@@ -299,9 +712,9 @@ func PrepareStage(wEnv []internaltypes.Env, sEnv []internaltypes.Env, inputs []i
 			}
 		}
 		result.Logs = append(result.Logs, fmt.Sprintf("[%s:%s] %s", stage, id, str))
-	}, color.FgWhite)
+	}, color.FgWhite, masker)
 
-	LwRed := logger.NewLogWriter(func(str string, color color.Attribute) {
+	LwRed := logger.NewMaskedLogWriter(func(str string, color color.Attribute) {
 		logger.Custom(color, fmt.Sprintf("[%s:%s] %s", stage, id, str))
 		if viper.GetBool("database") {
 			for _, log := range result.Logs {
@@ -309,9 +722,9 @@ func PrepareStage(wEnv []internaltypes.Env, sEnv []internaltypes.Env, inputs []i
 			}
 		}
 		result.Logs = append(result.Logs, fmt.Sprintf("[%s:%s] %s", stage, id, str))
-	}, color.FgRed)
+	}, color.FgRed, masker)
 
-	LwCrossed := log.New(logger.NewLogWriter(func(str string, col color.Attribute) {
+	LwCrossed := log.New(logger.NewMaskedLogWriter(func(str string, col color.Attribute) {
 		colFuc := color.New(col).SprintFunc()
 		white := color.New(color.CrossedOut).SprintFunc()
 		logger.Free(white(fmt.Sprintf("[%s:%s] ", stage, id), colFuc(str)))
@@ -322,63 +735,11 @@ func PrepareStage(wEnv []internaltypes.Env, sEnv []internaltypes.Env, inputs []i
 		}
 
 		result.Logs = append(result.Logs, fmt.Sprintf("[%s:%s] %s", stage, id, str))
-	}, color.BgYellow), "", 0)
+	}, color.BgYellow, masker), "", 0)
 
 	return allEnvs, needSplit, LwWhite, LwCrossed, LwRed
 }
 
-func Engine(cli *client.Client, ctx context.Context, w internaltypes.Workflow, sID string, allOutputs map[string][]internaltypes.Env, wg *sync.WaitGroup, skippedStages *[]string, results chan internaltypes.Result, runid string) {
-	defer wg.Done()
-	idx := slices.IndexFunc(w.Stages, func(c internaltypes.Stage) bool { return c.ID == sID })
-	stage := w.Stages[idx]
-	result := internaltypes.Result{Stage: stage}
-	volOutput, dirOutput := CreateVolume(cli, ctx)
-	outputPath := path.Join(dirOutput, "output")
-	_, err := os.Create(outputPath)
-	logger.HandleErr(err)
-
-	defer RemoveVolume(volOutput.Name, ctx, cli)
-	defer os.RemoveAll(dirOutput)
-
-	tempW := w
-	tempW.Input = []internaltypes.Input{}
-	hash, err := hashstructure.Hash(tempW, hashstructure.FormatV2, nil)
-	strHash := fmt.Sprint(hash)
-	logger.HandleErr(err)
-
-	allEnvs, needSplit, LwWhite, LwCrossed, LwRed := PrepareStage(w.Env, stage.Env, w.Input, stage.Needs, allOutputs, stage.Stage, stage.ID, &result, runid, strHash)
-	if !EvaluateCondition(stage.If, allEnvs, LwWhite) {
-		*skippedStages = append(*skippedStages, stage.ID)
-		result.Skipped = true
-		LwCrossed.Println("Stage Skipped due to IF condition")
-	} else {
-		toSkip := false
-		for _, skipped := range *skippedStages {
-			for _, need := range needSplit {
-				if need == skipped {
-					toSkip = true
-				}
-			}
-		}
-		if toSkip {
-			*skippedStages = append(*skippedStages, stage.ID)
-			result.Skipped = true
-			LwCrossed.Println("Stage Skipped due to needed stage skipped")
-		} else {
-			vol, dir := CreateVolume(cli, ctx)
-			success := RunStage(stage, ctx, cli, allEnvs, w.Image, vol, dir, volOutput, dirOutput, LwWhite, LwRed, runid, w)
-			result.Result = success
-		}
-
-	}
-
-	outputMap, err := ReadPropertiesFile(outputPath)
-	logger.HandleErr(err)
-	allOutputs[stage.ID] = outputMap
-	result.Outputs = outputMap
-	results <- result
-}
-
 func CreateVolume(cli *client.Client, ctx context.Context) (vol types.Volume, dir string) {
 	dir, err := os.MkdirTemp("", "temp")
 	logger.HandleErr(err)
@@ -402,78 +763,40 @@ func CreateVolume(cli *client.Client, ctx context.Context) (vol types.Volume, di
 	return vol, dir
 }
 
-func trimFirstRune(s string) string {
-	_, i := utf8.DecodeRuneInString(s)
-	return s[i:]
+// CreateNetwork creates a network for the services of a run or of a stage.
+// Nested runs share the run ID, so the name gets a random suffix.
+func CreateNetwork(cli *client.Client, ctx context.Context, runid string) (string, error) {
+	name := fmt.Sprintf("opsilon-%s-%s", runid, uuid.NewString()[:8])
+	_, err := cli.NetworkCreate(ctx, name, types.NetworkCreate{CheckDuplicate: true})
+	return name, err
 }
 
-func getVariablesFromExpression(condition string) []string {
-	fields := strings.Fields(condition)
-	varList := make([]string, 0)
-	for _, v := range fields {
-		if strings.HasPrefix(v, "$") {
-			varList = append(varList, strings.ReplaceAll(trimFirstRune(v), " ", ""))
-		}
+// ExtractArtifacts saves the files under path selected by the artifact
+// patterns of the stage to the store. Patterns that match no files are
+// handled by the if_no_files_found policy of the stage. A file that cannot
+// be saved is an *artifacts.SaveError.
+func ExtractArtifacts(ctx context.Context, run *executor.StageRun, path string) error {
+	s := run.Stage
+	if len(s.Artifacts) == 0 {
+		return nil
 	}
-	return varList
-}
-
-func EvaluateCondition(condition string, availableValues []internaltypes.Env, LwWhite *logger.MyLogWriter) bool {
-	if condition != "" {
-		LwWhite.Write([]byte(fmt.Sprintf("Evaluating If Statement: %s, with the following variables: %s\n", condition, availableValues)))
-
-		varList := getVariablesFromExpression(condition)
-
-		parameters := make(map[string]interface{}, len(varList))
-
-		for _, v := range varList {
-			idx := slices.IndexFunc(availableValues, func(c internaltypes.Env) bool { return c.Name == v })
-			if idx == -1 {
-
-				// Not all variables can be populated. Thus the If statement is void.
-				return false
-			} else {
-				parameters[v] = availableValues[idx].Value
-			}
-		}
-
-		expression, err := govaluate.NewEvaluableExpression(strings.ReplaceAll(condition, "$", ""))
-		logger.HandleErr(err)
-
-		result, err := expression.Evaluate(parameters)
-		logger.HandleErr(err)
-		return result.(bool)
+	names, err := artifacts.Files(path)
+	if err != nil {
+		return err
 	}
-	return true
-}
-
-func ExtractArtifacts(path string, s internaltypes.Stage, runid string, w internaltypes.Workflow) {
-	white := color.New(color.FgWhite).SprintFunc()
-
-	LwOperation := log.New(logger.NewLogWriter(func(str string, col color.Attribute) {
-		colFuc := color.New(col).SprintFunc()
-		logger.Free(white(fmt.Sprintf("[%s:%s] ", s.Stage, s.ID), colFuc(str)))
-	}, color.FgYellow), "", 0)
-	LwSuccess := log.New(logger.NewLogWriter(func(str string, col color.Attribute) {
-		colFuc := color.New(col).SprintFunc()
-		logger.Free(white(fmt.Sprintf("[%s:%s] ", s.Stage, s.ID), colFuc(str)))
-	}, color.FgGreen), "", 0)
-	LwError := log.New(logger.NewLogWriter(func(str string, col color.Attribute) {
-		colFuc := color.New(col).SprintFunc()
-		logger.Free(white(fmt.Sprintf("[%s:%s] ", s.Stage, s.ID), colFuc(str)))
-	}, color.FgRed), "", 0)
-
-	for _, v := range s.Artifacts {
-		fullPath := filepath.Join(path, v)
-		current, _ := os.Getwd()
-		to := filepath.Join(current, "artifacts", w.Repo, w.ID, runid, s.ID, v)
-		os.MkdirAll(filepath.Join(current, "artifacts", w.Repo, w.ID, runid, s.ID), 0755)
-		LwOperation.Println("Copying", v, "To", to)
-		err := Copy(fullPath, to)
+	selected, unmatched := artifacts.NewPatterns(s.Artifacts).Select(names)
+	warning, policyErr := artifacts.NoFiles(s.IfNoFilesFound, unmatched)
+	if warning != "" {
+		run.LwRed.Write([]byte(warning + "\n"))
+	}
+	run.LwWhite.Write([]byte(fmt.Sprintf("Copying %d artifact files\n", len(selected))))
+	for _, name := range selected {
+		key := run.Scope.Key(s.ID, name)
+		err := run.Artifacts.Save(ctx, key, filepath.Join(path, filepath.FromSlash(name)))
 		if err != nil {
-			LwError.Println(err.Error())
-		} else {
-			LwSuccess.Println("Copied", v, "To", to)
+			return &artifacts.SaveError{Key: key, Err: err}
 		}
+		run.LwWhite.Write([]byte(fmt.Sprintf("Copied %s To %s\n", name, key.Path())))
 	}
+	return policyErr
 }
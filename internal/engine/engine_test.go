@@ -0,0 +1,434 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/fatih/color"
+	"github.com/jatalocks/opsilon/internal/artifacts"
+	"github.com/jatalocks/opsilon/internal/executor"
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"github.com/jatalocks/opsilon/internal/logger"
+)
+
+func TestReadPropertiesFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []internaltypes.Env
+		wantErr bool
+	}{
+		{
+			name:    "empty",
+			content: "",
+			want:    []internaltypes.Env{},
+		},
+		{
+			name:    "key value lines",
+			content: "a=1\n b = two words \nempty=\nnot a property\n=novalue\nurl=http://x?y=z\n",
+			want: []internaltypes.Env{
+				{Name: "a", Value: "1"},
+				{Name: "b", Value: "two words"},
+				{Name: "empty", Value: ""},
+				{Name: "url", Value: "http://x?y=z"},
+			},
+		},
+		{
+			name:    "heredoc",
+			content: "before=1\nnotes<<EOF\nline one\n  line two=2\n\nEOF\nafter=3\n",
+			want: []internaltypes.Env{
+				{Name: "before", Value: "1"},
+				{Name: "notes", Value: "line one\n  line two=2\n"},
+				{Name: "after", Value: "3"},
+			},
+		},
+		{
+			name:    "empty heredoc",
+			content: "notes << END\nEND\n",
+			want:    []internaltypes.Env{{Name: "notes", Value: ""}},
+		},
+		{
+			name:    "delimiter must be on a line of its own",
+			content: "notes<<EOF\nnot EOF\nEOF \nEOF\n",
+			want:    []internaltypes.Env{{Name: "notes", Value: "not EOF\nEOF "}},
+		},
+		{
+			name:    "<< in a value",
+			content: "shift=1<<2\n",
+			want:    []internaltypes.Env{{Name: "shift", Value: "1<<2"}},
+		},
+		{
+			name:    "heredoc without key or delimiter",
+			content: "<<EOF\nkey<<\na=1\n",
+			want:    []internaltypes.Env{{Name: "a", Value: "1"}},
+		},
+		{
+			name:    "unclosed heredoc",
+			content: "notes<<EOF\nline\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "output")
+			if err := os.WriteFile(file, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadPropertiesFile(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadPropertiesFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadPropertiesFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadJSONOutputs(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []internaltypes.Env
+		wantErr bool
+	}{
+		{
+			name: "values sorted by key",
+			data: `{"s": "text", "n": 1.5, "b": true, "null": null, "list": [1, "a"], "obj": {"k": "v"}}`,
+			want: []internaltypes.Env{
+				{Name: "b", Value: "true"},
+				{Name: "list", Value: `[1,"a"]`},
+				{Name: "n", Value: "1.5"},
+				{Name: "null", Value: ""},
+				{Name: "obj", Value: `{"k":"v"}`},
+				{Name: "s", Value: "text"},
+			},
+		},
+		{
+			name: "multi-line string",
+			data: `{"notes": "a\nb"}`,
+			want: []internaltypes.Env{{Name: "notes", Value: "a\nb"}},
+		},
+		{name: "not an object", data: `["a"]`, wantErr: true},
+		{name: "invalid", data: `{"a": `, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadJSONOutputs([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadJSONOutputs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadJSONOutputs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadOutputs(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    *string
+		want    []internaltypes.Env
+		wantErr bool
+	}{
+		{
+			name: "no output.json",
+			want: []internaltypes.Env{{Name: "a", Value: "1"}},
+		},
+		{
+			name: "blank output.json",
+			json: ptr(" \n"),
+			want: []internaltypes.Env{{Name: "a", Value: "1"}},
+		},
+		{
+			name: "both files",
+			json: ptr(`{"b": 2}`),
+			want: []internaltypes.Env{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}},
+		},
+		{
+			name:    "invalid output.json",
+			json:    ptr(`{`),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "output"), []byte("a=1\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.json != nil {
+				if err := os.WriteFile(filepath.Join(dir, "output.json"), []byte(*tt.json), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := ReadOutputs(dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadOutputs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadOutputs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		lists [][]internaltypes.Env
+		want  []internaltypes.Env
+	}{
+		{
+			name: "nothing",
+			want: []internaltypes.Env{},
+		},
+		{
+			name: "last value, first order",
+			lists: [][]internaltypes.Env{
+				{{Name: "a", Value: "1"}, {Name: "b", Value: "1"}},
+				{{Name: "c", Value: "2"}, {Name: "a", Value: "2"}},
+				nil,
+				{{Name: "b", Value: "3"}},
+			},
+			want: []internaltypes.Env{{Name: "a", Value: "2"}, {Name: "b", Value: "3"}, {Name: "c", Value: "2"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MergeEnv(tt.lists...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MergeEnv() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareStageEnv(t *testing.T) {
+	outputs := map[string][]internaltypes.Env{
+		"build":  {{Name: "tag", Value: "build"}, {Name: "name", Value: "build"}},
+		"test-1": {{Name: "tag", Value: "test"}, {Name: "report.path", Value: "r.xml"}},
+		"other":  {{Name: "unused", Value: "other"}},
+	}
+	tests := []struct {
+		name   string
+		wEnv   []internaltypes.Env
+		sEnv   []internaltypes.Env
+		inputs []internaltypes.Input
+		needs  string
+		want   []internaltypes.Env
+	}{
+		{
+			name: "no needs",
+			wEnv: []internaltypes.Env{{Name: "a", Value: "w"}},
+			sEnv: []internaltypes.Env{{Name: "a", Value: "s"}, {Name: "b", Value: "s"}},
+			want: []internaltypes.Env{{Name: "a", Value: "s"}, {Name: "b", Value: "s"}},
+		},
+		{
+			name:   "inputs override the stage env, which overrides the workflow env",
+			wEnv:   []internaltypes.Env{{Name: "a", Value: "w"}, {Name: "b", Value: "w"}},
+			sEnv:   []internaltypes.Env{{Name: "a", Value: "s"}, {Name: "b", Value: "s"}},
+			inputs: []internaltypes.Input{{Name: "a", Default: "i"}},
+			want:   []internaltypes.Env{{Name: "a", Value: "i"}, {Name: "b", Value: "s"}},
+		},
+		{
+			name:  "later needs override earlier ones and outputs are namespaced",
+			needs: "build,test-1",
+			want: []internaltypes.Env{
+				{Name: "tag", Value: "test"},
+				{Name: "name", Value: "build"},
+				{Name: "report.path", Value: "r.xml"},
+				{Name: "NEEDS_BUILD_TAG", Value: "build"},
+				{Name: "NEEDS_BUILD_NAME", Value: "build"},
+				{Name: "NEEDS_TEST_1_TAG", Value: "test"},
+				{Name: "NEEDS_TEST_1_REPORT_PATH", Value: "r.xml"},
+			},
+		},
+		{
+			name:  "the env overrides outputs but not namespaced outputs",
+			wEnv:  []internaltypes.Env{{Name: "tag", Value: "w"}, {Name: "NEEDS_BUILD_TAG", Value: "w"}},
+			needs: "build",
+			want: []internaltypes.Env{
+				{Name: "tag", Value: "w"},
+				{Name: "name", Value: "build"},
+				{Name: "NEEDS_BUILD_TAG", Value: "build"},
+				{Name: "NEEDS_BUILD_NAME", Value: "build"},
+			},
+		},
+		{
+			name:  "needs without outputs",
+			needs: "missing",
+			want:  []internaltypes.Env{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := internaltypes.Result{}
+			got, _, _, _, _ := PrepareStage(tt.wEnv, tt.sEnv, tt.inputs, tt.needs, outputs, "stage", "id", &result, "run", "hash", nil)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PrepareStage() env = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+// failingStore fails to save or load any artifact.
+type failingStore struct {
+	artifacts.Store
+}
+
+var errStore = errors.New("store unavailable")
+
+func (failingStore) Save(ctx context.Context, key artifacts.Key, src string) error {
+	return errStore
+}
+
+func (failingStore) Load(ctx context.Context, key artifacts.Key, dst string) error {
+	return errStore
+}
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// lines returns a log writer that appends the lines written to it to out.
+func lines(out *[]string) *logger.MyLogWriter {
+	return logger.NewLogWriter(func(str string, col color.Attribute) {
+		*out = append(*out, str)
+	}, color.FgWhite)
+}
+
+func TestExtractArtifacts(t *testing.T) {
+	store, err := artifacts.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "dist", "app"), "app")
+	writeFile(t, filepath.Join(dir, "src", "main.go"), "main")
+	var logs, errs []string
+	run := &executor.StageRun{
+		Stage:     internaltypes.Stage{ID: "build", Artifacts: []string{"dist/**", "missing/*"}, IfNoFilesFound: "warn"},
+		Artifacts: store,
+		Scope:     artifacts.Scope{Repo: "r", Workflow: "w", RunID: "run"},
+		LwWhite:   lines(&logs),
+		LwRed:     lines(&errs),
+	}
+	if err := ExtractArtifacts(context.Background(), run, dir); err != nil {
+		t.Fatalf("ExtractArtifacts() error = %v", err)
+	}
+	wantLogs := []string{"Copying 1 artifact files", "Copied dist/app To r/w/run/build/dist/app"}
+	if !reflect.DeepEqual(logs, wantLogs) || len(errs) != 1 {
+		t.Errorf("logs = %q and %q, want %q and a warning", logs, errs, wantLogs)
+	}
+	objects, err := store.List(context.Background(), "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []artifacts.Object{{Repo: "r", Workflow: "w", Stage: "build", Path: "dist/app", Size: 3}}
+	if !reflect.DeepEqual(objects, want) {
+		t.Errorf("saved %+v, want %+v", objects, want)
+	}
+
+	run.Artifacts = failingStore{store}
+	err = ExtractArtifacts(context.Background(), run, dir)
+	var saveErr *artifacts.SaveError
+	if !errors.As(err, &saveErr) || !errors.Is(err, errStore) {
+		t.Fatalf("ExtractArtifacts() error = %v, want an *artifacts.SaveError", err)
+	}
+	if saveErr.Key.Name != "dist/app" {
+		t.Errorf("SaveError key = %+v, want dist/app", saveErr.Key)
+	}
+}
+
+func TestLoadImportsIntoStage(t *testing.T) {
+	store, err := artifacts.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "app"), "app")
+	scope := artifacts.Scope{Repo: "r", Workflow: "w", RunID: "run"}
+	if err := store.Save(context.Background(), scope.Key("build", "dist/app"), filepath.Join(src, "app")); err != nil {
+		t.Fatal(err)
+	}
+	var logs, errs []string
+	run := &executor.StageRun{
+		Stage: internaltypes.Stage{
+			ID:             "release",
+			Import:         []internaltypes.Import{{From: "build", Artifacts: []string{"dist/*", "missing/*"}}},
+			IfNoFilesFound: "warn",
+		},
+		Artifacts: store,
+		Scope:     scope,
+		LwWhite:   lines(&logs),
+		LwRed:     lines(&errs),
+	}
+	dir := t.TempDir()
+	if err := LoadImportsIntoStage(context.Background(), run, dir); err != nil {
+		t.Fatalf("LoadImportsIntoStage() error = %v", err)
+	}
+	wantLogs := []string{"Copying r/w/run/build/dist/app To " + filepath.Join(dir, "dist", "app")}
+	if !reflect.DeepEqual(logs, wantLogs) || len(errs) != 1 {
+		t.Errorf("logs = %q and %q, want %q and a warning", logs, errs, wantLogs)
+	}
+	if content, err := os.ReadFile(filepath.Join(dir, "dist", "app")); err != nil || string(content) != "app" {
+		t.Errorf("imported dist/app = %q, %v, want app", content, err)
+	}
+
+	run.Artifacts = failingStore{store}
+	if err := LoadImportsIntoStage(context.Background(), run, t.TempDir()); !errors.Is(err, errStore) {
+		t.Errorf("LoadImportsIntoStage() error = %v, want %v", err, errStore)
+	}
+}
+
+func TestDockerResources(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources internaltypes.Resources
+		want      container.Resources
+		wantErr   bool
+	}{
+		{name: "none", want: container.Resources{}},
+		{
+			name: "limits and requests",
+			resources: internaltypes.Resources{
+				Requests: internaltypes.ResourceList{CPU: "500m", Memory: "64Mi"},
+				Limits:   internaltypes.ResourceList{CPU: "1.5", Memory: "1Gi"},
+			},
+			want: container.Resources{NanoCPUs: 1500000000, Memory: 1 << 30, CPUShares: 512, MemoryReservation: 64 << 20},
+		},
+		{
+			name:      "tiny cpu request",
+			resources: internaltypes.Resources{Requests: internaltypes.ResourceList{CPU: "1m"}},
+			want:      container.Resources{CPUShares: 2},
+		},
+		{name: "invalid quantity", resources: internaltypes.Resources{Limits: internaltypes.ResourceList{Memory: "lots"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dockerResources(tt.resources)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dockerResources() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dockerResources() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package executor
+
+import (
+	"context"
+
+	"github.com/docker/distribution/reference"
+	"github.com/jatalocks/opsilon/internal/artifacts"
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"github.com/jatalocks/opsilon/internal/logger"
+	"golang.org/x/exp/slices"
+)
+
+// Executor is a backend that knows how to run the stages of a workflow.
+// The layer loop in concurrency.ToGraph only talks to this interface, so the
+// Docker, Kubernetes and shell backends share the same stage semantics.
+type Executor interface {
+	// Prepare is called once per run, before the first stage is started.
+	Prepare(ctx context.Context, w internaltypes.Workflow, runid string) error
+	// RunStage runs the stage script to completion and returns its exit code.
+	RunStage(ctx context.Context, s *StageRun) (int, error)
+	// Collect reads the outputs of a finished stage and saves its artifacts.
+	Collect(ctx context.Context, s *StageRun) ([]internaltypes.Env, error)
+	// Cleanup removes everything RunStage created for the stage.
+	Cleanup(ctx context.Context, s *StageRun)
+	// Finish is called once per run, after the last stage, to remove
+	// everything Prepare created. It is called even if Prepare failed.
+	Finish(ctx context.Context)
+}
+
+// StageRun holds everything an Executor needs to run a single stage.
+type StageRun struct {
+	Stage    internaltypes.Stage
+	Workflow internaltypes.Workflow
+	RunID    string
+	Env      []internaltypes.Env
+	LwWhite  *logger.MyLogWriter
+	LwRed    *logger.MyLogWriter
+	// Checkout is a directory on the host with the content of the workflow
+	// repository, copied into the stage workspace. Empty if not mounted.
+	Checkout string
+	// Artifacts is the store stage artifacts are saved to and imported from.
+	Artifacts artifacts.Store
+	// Scope is where the stage saves its artifacts and imports from.
+	Scope artifacts.Scope
+	// Workspace is set by RunStage and holds backend specific state
+	// (volumes, pod name, temp directories) for Collect and Cleanup.
+	Workspace interface{}
+	// ImageDigest is set by RunStage to the digest of the image that ran.
+	ImageDigest string
+}
+
+// Image returns the image of the stage, falling back to the workflow image.
+func (s *StageRun) Image() string {
+	if s.Stage.Image != "" {
+		return s.Stage.Image
+	}
+	return s.Workflow.Image
+}
+
+// PullPolicy returns the pull policy for an image of the stage or of its
+// services: the stage policy, falling back to the workflow policy. Without
+// either, images tagged latest or without a tag are always pulled and other
+// images only if they are not present.
+func (s *StageRun) PullPolicy(image string) string {
+	if s.Stage.Pull != "" {
+		return s.Stage.Pull
+	}
+	if s.Workflow.Pull != "" {
+		return s.Workflow.Pull
+	}
+	return DefaultPullPolicy(image)
+}
+
+// DefaultPullPolicy returns the pull policy of an image without one.
+func DefaultPullPolicy(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return internaltypes.PullIfNotPresent
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return internaltypes.PullIfNotPresent
+	}
+	if tagged, ok := named.(reference.Tagged); ok && tagged.Tag() != "latest" {
+		return internaltypes.PullIfNotPresent
+	}
+	return internaltypes.PullAlways
+}
+
+// Resources returns the resources of the stage, with the values it does not
+// set taken from the workflow.
+func (s *StageRun) Resources() internaltypes.Resources {
+	return s.Stage.Resources.Merge(s.Workflow.Resources)
+}
+
+// StageServices returns the services of the stage alone, with the pull
+// policy of the stage when they have none.
+func (s *StageRun) StageServices() []internaltypes.Service {
+	services := append([]internaltypes.Service{}, s.Stage.Services...)
+	for i := range services {
+		if services[i].Pull == "" {
+			services[i].Pull = s.PullPolicy(services[i].Image)
+		}
+	}
+	return services
+}
+
+// Services returns the workflow services followed by the stage services.
+// A stage service replaces the workflow service with the same name. Services
+// without a pull policy get the one of the stage.
+func (s *StageRun) Services() []internaltypes.Service {
+	services := []internaltypes.Service{}
+	for _, service := range s.Workflow.Services {
+		if slices.IndexFunc(s.Stage.Services, func(o internaltypes.Service) bool { return o.Name == service.Name }) == -1 {
+			services = append(services, service)
+		}
+	}
+	services = append(services, s.Stage.Services...)
+	for i := range services {
+		if services[i].Pull == "" {
+			services[i].Pull = s.PullPolicy(services[i].Image)
+		}
+	}
+	return services
+}
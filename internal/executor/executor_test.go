@@ -0,0 +1,122 @@
+package executor
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+)
+
+func TestServices(t *testing.T) {
+	run := StageRun{
+		Workflow: internaltypes.Workflow{Services: []internaltypes.Service{
+			{Name: "postgres", Image: "postgres:15"},
+			{Name: "redis", Image: "redis:7", Pull: internaltypes.PullNever},
+		}},
+		Stage: internaltypes.Stage{
+			Pull: internaltypes.PullAlways,
+			Services: []internaltypes.Service{
+				{Name: "redis", Image: "redis:6"},
+				{Name: "minio", Image: "minio/minio", Pull: internaltypes.PullIfNotPresent},
+			},
+		},
+	}
+	services := []internaltypes.Service{
+		{Name: "postgres", Image: "postgres:15", Pull: internaltypes.PullAlways},
+		{Name: "redis", Image: "redis:6", Pull: internaltypes.PullAlways},
+		{Name: "minio", Image: "minio/minio", Pull: internaltypes.PullIfNotPresent},
+	}
+	if got := run.Services(); !reflect.DeepEqual(got, services) {
+		t.Errorf("Services() = %+v, want %+v", got, services)
+	}
+	if got := run.StageServices(); !reflect.DeepEqual(got, services[1:]) {
+		t.Errorf("StageServices() = %+v, want %+v", got, services[1:])
+	}
+	if run.Stage.Services[0].Pull != "" {
+		t.Errorf("Services() changed the stage services: %+v", run.Stage.Services)
+	}
+}
+
+func TestResources(t *testing.T) {
+	workflow := &internaltypes.Resources{
+		Requests: internaltypes.ResourceList{CPU: "100m", Memory: "64Mi"},
+		Limits:   internaltypes.ResourceList{CPU: "1", Memory: "256Mi"},
+	}
+	tests := []struct {
+		name            string
+		workflow, stage *internaltypes.Resources
+		want            internaltypes.Resources
+	}{
+		{name: "none"},
+		{name: "workflow defaults", workflow: workflow, want: *workflow},
+		{
+			name:  "stage only",
+			stage: &internaltypes.Resources{Limits: internaltypes.ResourceList{Memory: "1Gi"}},
+			want:  internaltypes.Resources{Limits: internaltypes.ResourceList{Memory: "1Gi"}},
+		},
+		{
+			name:     "stage values replace the workflow ones",
+			workflow: workflow,
+			stage:    &internaltypes.Resources{Requests: internaltypes.ResourceList{CPU: "500m"}, Limits: internaltypes.ResourceList{Memory: "1Gi"}},
+			want: internaltypes.Resources{
+				Requests: internaltypes.ResourceList{CPU: "500m", Memory: "64Mi"},
+				Limits:   internaltypes.ResourceList{CPU: "1", Memory: "1Gi"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run := StageRun{Workflow: internaltypes.Workflow{Resources: tt.workflow}, Stage: internaltypes.Stage{Resources: tt.stage}}
+			if got := run.Resources(); got != tt.want {
+				t.Errorf("Resources() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if workflow.Limits.Memory != "256Mi" {
+		t.Errorf("Resources() changed the workflow resources: %+v", workflow)
+	}
+}
+
+func TestDefaultPullPolicy(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{image: "alpine", want: internaltypes.PullAlways},
+		{image: "alpine:latest", want: internaltypes.PullAlways},
+		{image: "registry.example.com:5000/team/app", want: internaltypes.PullAlways},
+		{image: "alpine:3.17", want: internaltypes.PullIfNotPresent},
+		{image: "registry.example.com:5000/team/app:v1", want: internaltypes.PullIfNotPresent},
+		{image: "alpine@sha256:" + strings.Repeat("a", 64), want: internaltypes.PullIfNotPresent},
+		{image: "Not A Valid Image", want: internaltypes.PullIfNotPresent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			if got := DefaultPullPolicy(tt.image); got != tt.want {
+				t.Errorf("DefaultPullPolicy(%q) = %s, want %s", tt.image, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPullPolicy(t *testing.T) {
+	tests := []struct {
+		name            string
+		workflow, stage string
+		image           string
+		want            string
+	}{
+		{name: "stage policy", workflow: internaltypes.PullNever, stage: internaltypes.PullAlways, image: "alpine:3.17", want: internaltypes.PullAlways},
+		{name: "workflow policy", workflow: internaltypes.PullNever, image: "alpine", want: internaltypes.PullNever},
+		{name: "default policy", image: "alpine", want: internaltypes.PullAlways},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run := StageRun{Workflow: internaltypes.Workflow{Pull: tt.workflow}, Stage: internaltypes.Stage{Pull: tt.stage}}
+			if got := run.PullPolicy(tt.image); got != tt.want {
+				t.Errorf("PullPolicy(%q) = %s, want %s", tt.image, got, tt.want)
+			}
+		})
+	}
+}
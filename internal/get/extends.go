@@ -0,0 +1,177 @@
+package get
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jatalocks/opsilon/internal/config"
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"golang.org/x/exp/slices"
+)
+
+// resolver resolves the extends and templates of workflows. Workflows of
+// other repositories are read when extended.
+type resolver struct {
+	byRef  map[string]internaltypes.Workflow
+	loaded map[string]bool
+	// extended holds workflows merged with the workflows they extend,
+	// before their templates are applied.
+	extended map[string]internaltypes.Workflow
+}
+
+func newResolver(workflows []internaltypes.Workflow) *resolver {
+	r := &resolver{byRef: make(map[string]internaltypes.Workflow), loaded: make(map[string]bool), extended: make(map[string]internaltypes.Workflow)}
+	for _, w := range workflows {
+		r.byRef[w.Repo+"/"+w.ID] = w
+		r.loaded[w.Repo] = true
+	}
+	return r
+}
+
+// resolve returns the workflow merged with the workflows it extends, with
+// the templates of its stages applied.
+func (r *resolver) resolve(w internaltypes.Workflow) (internaltypes.Workflow, error) {
+	ref := w.Repo + "/" + w.ID
+	if w.Extends != "" {
+		parent, err := r.extend(w.Extends, []string{ref})
+		if err != nil {
+			return w, err
+		}
+		w = extend(parent, w)
+	}
+	return applyTemplates(w)
+}
+
+// extend returns the workflow ref merged with the workflows it extends.
+// path holds the workflows extending it, to detect cycles.
+func (r *resolver) extend(ref string, path []string) (internaltypes.Workflow, error) {
+	if slices.Contains(path, ref) {
+		return internaltypes.Workflow{}, fmt.Errorf("workflows extend each other in a cycle: %s", strings.Join(append(path[slices.Index(path, ref):], ref), " -> "))
+	}
+	if w, ok := r.extended[ref]; ok {
+		return w, nil
+	}
+	w, err := r.lookup(ref)
+	if err != nil {
+		return w, fmt.Errorf("workflow %s extends %s: %w", path[len(path)-1], ref, err)
+	}
+	if w.Extends != "" {
+		parent, err := r.extend(w.Extends, append(path, ref))
+		if err != nil {
+			return w, err
+		}
+		w = extend(parent, w)
+	}
+	r.extended[ref] = w
+	return w, nil
+}
+
+func (r *resolver) lookup(ref string) (internaltypes.Workflow, error) {
+	repo, _ := SplitRef(ref)
+	if !r.loaded[repo] {
+		r.loaded[repo] = true
+		repos := config.GetConfig()
+		idx := slices.IndexFunc(repos, func(c config.Repo) bool { return c.Name == repo })
+		if idx == -1 {
+			return internaltypes.Workflow{}, fmt.Errorf("repository %s is not configured", repo)
+		}
+		other, err := readWorkflows(repos[idx].Location, repo)
+		if err != nil {
+			return internaltypes.Workflow{}, err
+		}
+		for _, w := range *other {
+			r.byRef[w.Repo+"/"+w.ID] = w
+		}
+	}
+	w, ok := r.byRef[ref]
+	if !ok {
+		return w, fmt.Errorf("workflow %s does not exist", ref)
+	}
+	return w, nil
+}
+
+// extend merges a workflow with the workflow it extends. Fields the child
+// sets to a non-zero value replace the ones of the parent, see fillZero. Env, inputs and services are merged
+// by name and stages by ID: a child item replaces the parent item with the
+// same name in place, other child items are added after the parent items.
+// Templates are merged by name and secrets are added to the parent ones.
+func extend(parent, child internaltypes.Workflow) internaltypes.Workflow {
+	merged := child
+	fillZero(&merged, parent)
+	merged.Commit = child.Commit
+	merged.Env = mergeBy(parent.Env, child.Env, func(e internaltypes.Env) string { return e.Name })
+	merged.Input = mergeBy(parent.Input, child.Input, func(i internaltypes.Input) string { return i.Name })
+	merged.Services = mergeBy(parent.Services, child.Services, func(s internaltypes.Service) string { return s.Name })
+	merged.Stages = mergeBy(parent.Stages, child.Stages, func(s internaltypes.Stage) string { return s.ID })
+	merged.Secrets = mergeBy(parent.Secrets, child.Secrets, func(s string) string { return s })
+	if len(parent.Templates) > 0 {
+		merged.Templates = make(map[string]internaltypes.Stage)
+		for name, t := range parent.Templates {
+			merged.Templates[name] = t
+		}
+		for name, t := range child.Templates {
+			merged.Templates[name] = t
+		}
+	}
+	return merged
+}
+
+// applyTemplates sets the fields a stage does not set from its template.
+// Env and services of the stage are merged with the template ones by name.
+func applyTemplates(w internaltypes.Workflow) (internaltypes.Workflow, error) {
+	stages := make([]internaltypes.Stage, len(w.Stages))
+	for i, s := range w.Stages {
+		stages[i] = s
+		if s.Template == "" {
+			continue
+		}
+		t, ok := w.Templates[s.Template]
+		if !ok {
+			return w, fmt.Errorf("stage %s of workflow %s/%s uses template %s, which does not exist", s.ID, w.Repo, w.ID, s.Template)
+		}
+		fillZero(&stages[i], t)
+		stages[i].Env = mergeBy(t.Env, s.Env, func(e internaltypes.Env) string { return e.Name })
+		stages[i].Services = mergeBy(t.Services, s.Services, func(s internaltypes.Service) string { return s.Name })
+	}
+	w.Stages = stages
+	w.Templates = nil
+	return w, nil
+}
+
+// fillZero sets every exported field of dst that has its zero value to the
+// value of the same field in src. Empty strings, lists and maps count as
+// not set, so they cannot clear a value of src. Booleans that can be
+// overridden are pointers, a false that is set is not zero.
+func fillZero[T any](dst *T, src T) {
+	d := reflect.ValueOf(dst).Elem()
+	s := reflect.ValueOf(src)
+	for i := 0; i < d.NumField(); i++ {
+		if f := d.Field(i); f.CanSet() && f.IsZero() {
+			f.Set(s.Field(i))
+		}
+	}
+}
+
+// mergeBy merges two lists of items identified by key. An item of child
+// replaces the item of parent with the same key in place, the other items
+// of child are appended.
+func mergeBy[T any](parent, child []T, key func(T) string) []T {
+	if len(parent) == 0 {
+		return child
+	}
+	merged := append([]T{}, parent...)
+	index := make(map[string]int, len(merged))
+	for i, item := range merged {
+		index[key(item)] = i
+	}
+	for _, item := range child {
+		if i, ok := index[key(item)]; ok {
+			merged[i] = item
+			continue
+		}
+		index[key(item)] = len(merged)
+		merged = append(merged, item)
+	}
+	return merged
+}
@@ -0,0 +1,208 @@
+package get
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"github.com/jatalocks/opsilon/internal/validate"
+)
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestMergeBy(t *testing.T) {
+	name := func(e internaltypes.Env) string { return e.Name }
+	tests := []struct {
+		name          string
+		parent, child []internaltypes.Env
+		want          []internaltypes.Env
+	}{
+		{
+			name:  "no parent items",
+			child: []internaltypes.Env{{Name: "a", Value: "c"}},
+			want:  []internaltypes.Env{{Name: "a", Value: "c"}},
+		},
+		{
+			name:   "no child items",
+			parent: []internaltypes.Env{{Name: "a", Value: "p"}},
+			want:   []internaltypes.Env{{Name: "a", Value: "p"}},
+		},
+		{
+			name:   "child items replace parent items in place and others are added",
+			parent: []internaltypes.Env{{Name: "a", Value: "p"}, {Name: "b", Value: "p"}},
+			child:  []internaltypes.Env{{Name: "c", Value: "c"}, {Name: "a", Value: "c"}},
+			want:   []internaltypes.Env{{Name: "a", Value: "c"}, {Name: "b", Value: "p"}, {Name: "c", Value: "c"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := append([]internaltypes.Env{}, tt.parent...)
+			if got := mergeBy(tt.parent, tt.child, name); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeBy() = %v, want %v", got, tt.want)
+			}
+			if len(parent) > 0 && !reflect.DeepEqual(tt.parent, parent) {
+				t.Errorf("mergeBy() changed the parent items: %v", tt.parent)
+			}
+		})
+	}
+}
+
+func TestExtend(t *testing.T) {
+	parent := internaltypes.Workflow{
+		ID:          "base",
+		Image:       "alpine",
+		Description: "base",
+		Commit:      "parent",
+		Mount:       boolPtr(true),
+		Env:         []internaltypes.Env{{Name: "a", Value: "p"}, {Name: "b", Value: "p"}},
+		Secrets:     []string{"token"},
+		Stages:      []internaltypes.Stage{{ID: "build", Stage: "Build"}, {ID: "test", Stage: "Test"}},
+		Templates:   map[string]internaltypes.Stage{"sh": {Image: "alpine"}, "go": {Image: "golang"}},
+	}
+	child := internaltypes.Workflow{
+		ID:        "app",
+		Extends:   "repo/base",
+		Mount:     boolPtr(false),
+		Env:       []internaltypes.Env{{Name: "b", Value: "c"}},
+		Secrets:   []string{"token", "key"},
+		Stages:    []internaltypes.Stage{{ID: "test", Stage: "Unit tests"}, {ID: "deploy", Stage: "Deploy"}},
+		Templates: map[string]internaltypes.Stage{"go": {Image: "golang:1.19"}},
+	}
+	got := extend(parent, child)
+	want := internaltypes.Workflow{
+		ID:          "app",
+		Image:       "alpine",
+		Description: "base",
+		Extends:     "repo/base",
+		Mount:       boolPtr(false),
+		Env:         []internaltypes.Env{{Name: "a", Value: "p"}, {Name: "b", Value: "c"}},
+		Secrets:     []string{"token", "key"},
+		Stages:      []internaltypes.Stage{{ID: "build", Stage: "Build"}, {ID: "test", Stage: "Unit tests"}, {ID: "deploy", Stage: "Deploy"}},
+		Templates:   map[string]internaltypes.Stage{"sh": {Image: "alpine"}, "go": {Image: "golang:1.19"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("extend() = %+v, want %+v", got, want)
+	}
+	if len(parent.Templates) != 2 || parent.Templates["go"].Image != "golang" {
+		t.Errorf("extend() changed the parent templates: %v", parent.Templates)
+	}
+}
+
+func TestApplyTemplates(t *testing.T) {
+	w := internaltypes.Workflow{
+		Templates: map[string]internaltypes.Stage{"sh": {
+			Stage:           "Shell",
+			Image:           "alpine",
+			Script:          []string{"sh", "-c", "env"},
+			ContinueOnError: boolPtr(true),
+			Env:             []internaltypes.Env{{Name: "a", Value: "t"}, {Name: "b", Value: "t"}},
+		}},
+		Stages: []internaltypes.Stage{
+			{ID: "plain", Stage: "Plain"},
+			{ID: "templated", Template: "sh", Env: []internaltypes.Env{{Name: "b", Value: "s"}}},
+			{ID: "strict", Template: "sh", Image: "busybox", ContinueOnError: boolPtr(false)},
+		},
+	}
+	got, err := applyTemplates(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []internaltypes.Stage{
+		{ID: "plain", Stage: "Plain"},
+		{
+			ID:              "templated",
+			Template:        "sh",
+			Stage:           "Shell",
+			Image:           "alpine",
+			Script:          []string{"sh", "-c", "env"},
+			ContinueOnError: boolPtr(true),
+			Env:             []internaltypes.Env{{Name: "a", Value: "t"}, {Name: "b", Value: "s"}},
+		},
+		{
+			ID:              "strict",
+			Template:        "sh",
+			Stage:           "Shell",
+			Image:           "busybox",
+			Script:          []string{"sh", "-c", "env"},
+			ContinueOnError: boolPtr(false),
+			Env:             []internaltypes.Env{{Name: "a", Value: "t"}, {Name: "b", Value: "t"}},
+		},
+	}
+	if !reflect.DeepEqual(got.Stages, want) {
+		t.Errorf("applyTemplates() stages = %+v, want %+v", got.Stages, want)
+	}
+	if got.Templates != nil {
+		t.Errorf("applyTemplates() kept the templates: %v", got.Templates)
+	}
+
+	w.Stages = []internaltypes.Stage{{ID: "broken", Template: "missing"}}
+	if _, err := applyTemplates(w); err == nil {
+		t.Error("applyTemplates() with an unknown template succeeded")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	workflows := []internaltypes.Workflow{
+		{Repo: "repo", ID: "base", Image: "alpine", Env: []internaltypes.Env{{Name: "level", Value: "base"}}},
+		{Repo: "repo", ID: "middle", Extends: "repo/base", Env: []internaltypes.Env{{Name: "level", Value: "middle"}}},
+		{Repo: "repo", ID: "app", Extends: "repo/middle", Description: "app"},
+		{Repo: "repo", ID: "a", Extends: "repo/b"},
+		{Repo: "repo", ID: "b", Extends: "repo/c"},
+		{Repo: "repo", ID: "c", Extends: "repo/b"},
+		{Repo: "repo", ID: "self", Extends: "repo/self"},
+		{Repo: "repo", ID: "orphan", Extends: "repo/missing"},
+	}
+	r := newResolver(workflows)
+	tests := []struct {
+		id      string
+		want    []string // ID, image, description and env of the resolved workflow.
+		wantErr string
+	}{
+		{id: "app", want: []string{"app", "alpine", "app", "level=middle"}},
+		{id: "a", wantErr: "cycle: repo/b -> repo/c -> repo/b"},
+		{id: "self", wantErr: "cycle: repo/self -> repo/self"},
+		{id: "orphan", wantErr: "workflow repo/missing does not exist"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			got, err := r.resolve(r.byRef["repo/"+tt.id])
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolve() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			fields := []string{got.ID, got.Image, got.Description}
+			for _, e := range got.Env {
+				fields = append(fields, e.Name+"="+e.Value)
+			}
+			if !reflect.DeepEqual(fields, tt.want) {
+				t.Errorf("resolve() = %v, want %v", fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtendFalseOverridesTrue(t *testing.T) {
+	base, problems := validate.Decode("base.ops.yaml", []byte("id: base\nimage: alpine\nmount: true\nstages:\n  - id: a\n    stage: A\n    clean: true\n    script: [env]\n"))
+	if len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	app, problems := validate.Decode("app.ops.yaml", []byte("id: app\nextends: repo/base\nmount: false\nstages:\n  - id: a\n    stage: A\n    clean: false\n    script: [env]\n"))
+	if len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	got := extend(*base, *app)
+	if internaltypes.IsTrue(got.Mount) || got.Mount == nil {
+		t.Errorf("Mount = %v, want false", got.Mount)
+	}
+	if internaltypes.IsTrue(got.Stages[0].Clean) {
+		t.Errorf("Clean = %v, want false", *got.Stages[0].Clean)
+	}
+}
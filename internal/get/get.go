@@ -8,16 +8,18 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/jatalocks/opsilon/internal/artifacts"
 	"github.com/jatalocks/opsilon/internal/config"
 	"github.com/jatalocks/opsilon/internal/internaltypes"
 	"github.com/jatalocks/opsilon/internal/logger"
 	"github.com/jatalocks/opsilon/internal/validate"
-	"gopkg.in/yaml.v3"
+	"golang.org/x/exp/slices"
 )
 
 // CheckArgs should be used to ensure the right command line arguments are
@@ -63,8 +65,189 @@ func gitCloneMemory(loc config.Location) (*git.Repository, error) {
 	}
 }
 
+// refused holds the problems of the workflows that were left out when
+// their repositories were last loaded, by <repo>/<workflow id>.
+var refused = struct {
+	sync.Mutex
+	problems map[string]validate.Problems
+}{problems: make(map[string]validate.Problems)}
+
+// refuse records the problems of the workflows of a repository that were
+// left out, replacing the ones of its last load.
+func refuse(repo string, problems validate.Problems) {
+	refused.Lock()
+	defer refused.Unlock()
+	for ref := range refused.problems {
+		if r, _ := SplitRef(ref); r == repo {
+			delete(refused.problems, ref)
+		}
+	}
+	for _, p := range problems {
+		if p.Workflow != "" {
+			ref := repo + "/" + p.Workflow
+			refused.problems[ref] = append(refused.problems[ref], p)
+		}
+	}
+}
+
+// Refused returns the problems of the workflow <repo>/<workflow id> when it
+// was left out of its repository because of them, and nil otherwise.
+func Refused(ref string) error {
+	refused.Lock()
+	defer refused.Unlock()
+	if problems, ok := refused.problems[ref]; ok {
+		return problems
+	}
+	return nil
+}
+
+// refuseUses records the problem of a workflow of the repository that was
+// left out for the workflows it uses, keeping the other ones.
+func refuseUses(repo string, p validate.Problem) {
+	refused.Lock()
+	defer refused.Unlock()
+	ref := repo + "/" + p.Workflow
+	refused.problems[ref] = append(refused.problems[ref], p)
+}
+
+// refusedIn returns whether workflows of the repository were left out.
+func refusedIn(repo string) bool {
+	refused.Lock()
+	defer refused.Unlock()
+	for ref := range refused.problems {
+		if r, _ := SplitRef(ref); r == repo {
+			return true
+		}
+	}
+	return false
+}
+
+// getWorkflows reads the workflows of a repository, resolving their
+// extends and templates. Workflows with problems are left out, and their
+// problems logged.
 func getWorkflows(location config.Location, repo string) (*[]internaltypes.Workflow, error) {
+	data, problems, err := loadWorkflows(location, repo)
+	if err != nil {
+		return nil, err
+	}
+	refuse(repo, problems)
+	if len(problems) > 0 {
+		logger.Error("Workflows with problems are left out of repository", repo)
+		for _, p := range problems {
+			logger.Error(p.String())
+		}
+	}
+	return &data, nil
+}
+
+// Check reads the workflows of a repository like they are loaded, and
+// returns all their problems, with the files and lines they are in.
+func Check(location config.Location, repo string) (validate.Problems, error) {
+	data, problems, err := loadWorkflows(location, repo)
+	if err != nil {
+		return nil, err
+	}
+	refuse(repo, problems)
+	failed := checkUses(data)
+	for _, w := range data {
+		if err, ok := failed[w.Repo+"/"+w.ID]; ok {
+			problems = append(problems, validate.Problem{File: w.File, Workflow: w.ID, Message: err.Error()})
+		}
+	}
+	return problems, nil
+}
+
+// loadWorkflows reads the workflows of a repository, resolves their extends
+// and templates and validates them. Workflows with problems are left out.
+func loadWorkflows(location config.Location, repo string) ([]internaltypes.Workflow, validate.Problems, error) {
+	files, err := readFiles(location, repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	problems := validate.Problems{}
+	sources := make(map[string][]byte)
 	data := []internaltypes.Workflow{}
+	for _, f := range files {
+		w, decodeProblems := f.decode(repo)
+		problems = append(problems, decodeProblems...)
+		if w != nil {
+			sources[f.name] = f.data
+			data = append(data, *w)
+		}
+	}
+
+	r := newResolver(data)
+	resolved := []internaltypes.Workflow{}
+	for _, w := range data {
+		rw, err := r.resolve(w)
+		if err != nil {
+			problems = append(problems, validate.Problem{File: w.File, Message: err.Error()})
+			continue
+		}
+		resolved = append(resolved, rw)
+	}
+	if err := validate.ValidateWorkflows(&resolved); err != nil {
+		problems = append(problems, validate.Locate(err, resolved, sources)...)
+	}
+	problems.Sort()
+	ids := make(map[string]string)
+	for _, w := range data {
+		ids[w.File] = w.ID
+	}
+	invalid := make(map[string]bool)
+	for i, p := range problems {
+		problems[i].Workflow = ids[p.File]
+		invalid[p.File] = true
+	}
+	valid := []internaltypes.Workflow{}
+	for _, w := range resolved {
+		if !invalid[w.File] {
+			valid = append(valid, w)
+		}
+	}
+	return valid, problems, nil
+}
+
+// readWorkflows reads the workflows of a repository as they are written.
+// Files that cannot be read as workflows are left out.
+func readWorkflows(location config.Location, repo string) (*[]internaltypes.Workflow, error) {
+	files, err := readFiles(location, repo)
+	if err != nil {
+		return nil, err
+	}
+	data := []internaltypes.Workflow{}
+	for _, f := range files {
+		w, problems := f.decode(repo)
+		if len(problems) > 0 {
+			continue
+		}
+		data = append(data, *w)
+	}
+	return &data, nil
+}
+
+// workflowFile is a workflow file of a repository.
+type workflowFile struct {
+	name   string
+	data   []byte
+	commit string // The git commit the file was read from, if any.
+}
+
+func (f workflowFile) decode(repo string) (*internaltypes.Workflow, validate.Problems) {
+	w, problems := validate.Decode(f.name, f.data)
+	if w == nil {
+		return nil, problems
+	}
+	w.Repo = repo
+	w.Commit = f.commit
+	w.File = f.name
+	return w, problems
+}
+
+// readFiles reads the workflow files of a repository: the files named
+// *.ops.yaml or *.ops.yml.
+func readFiles(location config.Location, repo string) ([]workflowFile, error) {
+	files := []workflowFile{}
 	logger.Operation("Getting workflows from repo", repo, "in location", location.Path, "type", location.Type)
 	if location.Type == "folder" {
 		// if location.Path[0:1] == "/" {
@@ -80,14 +263,7 @@ func getWorkflows(location config.Location, repo string) (*[]internaltypes.Workf
 						if err != nil {
 							return err
 						}
-						temp := internaltypes.Workflow{}
-						temp.Repo = repo
-						err2 := yaml.Unmarshal(yfile, &temp)
-						if err2 != nil {
-							return err2
-						}
-
-						data = append(data, temp)
+						files = append(files, workflowFile{name: path, data: yfile})
 					}
 				}
 
@@ -131,13 +307,7 @@ func getWorkflows(location config.Location, repo string) (*[]internaltypes.Workf
 				if err != nil {
 					globalErr = err
 				}
-				temp := internaltypes.Workflow{}
-				temp.Repo = repo
-				err2 := yaml.Unmarshal(bytes, &temp)
-				if err2 != nil {
-					globalErr = err
-				}
-				data = append(data, temp)
+				files = append(files, workflowFile{name: f.Name, data: bytes, commit: commit.Hash.String()})
 			}
 			return nil
 		})
@@ -163,7 +333,82 @@ func getWorkflows(location config.Location, repo string) (*[]internaltypes.Workf
 	// 	err3 := yaml.Unmarshal(buf.Bytes(), &data)
 	// 	logger.HandleErr(err3)
 	// }
-	return &data, nil
+	return files, nil
+}
+
+// Checkout writes the content of the repository of the workflow to a new
+// temporary directory: a copy of the folder, or the git tree at the commit
+// the workflow was read from. The caller removes the directory.
+func Checkout(w internaltypes.Workflow) (string, error) {
+	repos := config.GetConfig()
+	idx := slices.IndexFunc(repos, func(r config.Repo) bool { return r.Name == w.Repo })
+	if idx == -1 {
+		return "", errors.New("repository " + w.Repo + " is not configured")
+	}
+	dir, err := os.MkdirTemp("", "checkout")
+	if err != nil {
+		return "", err
+	}
+	if err := checkoutTo(repos[idx].Location, w.Commit, dir); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+func checkoutTo(location config.Location, commitHash string, dir string) error {
+	if location.Type == "folder" {
+		return artifacts.Copy(location.Path, dir)
+	}
+	r, err := gitCloneMemory(location)
+	if err != nil {
+		return err
+	}
+	hash := plumbing.NewHash(commitHash)
+	if commitHash == "" {
+		ref, err := r.Head()
+		if err != nil {
+			return err
+		}
+		hash = ref.Hash()
+	}
+	commit, err := r.CommitObject(hash)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	return tree.Files().ForEach(func(f *object.File) error {
+		to := filepath.Join(dir, f.Name)
+		if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+			return err
+		}
+		mode, err := f.Mode.ToOSFileMode()
+		if err != nil {
+			return err
+		}
+		if mode&os.ModeSymlink != 0 {
+			target, err := f.Contents()
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, to)
+		}
+		reader, err := f.Blob.Reader()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		file, err := os.OpenFile(to, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(file, reader)
+		return err
+	})
 }
 
 func appendToWArray(v config.Repo, workflowArray *[]internaltypes.Workflow) error {
@@ -172,8 +417,7 @@ func appendToWArray(v config.Repo, workflowArray *[]internaltypes.Workflow) erro
 	if err != nil {
 		return err
 	}
-	validate.ValidateWorkflows(w)
-	if len(*w) == 0 {
+	if len(*w) == 0 && !refusedIn(v.Name) {
 		return errors.New("Cannot fetch workflows from repository " + v.Name + " or it is empty.")
 	}
 	*workflowArray = append(*workflowArray, *w...)
@@ -203,5 +447,123 @@ func GetWorkflowsForRepo(repoList []string) ([]internaltypes.Workflow, error) {
 		}
 	}
 
-	return workflowArray, nil
+	failed := checkUses(workflowArray)
+	if len(failed) == 0 {
+		return workflowArray, nil
+	}
+	valid := []internaltypes.Workflow{}
+	for _, w := range workflowArray {
+		err, ok := failed[w.Repo+"/"+w.ID]
+		if !ok {
+			valid = append(valid, w)
+			continue
+		}
+		p := validate.Problem{File: w.File, Workflow: w.ID, Message: err.Error()}
+		logger.Error("Workflow", w.ID, "is left out of repository", w.Repo+":", p.String())
+		refuseUses(w.Repo, p)
+	}
+	return valid, nil
+}
+
+// SplitRef splits a workflow reference of uses or extends, <repo>/<workflow
+// id>, into the repository and the workflow ID.
+func SplitRef(uses string) (string, string) {
+	i := strings.LastIndex(uses, "/")
+	if i == -1 {
+		return "", uses
+	}
+	return uses[:i], uses[i+1:]
+}
+
+// GetWorkflow returns the workflow a stage uses, <repo>/<workflow id>.
+func GetWorkflow(uses string) (internaltypes.Workflow, error) {
+	repo, id := SplitRef(uses)
+	workflows, err := GetWorkflowsForRepo([]string{repo})
+	if err != nil {
+		return internaltypes.Workflow{}, err
+	}
+	for _, w := range workflows {
+		if w.ID == id {
+			return w, nil
+		}
+	}
+	if problems := Refused(uses); problems != nil {
+		return internaltypes.Workflow{}, fmt.Errorf("workflow %s has problems:\n%w", uses, problems)
+	}
+	return internaltypes.Workflow{}, fmt.Errorf("workflow %s not found", uses)
+}
+
+// checkUses returns the errors of the workflows, by <repo>/<workflow id>,
+// that have a stage using a workflow that does not exist or has problems,
+// or that use each other in a cycle, directly or through other workflows.
+// Workflows of other repositories are loaded when used.
+func checkUses(workflows []internaltypes.Workflow) map[string]error {
+	byRef := make(map[string]internaltypes.Workflow)
+	loaded := make(map[string]bool)
+	for _, w := range workflows {
+		byRef[w.Repo+"/"+w.ID] = w
+		loaded[w.Repo] = true
+	}
+	lookup := func(ref string) (internaltypes.Workflow, bool, error) {
+		if w, ok := byRef[ref]; ok {
+			return w, true, nil
+		}
+		repo, _ := SplitRef(ref)
+		if loaded[repo] {
+			return internaltypes.Workflow{}, false, nil
+		}
+		loaded[repo] = true
+		repos := config.GetConfig()
+		idx := slices.IndexFunc(repos, func(r config.Repo) bool { return r.Name == repo })
+		if idx == -1 {
+			return internaltypes.Workflow{}, false, nil
+		}
+		other, err := getWorkflows(repos[idx].Location, repo)
+		if err != nil {
+			return internaltypes.Workflow{}, false, err
+		}
+		for _, w := range *other {
+			byRef[w.Repo+"/"+w.ID] = w
+		}
+		w, ok := byRef[ref]
+		return w, ok, nil
+	}
+
+	done := make(map[string]bool)
+	var visit func(ref string, path []string) error
+	visit = func(ref string, path []string) error {
+		if slices.Contains(path, ref) {
+			return fmt.Errorf("workflows use each other in a cycle: %s", strings.Join(append(path[slices.Index(path, ref):], ref), " -> "))
+		}
+		if done[ref] {
+			return nil
+		}
+		w := byRef[ref]
+		path = append(path, ref)
+		for _, s := range w.Stages {
+			if s.Uses == "" {
+				continue
+			}
+			if _, ok, err := lookup(s.Uses); err != nil {
+				return err
+			} else if !ok && Refused(s.Uses) != nil {
+				return fmt.Errorf("stage %s of workflow %s uses %s, which has problems", s.ID, ref, s.Uses)
+			} else if !ok {
+				return fmt.Errorf("stage %s of workflow %s uses %s, which does not exist", s.ID, ref, s.Uses)
+			}
+			if err := visit(s.Uses, path); err != nil {
+				return err
+			}
+		}
+		done[ref] = true
+		return nil
+	}
+	failed := make(map[string]error)
+	for _, w := range workflows {
+		ref := w.Repo + "/" + w.ID
+		if err := visit(ref, nil); err != nil {
+			failed[ref] = err
+		}
+	}
+	return failed
 }
@@ -0,0 +1,118 @@
+package get
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/jatalocks/opsilon/internal/config"
+)
+
+// writeFiles writes the files, by slash separated path, under dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// treeFiles returns the content of the files under dir by slash separated
+// path.
+func treeFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, file)
+		files[filepath.ToSlash(name)] = string(content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// commit writes the files to the worktree of the repository and commits
+// them.
+func commit(t *testing.T, r *git.Repository, dir string, files map[string]string) plumbing.Hash {
+	t.Helper()
+	writeFiles(t, dir, files)
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddGlob("."); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := w.Commit("update", &git.CommitOptions{Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestCheckoutFolder(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{"flow.ops.yaml": "id: flow", "scripts/deploy.sh": "echo deploy"}
+	writeFiles(t, src, files)
+	dir := t.TempDir()
+	if err := checkoutTo(config.Location{Type: "folder", Path: src}, "", dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := treeFiles(t, dir); !reflect.DeepEqual(got, files) {
+		t.Errorf("checkout = %v, want %v", got, files)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "scripts", "deploy.sh")); err != nil || info.Mode().Perm()&0o100 == 0 {
+		t.Errorf("scripts/deploy.sh lost its mode: %v, %v", info, err)
+	}
+}
+
+func TestCheckoutGit(t *testing.T) {
+	src := t.TempDir()
+	r, err := git.PlainInit(src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := commit(t, r, src, map[string]string{"flow.ops.yaml": "id: flow", "scripts/deploy.sh": "echo v1"})
+	commit(t, r, src, map[string]string{"scripts/deploy.sh": "echo v2"})
+	tests := []struct {
+		name   string
+		commit string
+		want   map[string]string
+	}{
+		{name: "head", want: map[string]string{"flow.ops.yaml": "id: flow", "scripts/deploy.sh": "echo v2"}},
+		{name: "fetched commit", commit: first.String(), want: map[string]string{"flow.ops.yaml": "id: flow", "scripts/deploy.sh": "echo v1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := checkoutTo(config.Location{Type: "git", Path: src}, tt.commit, dir); err != nil {
+				t.Fatal(err)
+			}
+			if got := treeFiles(t, dir); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("checkout = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if err := checkoutTo(config.Location{Type: "git", Path: src}, plumbing.ZeroHash.String(), t.TempDir()); err == nil {
+		t.Error("checkout of a missing commit succeeded")
+	}
+}
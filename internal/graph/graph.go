@@ -0,0 +1,206 @@
+package graph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"github.com/jatalocks/opsilon/internal/matrix"
+	"github.com/kendru/darwin/go/depgraph"
+)
+
+// Formats are the formats Render writes.
+var Formats = []string{"ascii", "dot", "mermaid"}
+
+// Needs returns the IDs of the stages the stage waits for: the stages it
+// needs, with matrix stages replaced by all of their instances.
+func Needs(w internaltypes.Workflow, s internaltypes.Stage) []string {
+	ids := []string{}
+	if s.Needs == "" {
+		return ids
+	}
+	for _, id := range strings.Split(s.Needs, ",") {
+		if instances := matrix.Instances(w, id); len(instances) > 0 {
+			ids = append(ids, instances...)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// New returns the dependency graph of the stages of the workflow. Stages
+// that need nothing depend on the empty root node.
+func New(w internaltypes.Workflow) *depgraph.Graph {
+	g := depgraph.New()
+	for _, s := range w.Stages {
+		needs := Needs(w, s)
+		if len(needs) == 0 {
+			needs = []string{""}
+		}
+		for _, v := range needs {
+			g.DependOn(s.ID, v)
+		}
+	}
+	return g
+}
+
+// Layers returns the IDs of the stages of the workflow in the order they
+// run. The stages of a layer run in parallel, after all the stages of the
+// layers before it, and are in the order of the workflow.
+func Layers(w internaltypes.Workflow) [][]string {
+	order := make(map[string]int, len(w.Stages))
+	for i, s := range w.Stages {
+		order[s.ID] = i
+	}
+	layers := [][]string{}
+	for _, layer := range New(w).TopoSortedLayers() {
+		ids := []string{}
+		for _, id := range layer {
+			if id != "" {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		sort.Slice(ids, func(a, b int) bool { return order[ids[a]] < order[ids[b]] })
+		layers = append(layers, ids)
+	}
+	return layers
+}
+
+// Render returns the graph of the stages of the workflow in format: ascii
+// (a tree of the stages under the stages they need), dot (Graphviz) or
+// mermaid. Stages are annotated with their image, if condition, imports
+// and the workflow they use. Matrix stages are shown as their instances
+// when their values are known.
+func Render(w internaltypes.Workflow, format string) (string, error) {
+	if expanded, err := matrix.Expand(w); err == nil {
+		w = expanded
+	}
+	switch format {
+	case "ascii", "":
+		return ascii(w), nil
+	case "dot":
+		return dot(w), nil
+	case "mermaid":
+		return mermaid(w), nil
+	}
+	return "", fmt.Errorf("unknown format %s, must be one of %s", format, strings.Join(Formats, ", "))
+}
+
+// details returns the annotations of a stage.
+func details(w internaltypes.Workflow, s internaltypes.Stage) []string {
+	d := []string{}
+	if s.Uses != "" {
+		d = append(d, "uses: "+s.Uses)
+	} else if s.Image != "" {
+		d = append(d, "image: "+s.Image)
+	} else {
+		d = append(d, "image: "+w.Image)
+	}
+	if s.If != "" {
+		d = append(d, "if: "+s.If)
+	}
+	for _, i := range s.Import {
+		d = append(d, fmt.Sprintf("import: %s %s", i.From, strings.Join(i.Artifacts, " ")))
+	}
+	return d
+}
+
+// dependents returns the stages that wait for each stage, in workflow
+// order, and the stages that wait for nothing.
+func dependents(w internaltypes.Workflow) (map[string][]internaltypes.Stage, []internaltypes.Stage) {
+	children := make(map[string][]internaltypes.Stage)
+	roots := []internaltypes.Stage{}
+	for _, s := range w.Stages {
+		needs := Needs(w, s)
+		if len(needs) == 0 {
+			roots = append(roots, s)
+		}
+		for _, id := range needs {
+			children[id] = append(children[id], s)
+		}
+	}
+	return children, roots
+}
+
+func ascii(w internaltypes.Workflow) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%s/%s (image: %s)\n", w.Repo, w.ID, w.Image)
+	children, roots := dependents(w)
+	shown := make(map[string]bool)
+	var tree func(stages []internaltypes.Stage, indent string)
+	tree = func(stages []internaltypes.Stage, indent string) {
+		for i, s := range stages {
+			branch, next := "├── ", "│   "
+			if i == len(stages)-1 {
+				branch, next = "└── ", "    "
+			}
+			if shown[s.ID] {
+				fmt.Fprintf(b, "%s%s%s (see above)\n", indent, branch, s.ID)
+				continue
+			}
+			shown[s.ID] = true
+			fmt.Fprintf(b, "%s%s%s [%s]\n", indent, branch, s.ID, strings.Join(details(w, s), "; "))
+			tree(children[s.ID], indent+next)
+		}
+	}
+	tree(roots, "")
+	return b.String()
+}
+
+var dotEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func dot(w internaltypes.Workflow) string {
+	quote := func(s string) string {
+		return `"` + dotEscape.Replace(s) + `"`
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "digraph %s {\n", quote(w.Repo+"/"+w.ID))
+	fmt.Fprintln(b, "  rankdir=LR;")
+	fmt.Fprintln(b, "  node [shape=box];")
+	for _, s := range w.Stages {
+		label := append([]string{s.ID}, details(w, s)...)
+		for i := range label {
+			label[i] = dotEscape.Replace(label[i])
+		}
+		fmt.Fprintf(b, "  %s [label=\"%s\\l\"];\n", quote(s.ID), strings.Join(label, `\l`))
+	}
+	for _, s := range w.Stages {
+		for _, id := range Needs(w, s) {
+			fmt.Fprintf(b, "  %s -> %s;\n", quote(id), quote(s.ID))
+		}
+	}
+	fmt.Fprintln(b, "}")
+	return b.String()
+}
+
+func mermaid(w internaltypes.Workflow) string {
+	// Stage IDs can be mermaid keywords such as end, so nodes get their
+	// own IDs.
+	nodes := make(map[string]string, len(w.Stages))
+	for i, s := range w.Stages {
+		nodes[s.ID] = fmt.Sprintf("s%d", i)
+	}
+	escape := strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;")
+	b := &strings.Builder{}
+	fmt.Fprintln(b, "flowchart LR")
+	for _, s := range w.Stages {
+		label := append([]string{s.ID}, details(w, s)...)
+		for i := range label {
+			label[i] = escape.Replace(label[i])
+		}
+		fmt.Fprintf(b, "  %s[\"%s\"]\n", nodes[s.ID], strings.Join(label, "<br/>"))
+	}
+	for _, s := range w.Stages {
+		for _, id := range Needs(w, s) {
+			if from, ok := nodes[id]; ok {
+				fmt.Fprintf(b, "  %s --> %s\n", from, nodes[s.ID])
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,101 @@
+package graph
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+)
+
+// testWorkflow has a matrix stage, a condition with quotes, imports and a
+// stage that uses a workflow.
+func testWorkflow() internaltypes.Workflow {
+	return internaltypes.Workflow{
+		Repo:  "repo",
+		ID:    "app",
+		Image: "alpine",
+		Stages: []internaltypes.Stage{
+			{ID: "build", Image: "golang:1.19", Matrix: map[string]internaltypes.MatrixValues{"os": {"linux", "darwin"}}},
+			{ID: "lint"},
+			{ID: "test", Needs: "build,lint", If: `$target != "dev"`},
+			{ID: "end", Needs: "build", Import: []internaltypes.Import{{From: "build", Artifacts: []string{"bin/*", "!bin/*.tmp"}}}},
+			{ID: "deploy", Needs: "test,end", Uses: "repo/deploy"},
+		},
+	}
+}
+
+func TestLayers(t *testing.T) {
+	w := testWorkflow()
+	w.Stages[0].Matrix = nil
+	want := [][]string{{"build", "lint"}, {"test", "end"}, {"deploy"}}
+	if got := Layers(w); !reflect.DeepEqual(got, want) {
+		t.Errorf("Layers() = %v, want %v", got, want)
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{format: "ascii", want: `repo/app (image: alpine)
+├── build-linux [image: golang:1.19]
+│   ├── test [image: alpine; if: $target != "dev"]
+│   │   └── deploy [uses: repo/deploy]
+│   └── end [image: alpine; import: build-linux bin/* !bin/*.tmp; import: build-darwin bin/* !bin/*.tmp]
+│       └── deploy (see above)
+├── build-darwin [image: golang:1.19]
+│   ├── test (see above)
+│   └── end (see above)
+└── lint [image: alpine]
+    └── test (see above)
+`},
+		{format: "dot", want: `digraph "repo/app" {
+  rankdir=LR;
+  node [shape=box];
+  "build-linux" [label="build-linux\limage: golang:1.19\l"];
+  "build-darwin" [label="build-darwin\limage: golang:1.19\l"];
+  "lint" [label="lint\limage: alpine\l"];
+  "test" [label="test\limage: alpine\lif: $target != \"dev\"\l"];
+  "end" [label="end\limage: alpine\limport: build-linux bin/* !bin/*.tmp\limport: build-darwin bin/* !bin/*.tmp\l"];
+  "deploy" [label="deploy\luses: repo/deploy\l"];
+  "build-linux" -> "test";
+  "build-darwin" -> "test";
+  "lint" -> "test";
+  "build-linux" -> "end";
+  "build-darwin" -> "end";
+  "test" -> "deploy";
+  "end" -> "deploy";
+}
+`},
+		{format: "mermaid", want: `flowchart LR
+  s0["build-linux<br/>image: golang:1.19"]
+  s1["build-darwin<br/>image: golang:1.19"]
+  s2["lint<br/>image: alpine"]
+  s3["test<br/>image: alpine<br/>if: $target != #quot;dev#quot;"]
+  s4["end<br/>image: alpine<br/>import: build-linux bin/* !bin/*.tmp<br/>import: build-darwin bin/* !bin/*.tmp"]
+  s5["deploy<br/>uses: repo/deploy"]
+  s0 --> s3
+  s1 --> s3
+  s2 --> s3
+  s0 --> s4
+  s1 --> s4
+  s3 --> s5
+  s4 --> s5
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			got, err := Render(testWorkflow(), tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Render(%s) =\n%s\nwant\n%s", tt.format, got, tt.want)
+			}
+		})
+	}
+	if _, err := Render(testWorkflow(), "svg"); err == nil {
+		t.Error("Render(svg) succeeded")
+	}
+}
@@ -1,10 +1,15 @@
 package internaltypes
 
 import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/shomali11/slacker"
 	"github.com/slack-go/slack"
+	"gopkg.in/yaml.v3"
 )
 
 type WorkflowQuery struct {
@@ -21,6 +26,37 @@ type RunLog struct {
 	UpdatedDate time.Time
 }
 
+// Possible values of Result.Status.
+const (
+	StatusSuccess   = "success"
+	StatusFailure   = "failure"
+	StatusSkipped   = "skipped"
+	StatusCancelled = "cancelled"
+	StatusTimeout   = "timeout"
+)
+
+// Image pull policies of workflows and stages.
+const (
+	PullAlways       = "always"
+	PullIfNotPresent = "if-not-present"
+	PullNever        = "never"
+)
+
+// Policies of a stage for artifact and import patterns that match no files.
+const (
+	NoFilesWarn   = "warn"
+	NoFilesError  = "error"
+	NoFilesIgnore = "ignore"
+)
+
+// Types of workflow inputs.
+const (
+	InputString  = "string"
+	InputNumber  = "number"
+	InputBoolean = "boolean"
+	InputChoice  = "choice"
+)
+
 type Result struct {
 	_id         string
 	RunID       string
@@ -28,6 +64,9 @@ type Result struct {
 	Stage       Stage
 	Result      bool
 	Skipped     bool
+	Status      string
+	Attempts    int
+	ImageDigest string // The image the stage ran, by digest.
 	Outputs     []Env
 	Logs        []string
 	CreatedDate time.Time
@@ -38,6 +77,7 @@ type RunResult struct {
 	SkippedStages    uint32
 	FailedStages     uint32
 	SuccessfulStages uint32
+	CancelledStages  uint32
 	Workflow         string
 	RunID            string
 	Outputs          []Env
@@ -52,24 +92,197 @@ type Input struct {
 	Name     string `mapstructure:"name" validate:"nonzero,nowhitespace"`
 	Default  string `mapstructure:"default"`
 	Optional bool   `mapstructure:"optional,omitempty"`
+	// Type of the value: string (default), number, boolean or choice.
+	Type        string   `mapstructure:"type,omitempty" validate:"regexp=^(string|number|boolean|choice)?$"`
+	Choices     []string `mapstructure:"choices,omitempty"` // Values a choice can take.
+	Pattern     string   `mapstructure:"pattern,omitempty"` // Regular expression a string value must match.
+	Description string   `mapstructure:"description,omitempty"`
+	// Secret values are masked when prompted and not printed.
+	Secret bool `mapstructure:"secret,omitempty"`
+}
+
+// Check validates a value of the input and returns it normalized: booleans
+// become true or false. Empty values are only checked by the caller, since
+// optional inputs may be left empty.
+func (i Input) Check(value string) (string, error) {
+	switch i.Type {
+	case InputNumber:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return value, fmt.Errorf("%s is not a number", value)
+		}
+	case InputBoolean:
+		switch strings.ToLower(value) {
+		case "true", "yes", "y", "1", "on":
+			return "true", nil
+		case "false", "no", "n", "0", "off":
+			return "false", nil
+		}
+		return value, fmt.Errorf("%s is not true or false", value)
+	case InputChoice:
+		for _, c := range i.Choices {
+			if c == value {
+				return value, nil
+			}
+		}
+		return value, fmt.Errorf("%s is not one of %s", value, strings.Join(i.Choices, ", "))
+	}
+	if i.Pattern != "" {
+		re, err := regexp.Compile(i.Pattern)
+		if err != nil {
+			return value, fmt.Errorf("invalid pattern %s: %w", i.Pattern, err)
+		}
+		if !re.MatchString(value) {
+			return value, fmt.Errorf("%s does not match %s", value, i.Pattern)
+		}
+	}
+	return value, nil
+}
+
+// IsTrue reports whether an optional boolean is set to true. Booleans a
+// workflow extending another one or a stage using a template can override
+// are pointers, so that false replaces true.
+func IsTrue(b *bool) bool {
+	return b != nil && *b
 }
 
 type Stage struct {
 	Stage     string   `mapstructure:"stage" validate:"nonzero"`
 	ID        string   `mapstructure:"id,omitempty" validate:"nonzero,nowhitespace"`
-	Script    []string `mapstructure:"script" validate:"nonzero"`
+	Script    []string `mapstructure:"script"` // Required unless the stage uses a workflow.
 	If        string   `mapstructure:"if,omitempty"`
-	Clean     bool     `mapstructure:"clean,omitempty"`
+	Clean     *bool    `mapstructure:"clean,omitempty"`
 	Env       []Env    `mapstructure:"env,omitempty"`
-	Artifacts []string `mapstructure:"artifacts,omitempty"`
+	Artifacts []string `mapstructure:"artifacts,omitempty" validate:"globs"` // Glob patterns, ! excludes.
 	Image     string   `mapstructure:"image,omitempty"`
+	Pull      string   `mapstructure:"pull,omitempty" validate:"regexp=^(always|if-not-present|never)?$"`
 	Needs     string   `mapstructure:"needs,omitempty" validate:"nowhitespace"`
 	Import    []Import `mapstructure:"import,omitempty"`
+	Timeout   string   `mapstructure:"timeout,omitempty" validate:"duration"`
+	Retry     *Retry   `mapstructure:"retry,omitempty"`
+	// IfNoFilesFound is what to do when an artifact or import pattern
+	// matches no files: warn (default), error or ignore.
+	IfNoFilesFound string `mapstructure:"if_no_files_found,omitempty" yaml:"if_no_files_found,omitempty" validate:"regexp=^(warn|error|ignore)?$"`
+	// ContinueOnError keeps the run going when this stage fails: its
+	// dependents still run and the run result is not affected.
+	ContinueOnError *bool `mapstructure:"continue_on_error,omitempty" yaml:"continue_on_error,omitempty"`
+	// Matrix expands the stage into one instance per combination of values.
+	Matrix   map[string]MatrixValues `mapstructure:"matrix,omitempty"`
+	MatrixOf string                  `mapstructure:"matrix_of,omitempty" yaml:"-"` // To be filled automatically. ID of the stage this instance was expanded from.
+	// Resources overrides the workflow resources for this stage only.
+	Resources *Resources `mapstructure:"resources,omitempty"`
+	// Services are started before the stage and removed after it. A
+	// service with the same name as a workflow service replaces it.
+	Services []Service `mapstructure:"services,omitempty"`
+	// Uses runs the workflow <repo>/<workflow id> as a nested run instead of
+	// a script, with the With values as its inputs. The outputs of its
+	// stages are the outputs of this stage.
+	Uses string            `mapstructure:"uses,omitempty"`
+	With map[string]string `mapstructure:"with,omitempty"`
+	// Template is the name of a template of the workflow the stage takes
+	// the fields it does not set from.
+	Template string `mapstructure:"template,omitempty"`
+}
+
+// Service is a container running next to a stage, such as a database.
+// The stage reaches it by its name.
+type Service struct {
+	Name        string       `mapstructure:"name" validate:"nonzero,nowhitespace"`
+	Image       string       `mapstructure:"image" validate:"nonzero,nowhitespace"`
+	Pull        string       `mapstructure:"pull,omitempty" validate:"regexp=^(always|if-not-present|never)?$"`
+	Env         []Env        `mapstructure:"env,omitempty"`
+	Command     []string     `mapstructure:"command,omitempty"`
+	HealthCheck *HealthCheck `mapstructure:"health_check,omitempty" yaml:"health_check,omitempty"`
+}
+
+// HealthCheck is a command run inside a service container. The stage starts
+// once it succeeds, and fails if it did not succeed after all the retries.
+type HealthCheck struct {
+	Command  []string `mapstructure:"command" validate:"nonzero"`
+	Interval string   `mapstructure:"interval,omitempty" validate:"duration"`
+	Timeout  string   `mapstructure:"timeout,omitempty" validate:"duration"`
+	Retries  int      `mapstructure:"retries,omitempty" validate:"min=0"`
+}
+
+// Settings returns the interval, timeout and retries of the health check,
+// defaulting to 2s, 5s and 30.
+func (h *HealthCheck) Settings() (time.Duration, time.Duration, int) {
+	interval, err := time.ParseDuration(h.Interval)
+	if err != nil || interval <= 0 {
+		interval = 2 * time.Second
+	}
+	timeout, err := time.ParseDuration(h.Timeout)
+	if err != nil || timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	retries := h.Retries
+	if retries <= 0 {
+		retries = 30
+	}
+	return interval, timeout, retries
+}
+
+// Resources are the cpu and memory requests and limits of a stage, in
+// Kubernetes quantity format (cpu: 500m, memory: 256Mi).
+type Resources struct {
+	Requests ResourceList `mapstructure:"requests,omitempty"`
+	Limits   ResourceList `mapstructure:"limits,omitempty"`
+}
+
+type ResourceList struct {
+	CPU    string `mapstructure:"cpu,omitempty" validate:"quantity"`
+	Memory string `mapstructure:"memory,omitempty" validate:"quantity"`
+}
+
+// Merge returns r with every value it does not set taken from defaults.
+func (r *Resources) Merge(defaults *Resources) Resources {
+	merged := Resources{}
+	if defaults != nil {
+		merged = *defaults
+	}
+	if r == nil {
+		return merged
+	}
+	if r.Requests.CPU != "" {
+		merged.Requests.CPU = r.Requests.CPU
+	}
+	if r.Requests.Memory != "" {
+		merged.Requests.Memory = r.Requests.Memory
+	}
+	if r.Limits.CPU != "" {
+		merged.Limits.CPU = r.Limits.CPU
+	}
+	if r.Limits.Memory != "" {
+		merged.Limits.Memory = r.Limits.Memory
+	}
+	return merged
+}
+
+// MatrixValues are the values of a single matrix axis. A single string is
+// accepted as a one element list so an axis can come from an input: `region: $regions`.
+type MatrixValues []string
+
+func (m *MatrixValues) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*m = MatrixValues{value.Value}
+		return nil
+	}
+	var values []string
+	if err := value.Decode(&values); err != nil {
+		return err
+	}
+	*m = values
+	return nil
+}
+
+type Retry struct {
+	Attempts  int    `mapstructure:"attempts" validate:"min=1"`
+	Backoff   string `mapstructure:"backoff,omitempty" validate:"duration"`
+	ExitCodes []int  `mapstructure:"exit_codes,omitempty" yaml:"exit_codes,omitempty"`
 }
 
 type Import struct {
 	From      string   `mapstructure:"from" validate:"nonzero,nowhitespace"`
-	Artifacts []string `mapstructure:"artifacts" validate:"nonzero"`
+	Artifacts []string `mapstructure:"artifacts" validate:"nonzero,globs"` // Glob patterns, ! excludes.
 }
 
 type Env struct {
@@ -80,13 +293,52 @@ type Env struct {
 type Workflow struct {
 	_id         string
 	ID          string  `mapstructure:"id" validate:"nonzero,nowhitespace"`
-	Image       string  `mapstructure:"image" validate:"nonzero,nowhitespace"`
+	Image       string  `mapstructure:"image" validate:"nonzero,image"`
+	Pull        string  `mapstructure:"pull,omitempty" validate:"regexp=^(always|if-not-present|never)?$"`
 	Description string  `mapstructure:"description"`
 	Env         []Env   `mapstructure:"env"`
 	Input       []Input `mapstructure:"input"`
-	// Mount       bool    `mapstructure:"mount"`
+	Timeout     string  `mapstructure:"timeout,omitempty" validate:"duration"`
+	// Secrets are the names of the config secrets every stage receives as
+	// env variables. Their values are masked in logs and outputs.
+	Secrets []string `mapstructure:"secrets,omitempty"`
+	// Resources are the default resources of every stage.
+	Resources *Resources `mapstructure:"resources,omitempty"`
+	// Services are started next to every stage.
+	Services []Service `mapstructure:"services,omitempty"`
+	// Mount copies the content of the workflow repository into the workspace of every stage.
+	Mount  *bool   `mapstructure:"mount,omitempty"`
 	Stages []Stage `mapstructure:"stages" validate:"nonzero"`
-	Repo   string  `mapstructure:"repository,omitempty"` // To be filled automatically. Not part of YAML.
+	Repo   string  `mapstructure:"repository,omitempty"`                    // To be filled automatically. Not part of YAML.
+	Commit string  `mapstructure:"commit,omitempty" yaml:"-" hash:"ignore"` // To be filled automatically. The git commit the workflow was read from.
+	File   string  `mapstructure:"file,omitempty" yaml:"-" hash:"ignore"`   // To be filled automatically. The file the workflow was read from.
+	// Extends is the workflow, <repo>/<workflow id>, this workflow is based on.
+	Extends string `mapstructure:"extends,omitempty"`
+	// Templates are stages that stages can take their fields from, by name.
+	// They are applied when the workflow is loaded.
+	Templates map[string]Stage `mapstructure:"templates,omitempty"`
+}
+
+// Registry holds the credentials used to pull images from a private registry.
+// Username and password are expanded with environment variables, so they can
+// be kept out of the config file: password: ${REGISTRY_TOKEN}
+type Registry struct {
+	Server   string `mapstructure:"server" yaml:"server" validate:"nonzero"`
+	Username string `mapstructure:"username,omitempty" yaml:"username,omitempty"`
+	Password string `mapstructure:"password,omitempty" yaml:"password,omitempty"`
+	// Secret is an existing image pull secret. It is used on Kubernetes
+	// instead of generating one from the username and password.
+	Secret string `mapstructure:"secret,omitempty" yaml:"secret,omitempty"`
+}
+
+// Secret is a value stages can receive without it being printed. It is read
+// from an env variable, a file or a provider such as vault.
+type Secret struct {
+	Name     string `mapstructure:"name" yaml:"name" validate:"nonzero,nowhitespace"`
+	Env      string `mapstructure:"env,omitempty" yaml:"env,omitempty"`
+	File     string `mapstructure:"file,omitempty" yaml:"file,omitempty"`
+	Provider string `mapstructure:"provider,omitempty" yaml:"provider,omitempty"`
+	Key      string `mapstructure:"key,omitempty" yaml:"key,omitempty"` // Key of the secret in the provider, e.g. secret/myapp#password for vault.
 }
 
 type WorkflowArgument struct {
@@ -0,0 +1,69 @@
+package internaltypes
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInputCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   Input
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "string", input: Input{}, value: "any value", want: "any value"},
+		{name: "explicit string", input: Input{Type: InputString}, value: "1", want: "1"},
+		{name: "integer", input: Input{Type: InputNumber}, value: "42", want: "42"},
+		{name: "float", input: Input{Type: InputNumber}, value: "-1.5e3", want: "-1.5e3"},
+		{name: "not a number", input: Input{Type: InputNumber}, value: "4two", want: "4two", wantErr: true},
+		{name: "true", input: Input{Type: InputBoolean}, value: "TRUE", want: "true"},
+		{name: "yes", input: Input{Type: InputBoolean}, value: "yes", want: "true"},
+		{name: "on", input: Input{Type: InputBoolean}, value: "On", want: "true"},
+		{name: "1", input: Input{Type: InputBoolean}, value: "1", want: "true"},
+		{name: "false", input: Input{Type: InputBoolean}, value: "False", want: "false"},
+		{name: "n", input: Input{Type: InputBoolean}, value: "n", want: "false"},
+		{name: "off", input: Input{Type: InputBoolean}, value: "off", want: "false"},
+		{name: "not a boolean", input: Input{Type: InputBoolean}, value: "maybe", want: "maybe", wantErr: true},
+		{name: "choice", input: Input{Type: InputChoice, Choices: []string{"dev", "prod"}}, value: "prod", want: "prod"},
+		{name: "choices are case sensitive", input: Input{Type: InputChoice, Choices: []string{"dev", "prod"}}, value: "Prod", want: "Prod", wantErr: true},
+		{name: "matching pattern", input: Input{Pattern: `^v[0-9]+\.[0-9]+$`}, value: "v1.2", want: "v1.2"},
+		{name: "pattern is not anchored", input: Input{Pattern: `[0-9]`}, value: "v1", want: "v1"},
+		{name: "not matching pattern", input: Input{Pattern: `^v[0-9]+$`}, value: "1", want: "1", wantErr: true},
+		{name: "number with pattern", input: Input{Type: InputNumber, Pattern: `^[0-9]+$`}, value: "1.5", want: "1.5", wantErr: true},
+		{name: "invalid pattern", input: Input{Pattern: `(`}, value: "x", want: "x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.input.Check(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Check(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthCheckSettings(t *testing.T) {
+	tests := []struct {
+		name              string
+		check             HealthCheck
+		interval, timeout time.Duration
+		retries           int
+	}{
+		{name: "defaults", interval: 2 * time.Second, timeout: 5 * time.Second, retries: 30},
+		{name: "set", check: HealthCheck{Interval: "500ms", Timeout: "1s", Retries: 3}, interval: 500 * time.Millisecond, timeout: time.Second, retries: 3},
+		{name: "invalid", check: HealthCheck{Interval: "often", Timeout: "-1s", Retries: -1}, interval: 2 * time.Second, timeout: 5 * time.Second, retries: 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interval, timeout, retries := tt.check.Settings()
+			if interval != tt.interval || timeout != tt.timeout || retries != tt.retries {
+				t.Errorf("Settings() = %s, %s, %d, want %s, %s, %d", interval, timeout, retries, tt.interval, tt.timeout, tt.retries)
+			}
+		})
+	}
+}
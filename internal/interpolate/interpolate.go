@@ -0,0 +1,182 @@
+package interpolate
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+)
+
+// reference is a ${{ expression }} in a workflow field.
+var reference = regexp.MustCompile(`\$\{\{\s*(.*?)\s*\}\}`)
+
+// Context holds the values references can be resolved to.
+type Context struct {
+	Inputs map[string]string
+	Env    map[string]string
+	// Needs holds the outputs of the needed stages, by stage ID. Nil when
+	// outputs are not known yet, such as when validating.
+	Needs map[string]map[string]string
+	// NeedIDs are the stages that can be referenced.
+	NeedIDs []string
+}
+
+// String replaces every reference in s:
+//
+//	${{ inputs.<name> }}
+//	${{ env.<name> }}
+//	${{ needs.<stage id>.outputs.<key> }}
+//
+// It returns an error for every reference that cannot be resolved.
+func String(s string, ctx Context) (string, []error) {
+	errs := []error{}
+	resolved := reference.ReplaceAllStringFunc(s, func(match string) string {
+		expr := reference.FindStringSubmatch(match)[1]
+		value, err := resolve(expr, ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", match, err))
+			return match
+		}
+		return value
+	})
+	return resolved, errs
+}
+
+func resolve(expr string, ctx Context) (string, error) {
+	parts := strings.Split(expr, ".")
+	switch {
+	case len(parts) == 2 && parts[0] == "inputs":
+		if v, ok := ctx.Inputs[parts[1]]; ok {
+			return v, nil
+		}
+		return "", fmt.Errorf("no input named %s", parts[1])
+	case len(parts) == 2 && parts[0] == "env":
+		if v, ok := ctx.Env[parts[1]]; ok {
+			return v, nil
+		}
+		return "", fmt.Errorf("no env named %s", parts[1])
+	case len(parts) == 4 && parts[0] == "needs" && parts[2] == "outputs":
+		found := false
+		for _, id := range ctx.NeedIDs {
+			if id == parts[1] {
+				found = true
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("stage %s is not in needs", parts[1])
+		}
+		if ctx.Needs == nil {
+			return "", nil
+		}
+		if v, ok := ctx.Needs[parts[1]][parts[3]]; ok {
+			return v, nil
+		}
+		return "", fmt.Errorf("stage %s has no output named %s", parts[1], parts[3])
+	}
+	return "", errors.New("must be inputs.<name>, env.<name> or needs.<stage id>.outputs.<key>")
+}
+
+// Resolve returns the workflow and the stage with the references in the
+// stage script, image, env, artifacts and with values and in the workflow
+// image resolved. Env values are resolved in order, so they can refer to the
+// workflow env and to the stage env defined before them. outputs holds the
+// outputs of finished stages by ID, or nil to only check the references.
+func Resolve(w internaltypes.Workflow, s internaltypes.Stage, outputs map[string][]internaltypes.Env) (internaltypes.Workflow, internaltypes.Stage, error) {
+	ctx := Context{Inputs: make(map[string]string), Env: make(map[string]string)}
+	for _, i := range w.Input {
+		ctx.Inputs[i.Name] = i.Default
+	}
+	for _, e := range w.Env {
+		ctx.Env[e.Name] = e.Value
+	}
+	if s.Needs != "" {
+		ctx.NeedIDs = strings.Split(s.Needs, ",")
+	}
+	if outputs != nil {
+		ctx.Needs = make(map[string]map[string]string)
+		for _, id := range ctx.NeedIDs {
+			ctx.Needs[id] = make(map[string]string)
+			for _, o := range outputs[id] {
+				ctx.Needs[id][o.Name] = o.Value
+			}
+		}
+	}
+	errs := []string{}
+	field := func(name, value string, c Context) string {
+		resolved, fieldErrs := String(value, c)
+		for _, err := range fieldErrs {
+			errs = append(errs, fmt.Sprintf("%s %s", name, err))
+		}
+		return resolved
+	}
+
+	// The workflow image is shared by all stages, it can only refer to
+	// inputs and the workflow env.
+	w.Image = field("workflow image", w.Image, Context{Inputs: ctx.Inputs, Env: ctx.Env})
+
+	env := make([]internaltypes.Env, len(s.Env))
+	for i, e := range s.Env {
+		env[i] = internaltypes.Env{Name: e.Name, Value: field("env "+e.Name, e.Value, ctx)}
+		ctx.Env[e.Name] = env[i].Value
+	}
+	s.Env = env
+	s.Image = field("image", s.Image, ctx)
+	script := make([]string, len(s.Script))
+	for i, line := range s.Script {
+		script[i] = field("script", line, ctx)
+	}
+	s.Script = script
+	artifacts := make([]string, len(s.Artifacts))
+	for i, a := range s.Artifacts {
+		artifacts[i] = field("artifacts", a, ctx)
+	}
+	s.Artifacts = artifacts
+	if s.With != nil {
+		names := make([]string, 0, len(s.With))
+		for name := range s.With {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		with := make(map[string]string, len(s.With))
+		for _, name := range names {
+			with[name] = field("with "+name, s.With[name], ctx)
+		}
+		s.With = with
+	}
+
+	if len(errs) > 0 {
+		return w, s, fmt.Errorf("unresolved references: %s", strings.Join(errs, "; "))
+	}
+	return w, s, nil
+}
+
+// Strip removes every reference from s, for validating the rest of a value.
+func Strip(s string) string {
+	return reference.ReplaceAllString(s, "")
+}
+
+// Check reports the references of the workflow that can never be resolved,
+// by field: inputs and env that are not defined and stages that are not
+// needed. Outputs of needed stages are only known when the workflow runs.
+func Check(w internaltypes.Workflow) map[string]error {
+	errs := make(map[string]error)
+	if _, _, err := Resolve(internaltypes.Workflow{Image: w.Image, Input: w.Input, Env: w.Env}, internaltypes.Stage{}, nil); err != nil {
+		errs["Image"] = err
+	}
+	stageless := w
+	stageless.Image = ""
+	for j, s := range w.Stages {
+		// Matrix axes are added to the env of every instance.
+		s.Env = append([]internaltypes.Env{}, s.Env...)
+		for axis := range s.Matrix {
+			s.Env = append(s.Env, internaltypes.Env{Name: axis})
+		}
+		if _, _, err := Resolve(stageless, s, nil); err != nil {
+			errs[fmt.Sprintf("Stages[%d]", j)] = err
+		}
+	}
+	return errs
+}
@@ -0,0 +1,176 @@
+package interpolate
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+)
+
+func TestString(t *testing.T) {
+	ctx := Context{
+		Inputs:  map[string]string{"version": "1.2", "empty": ""},
+		Env:     map[string]string{"REGISTRY": "ghcr.io"},
+		Needs:   map[string]map[string]string{"build": {"tag": "v1"}},
+		NeedIDs: []string{"build", "test"},
+	}
+	tests := []struct {
+		name    string
+		s       string
+		ctx     Context
+		want    string
+		wantErr int
+	}{
+		{name: "no references", s: "echo $HOME ${HOME} {{ x }}", ctx: ctx, want: "echo $HOME ${HOME} {{ x }}"},
+		{name: "input", s: "v${{ inputs.version }}", ctx: ctx, want: "v1.2"},
+		{name: "spaces", s: "${{inputs.version}} ${{   env.REGISTRY   }}", ctx: ctx, want: "1.2 ghcr.io"},
+		{name: "empty input", s: "[${{ inputs.empty }}]", ctx: ctx, want: "[]"},
+		{name: "output", s: "${{ env.REGISTRY }}/app:${{ needs.build.outputs.tag }}", ctx: ctx, want: "ghcr.io/app:v1"},
+		{name: "unknown input", s: "${{ inputs.missing }}", ctx: ctx, want: "${{ inputs.missing }}", wantErr: 1},
+		{name: "unknown env", s: "${{ env.MISSING }}", ctx: ctx, want: "${{ env.MISSING }}", wantErr: 1},
+		{name: "stage not needed", s: "${{ needs.other.outputs.tag }}", ctx: ctx, want: "${{ needs.other.outputs.tag }}", wantErr: 1},
+		{name: "unknown output", s: "${{ needs.test.outputs.tag }}", ctx: ctx, want: "${{ needs.test.outputs.tag }}", wantErr: 1},
+		{
+			name: "outputs not known yet",
+			s:    "${{ needs.build.outputs.anything }}",
+			ctx:  Context{NeedIDs: []string{"build"}},
+			want: "",
+		},
+		{name: "invalid reference", s: "${{ secrets.TOKEN }} ${{ inputs }}", ctx: ctx, want: "${{ secrets.TOKEN }} ${{ inputs }}", wantErr: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs := String(tt.s, tt.ctx)
+			if got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+			if len(errs) != tt.wantErr {
+				t.Errorf("String() errors = %v, want %d errors", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	w := internaltypes.Workflow{
+		Image: "${{ env.REGISTRY }}/base:${{ inputs.version }}",
+		Input: []internaltypes.Input{{Name: "version", Default: "1.2"}},
+		Env:   []internaltypes.Env{{Name: "REGISTRY", Value: "ghcr.io"}},
+	}
+	s := internaltypes.Stage{
+		ID:    "deploy",
+		Needs: "build",
+		Image: "${{ env.REGISTRY }}/deploy",
+		Env: []internaltypes.Env{
+			{Name: "TAG", Value: "${{ needs.build.outputs.tag }}"},
+			{Name: "IMAGE", Value: "${{ env.REGISTRY }}/app:${{ env.TAG }}"},
+		},
+		Script:    []string{"deploy", "${{ env.IMAGE }}"},
+		Artifacts: []string{"dist/${{ inputs.version }}/**"},
+		With:      map[string]string{"image": "${{ env.IMAGE }}"},
+	}
+	outputs := map[string][]internaltypes.Env{"build": {{Name: "tag", Value: "v1"}}}
+	gotW, gotS, err := Resolve(w, s, outputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ghcr.io/base:1.2"; gotW.Image != want {
+		t.Errorf("workflow image = %q, want %q", gotW.Image, want)
+	}
+	if want := "ghcr.io/deploy"; gotS.Image != want {
+		t.Errorf("image = %q, want %q", gotS.Image, want)
+	}
+	env := []internaltypes.Env{{Name: "TAG", Value: "v1"}, {Name: "IMAGE", Value: "ghcr.io/app:v1"}}
+	if !reflect.DeepEqual(gotS.Env, env) {
+		t.Errorf("env = %v, want %v", gotS.Env, env)
+	}
+	if want := []string{"deploy", "ghcr.io/app:v1"}; !reflect.DeepEqual(gotS.Script, want) {
+		t.Errorf("script = %v, want %v", gotS.Script, want)
+	}
+	if want := []string{"dist/1.2/**"}; !reflect.DeepEqual(gotS.Artifacts, want) {
+		t.Errorf("artifacts = %v, want %v", gotS.Artifacts, want)
+	}
+	if want := map[string]string{"image": "ghcr.io/app:v1"}; !reflect.DeepEqual(gotS.With, want) {
+		t.Errorf("with = %v, want %v", gotS.With, want)
+	}
+	if s.Env[0].Value != "${{ needs.build.outputs.tag }}" || s.Script[1] != "${{ env.IMAGE }}" {
+		t.Errorf("Resolve() changed the stage it was given: %v, %v", s.Env, s.Script)
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		w     internaltypes.Workflow
+		s     internaltypes.Stage
+		wants []string
+	}{
+		{
+			name:  "workflow image cannot read the stage env",
+			w:     internaltypes.Workflow{Image: "${{ env.STAGE }}"},
+			s:     internaltypes.Stage{Env: []internaltypes.Env{{Name: "STAGE", Value: "x"}}},
+			wants: []string{"workflow image ${{ env.STAGE }}: no env named STAGE"},
+		},
+		{
+			name: "env cannot read later env",
+			s: internaltypes.Stage{Env: []internaltypes.Env{
+				{Name: "A", Value: "${{ env.B }}"},
+				{Name: "B", Value: "b"},
+			}},
+			wants: []string{"env A ${{ env.B }}: no env named B"},
+		},
+		{
+			name: "every field is reported",
+			s: internaltypes.Stage{
+				Script:    []string{"${{ inputs.a }}"},
+				Artifacts: []string{"${{ inputs.b }}"},
+				With:      map[string]string{"x": "${{ needs.other.outputs.c }}"},
+			},
+			wants: []string{"script ${{ inputs.a }}", "artifacts ${{ inputs.b }}", "with x ${{ needs.other.outputs.c }}: stage other is not in needs"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Resolve(tt.w, tt.s, map[string][]internaltypes.Env{})
+			if err == nil {
+				t.Fatal("Resolve() error = nil, want an error")
+			}
+			for _, want := range tt.wants {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Resolve() error = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStrip(t *testing.T) {
+	if got, want := Strip("dist/${{ inputs.version }}/*${{env.EXT}}"), "dist//*"; got != want {
+		t.Errorf("Strip() = %q, want %q", got, want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	w := internaltypes.Workflow{
+		Image: "${{ inputs.missing }}",
+		Input: []internaltypes.Input{{Name: "version"}},
+		Env:   []internaltypes.Env{{Name: "REGISTRY"}},
+		Stages: []internaltypes.Stage{
+			{ID: "build", Script: []string{"${{ inputs.version }} ${{ env.REGISTRY }}"}},
+			{ID: "test", Needs: "build", Script: []string{"${{ needs.build.outputs.anything }}"}},
+			{ID: "matrix", Matrix: map[string]internaltypes.MatrixValues{"os": {"linux"}}, Script: []string{"${{ env.os }}"}},
+			{ID: "bad", Script: []string{"${{ needs.build.outputs.tag }}"}},
+		},
+	}
+	errs := Check(w)
+	fields := []string{}
+	for f := range errs {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	if want := []string{"Image", "Stages[3]"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("Check() fields = %v, want %v: %v", fields, want, errs)
+	}
+}
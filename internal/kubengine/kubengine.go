@@ -2,7 +2,10 @@ package kubengine
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -18,12 +21,15 @@ import (
 	_ "unsafe"
 
 	"github.com/google/uuid"
+	"github.com/jatalocks/opsilon/internal/artifacts"
 	"github.com/jatalocks/opsilon/internal/engine"
+	"github.com/jatalocks/opsilon/internal/executor"
 	"github.com/jatalocks/opsilon/internal/internaltypes"
 	"github.com/jatalocks/opsilon/internal/logger"
-	"github.com/mitchellh/hashstructure/v2"
+	"github.com/jatalocks/opsilon/internal/registry"
 	"golang.org/x/exp/slices"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -37,9 +43,10 @@ import (
 )
 
 type Client struct {
-	k8s    kubernetes.Interface
-	ns     string
-	config rest.Config
+	k8s        kubernetes.Interface
+	ns         string
+	config     rest.Config
+	registries []internaltypes.Registry
 }
 
 type RequestBody struct {
@@ -157,8 +164,12 @@ func (c *Client) RemoveVolume(ctx context.Context, vol string, claim *v1.Persist
 }
 
 // func (c *Client) CreatePod(ctx context.Context, name string, image string, command []string, envs []internaltypes.Env, volume string, claim *v1.PersistentVolumeClaim) (error, v1.Pod) {
-func (c *Client) CreatePod(ctx context.Context, name string, image string, s internaltypes.Stage, envs []internaltypes.Env, runid string, w internaltypes.Workflow, LwWhite *logger.MyLogWriter) (error, v1.Pod) {
+func (c *Client) CreatePod(ctx context.Context, name string, image string, pull string, resources internaltypes.Resources, services []internaltypes.Service, sources []string, s internaltypes.Stage, envs []internaltypes.Env, runid string, w internaltypes.Workflow, LwWhite *logger.MyLogWriter) (error, v1.Pod) {
 	envVar := ToV1Env(envs)
+	requirements, err := ToV1Resources(resources)
+	if err != nil {
+		return err, v1.Pod{}
+	}
 	VolumeMounts := []v1.VolumeMount{{Name: "emptyoutput", MountPath: "/output"}}
 	Volumes := []v1.Volume{{
 		Name:         "emptyoutput",
@@ -172,7 +183,9 @@ func (c *Client) CreatePod(ctx context.Context, name string, image string, s int
 	// 	})
 	// } else {
 	mountApp, err := os.MkdirTemp("", "app")
-	logger.HandleErr(err)
+	if err != nil {
+		return err, v1.Pod{}
+	}
 	defer os.RemoveAll(mountApp)
 
 	VolumeMounts = append(VolumeMounts, v1.VolumeMount{Name: "emptydir", MountPath: "/app"})
@@ -183,7 +196,7 @@ func (c *Client) CreatePod(ctx context.Context, name string, image string, s int
 		}},
 	})
 
-	if len(s.Import) > 0 {
+	if len(sources) > 0 {
 		pod := &v1.Pod{
 			ObjectMeta: metav1.ObjectMeta{Name: name + "-loader"},
 			Spec: v1.PodSpec{
@@ -204,24 +217,28 @@ func (c *Client) CreatePod(ctx context.Context, name string, image string, s int
 		_, err = c.k8s.CoreV1().
 			Pods(c.ns).
 			Create(ctx, pod, metav1.CreateOptions{})
-		current, _ := os.Getwd()
-		err := c.waitPod(ctx, name+"-loader", LwWhite, "Terminated")
-		logger.HandleErr(err)
-		for _, v := range s.Import {
-			for _, a := range v.Artifacts {
-				from := filepath.Join(current, "artifacts", w.Repo, w.ID, runid, v.From, a)
-				to := filepath.Join("/app")
-				fmt.Println("Copying", from, "To", to)
-				copyToPod(c, from, to, name+"-loader", ctx)
-				if err != nil {
-					fmt.Println(err)
-				}
-			}
+		if err != nil {
+			return err, v1.Pod{}
 		}
-
 		defer func(cli *Client, podName string) {
-			go cli.DeletePod(ctx, podName)
+			go cli.DeletePod(context.Background(), podName)
 		}(c, name+"-loader")
+		if err := c.waitPod(ctx, name+"-loader", LwWhite, "Terminated"); err != nil {
+			return err, v1.Pod{}
+		}
+		// copyToPod copies a path into the destination directory, copy every
+		// entry so the content of each source ends up in /app itself.
+		for _, source := range sources {
+			entries, err := os.ReadDir(source)
+			if err != nil {
+				return err, v1.Pod{}
+			}
+			for _, entry := range entries {
+				if err := copyToPod(c, filepath.Join(source, entry.Name()), "/app", name+"-loader", ctx); err != nil {
+					return err, v1.Pod{}
+				}
+			}
+		}
 	}
 
 	// engine.LoadImportsIntoStage(s, mountApp, runid, w)
@@ -235,32 +252,71 @@ func (c *Client) CreatePod(ctx context.Context, name string, image string, s int
 	// 		VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claimOutput.Name}},
 	// 	})
 	// }
+	main := v1.Container{
+		Name:            "main",
+		Image:           image,
+		ImagePullPolicy: ToV1PullPolicy(pull),
+		Command:         s.Script,
+		WorkingDir:      "/app",
+		Env:             *envVar,
+		VolumeMounts:    VolumeMounts,
+		Resources:       requirements,
+	}
+	keepalive := v1.Container{
+		Name:         "keepalive",
+		Image:        "busybox",
+		WorkingDir:   "/app",
+		Command:      []string{"/bin/sh", "-c", "sleep 60"},
+		VolumeMounts: VolumeMounts,
+	}
 	pod := &v1.Pod{
 		ObjectMeta: metav1.ObjectMeta{Name: name},
 		Spec: v1.PodSpec{
-			RestartPolicy: v1.RestartPolicyNever,
-			Volumes:       Volumes,
-			InitContainers: []v1.Container{
-				v1.Container{
-					Name:         "main",
-					Image:        image,
-					Command:      s.Script,
-					WorkingDir:   "/app",
-					Env:          *envVar,
-					VolumeMounts: VolumeMounts,
-				},
-			},
-			Containers: []v1.Container{
-				v1.Container{
-					Name:         "keepalive",
-					Image:        "busybox",
-					WorkingDir:   "/app",
-					Command:      []string{"/bin/sh", "-c", "sleep 60"},
-					VolumeMounts: VolumeMounts,
-				},
-			},
+			RestartPolicy:  v1.RestartPolicyNever,
+			Volumes:        Volumes,
+			InitContainers: []v1.Container{main},
+			Containers:     []v1.Container{keepalive},
 		},
 	}
+	images := []string{image}
+	for _, service := range services {
+		images = append(images, service.Image)
+	}
+	pullSecrets, err := c.createPullSecrets(ctx, name, images)
+	if err != nil {
+		return err, v1.Pod{}
+	}
+	pod.Spec.ImagePullSecrets = pullSecrets
+	if len(services) > 0 {
+		// Init containers run before any other container, so with services the
+		// stage runs as a regular container next to them. Its command waits
+		// for the ready file, written by waitServices once every service
+		// passed its health check, with the shell the gate container copies
+		// in, as the stage image may have none.
+		// keepalive runs until the pod is deleted, as it starts with the stage.
+		keepalive.Command = []string{"/bin/sh", "-c", "trap 'exit 0' TERM; while true; do sleep 1; done"}
+		gateMount := v1.VolumeMount{Name: "opsilon-gate", MountPath: gateDir}
+		pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{Name: "opsilon-gate", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}})
+		main.VolumeMounts = append(append([]v1.VolumeMount{}, main.VolumeMounts...), gateMount)
+		keepalive.VolumeMounts = append(append([]v1.VolumeMount{}, keepalive.VolumeMounts...), gateMount)
+		main.Command = append([]string{gateShell, "sh", "-c", gateScript, "gate"}, s.Script...)
+		gate := v1.Container{
+			Name:         "gate",
+			Image:        "busybox",
+			Command:      []string{"/bin/cp", "/bin/busybox", gateShell},
+			VolumeMounts: []v1.VolumeMount{gateMount},
+		}
+		hostnames := []string{}
+		containers := []v1.Container{}
+		for _, service := range services {
+			containers = append(containers, toV1Service(service))
+			hostnames = append(hostnames, service.Name)
+		}
+		pod.Spec.InitContainers = []v1.Container{gate}
+		pod.Spec.Containers = append(containers, main, keepalive)
+		// Containers of a pod share its network, services are reached on localhost.
+		pod.Spec.HostAliases = []v1.HostAlias{{IP: "127.0.0.1", Hostnames: hostnames}}
+	}
 
 	_, err = c.k8s.CoreV1().
 		Pods(c.ns).
@@ -269,26 +325,115 @@ func (c *Client) CreatePod(ctx context.Context, name string, image string, s int
 	return err, *pod
 }
 
+// ToV1Resources maps the stage resources to the requirements of its container.
+func ToV1Resources(r internaltypes.Resources) (v1.ResourceRequirements, error) {
+	requirements := v1.ResourceRequirements{}
+	requests, err := toV1ResourceList(r.Requests)
+	if err != nil {
+		return requirements, err
+	}
+	limits, err := toV1ResourceList(r.Limits)
+	if err != nil {
+		return requirements, err
+	}
+	if len(requests) > 0 {
+		requirements.Requests = requests
+	}
+	if len(limits) > 0 {
+		requirements.Limits = limits
+	}
+	return requirements, nil
+}
+
+func toV1ResourceList(r internaltypes.ResourceList) (v1.ResourceList, error) {
+	list := v1.ResourceList{}
+	if r.CPU != "" {
+		q, err := resource.ParseQuantity(r.CPU)
+		if err != nil {
+			return list, err
+		}
+		list[v1.ResourceCPU] = q
+	}
+	if r.Memory != "" {
+		q, err := resource.ParseQuantity(r.Memory)
+		if err != nil {
+			return list, err
+		}
+		list[v1.ResourceMemory] = q
+	}
+	return list, nil
+}
+
 func (c *Client) GetPodExitCode(ctx context.Context, name string) (int32, error) {
 	var exitCode int32
 	podCli := c.k8s.CoreV1().Pods(c.ns)
-	err := wait.PollImmediate(3*time.Second, 2*time.Minute, func() (bool, error) {
+	// Poll until the pod terminates or the stage context is done (cancelled or timed out).
+	err := wait.PollImmediateUntil(3*time.Second, func() (bool, error) {
 		p, err := podCli.Get(ctx, name, metav1.GetOptions{})
 		if err != nil {
 			return false, err
 		}
-		if len(p.Status.ContainerStatuses) == 0 {
-			return false, nil
-		}
-		if status := p.Status.InitContainerStatuses[0].State.Terminated; status != nil {
-			exitCode = status.ExitCode
+		status := mainStatus(p)
+		if status != nil && status.State.Terminated != nil {
+			exitCode = status.State.Terminated.ExitCode
 			return true, nil
 		}
+		if err := waitingError(status); err != nil {
+			return false, err
+		}
+		if p.Status.Phase == v1.PodFailed {
+			return false, errors.New("pod " + name + " failed before the stage finished")
+		}
 		return false, nil
-	})
+	}, ctx.Done())
 	return exitCode, err
 }
 
+// GetPodImageDigest returns the image the stage container ran, by digest.
+func (c *Client) GetPodImageDigest(ctx context.Context, name string) string {
+	p, err := c.k8s.CoreV1().Pods(c.ns).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return ""
+	}
+	status := mainStatus(p)
+	if status == nil {
+		return ""
+	}
+	// The container runtime may prefix the image ID, e.g. docker-pullable://
+	_, digest, found := strings.Cut(status.ImageID, "://")
+	if !found {
+		return status.ImageID
+	}
+	return digest
+}
+
+// stuckReasons are the reasons a container waits for that do not go away
+// without changing the workflow, the registry credentials or the cluster.
+var stuckReasons = []string{"ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CreateContainerConfigError"}
+
+// waitingError returns an error if the container waits for one of the
+// stuckReasons, as it would never start.
+func waitingError(status *v1.ContainerStatus) error {
+	if status == nil || status.State.Waiting == nil || !slices.Contains(stuckReasons, status.State.Waiting.Reason) {
+		return nil
+	}
+	waiting := status.State.Waiting
+	return fmt.Errorf("container %s cannot start: %s: %s", status.Name, waiting.Reason, waiting.Message)
+}
+
+// mainStatus returns the status of the stage container. It is an init
+// container, unless the stage has services.
+func mainStatus(pod *v1.Pod) *v1.ContainerStatus {
+	for _, statuses := range [][]v1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for i := range statuses {
+			if statuses[i].Name == "main" {
+				return &statuses[i]
+			}
+		}
+	}
+	return nil
+}
+
 func (c *Client) GetPodStdOut(ctx context.Context, name string) (string, error) {
 	stdout, err := c.k8s.CoreV1().
 		Pods(c.ns).
@@ -302,6 +447,55 @@ func (c *Client) GetPodStdOut(ctx context.Context, name string) (string, error)
 	return string(stdout), nil
 }
 
+// createPullSecrets returns the image pull secrets for the images of a pod.
+// Registries with a secret reference it, the others are written to a
+// generated secret named after the pod.
+func (c *Client) createPullSecrets(ctx context.Context, podName string, images []string) ([]v1.LocalObjectReference, error) {
+	refs := []v1.LocalObjectReference{}
+	auths := make(map[string]map[string]string)
+	for _, image := range images {
+		r, ok := registry.Find(c.registries, image)
+		if !ok {
+			continue
+		}
+		if r.Secret != "" {
+			if !slices.Contains(refs, v1.LocalObjectReference{Name: r.Secret}) {
+				refs = append(refs, v1.LocalObjectReference{Name: r.Secret})
+			}
+			continue
+		}
+		server := registry.Normalize(r.Server)
+		if server == registry.DockerHub {
+			server = "https://index.docker.io/v1/"
+		}
+		auths[server] = map[string]string{
+			"username": r.Username,
+			"password": r.Password,
+			"auth":     base64.StdEncoding.EncodeToString([]byte(r.Username + ":" + r.Password)),
+		}
+	}
+	if len(auths) == 0 {
+		return refs, nil
+	}
+	data, err := json.Marshal(map[string]interface{}{"auths": auths})
+	if err != nil {
+		return nil, err
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: pullSecretName(podName)},
+		Type:       v1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{v1.DockerConfigJsonKey: data},
+	}
+	if _, err := c.k8s.CoreV1().Secrets(c.ns).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		return nil, err
+	}
+	return append(refs, v1.LocalObjectReference{Name: secret.Name}), nil
+}
+
+func pullSecretName(podName string) string {
+	return podName + "-registry"
+}
+
 func (c *Client) DeletePod(ctx context.Context, name string) error {
 	recover()
 	deletePolicy := metav1.DeletePropagationBackground
@@ -322,7 +516,10 @@ func (c *Client) DeletePod(ctx context.Context, name string) error {
 // 	logger.HandleErr(err)
 // }
 
-func NewClient() (*Client, error) {
+// NewClient returns a Client for the current Kubernetes context. Images are
+// pulled with the credentials of the given registries, falling back to the
+// docker config file.
+func NewClient(registries []internaltypes.Registry) (*Client, error) {
 
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -347,62 +544,36 @@ func NewClient() (*Client, error) {
 	if namespace == "" {
 		namespace = "default"
 	}
-	return &Client{k8s: k8s, ns: namespace, config: *config}, nil
+	return &Client{k8s: k8s, ns: namespace, config: *config, registries: registries}, nil
 }
 
 func toPodName(stage internaltypes.Stage) string {
 	return fmt.Sprint(strings.ReplaceAll(clearString(fmt.Sprint(stage.Stage+"-"+stage.ID)), " ", "-") + "-" + (uuid.New()).String())
 }
 
-// func (cli *Client) KubeEngine(wg *sync.WaitGroup, sID string, ctx context.Context, w internaltypes.Workflow, vol string, claim *v1.PersistentVolumeClaim, allOutputs map[string][]internaltypes.Env, skippedStages *[]string, results chan internaltypes.Result) {
-func (cli *Client) KubeEngine(wg *sync.WaitGroup, sID string, ctx context.Context, w internaltypes.Workflow, allOutputs map[string][]internaltypes.Env, skippedStages *[]string, results chan internaltypes.Result, runid string) {
-	defer wg.Done()
-	idx := slices.IndexFunc(w.Stages, func(c internaltypes.Stage) bool { return c.ID == sID })
-	stage := w.Stages[idx]
-	result := internaltypes.Result{Stage: stage}
-	// volOutput, claimOutput := cli.CreateVolume(ctx, false)
-	// defer cli.RemoveVolume(ctx, volOutput, claimOutput)
-
-	tempW := w
-	tempW.Input = []internaltypes.Input{}
-	hash, err := hashstructure.Hash(tempW, hashstructure.FormatV2, nil)
-	strHash := fmt.Sprint(hash)
-	logger.HandleErr(err)
-
-	allEnvs, needSplit, LwWhite, LwCrossed, LwRed := engine.PrepareStage(w.Env, stage.Env, w.Input, stage.Needs, allOutputs, stage.Stage, stage.ID, &result, runid, strHash)
-
-	if !engine.EvaluateCondition(stage.If, allEnvs, LwWhite) {
-		*skippedStages = append(*skippedStages, stage.ID)
-		result.Skipped = true
-		LwCrossed.Println("Stage Skipped due to IF condition")
-	} else {
-		toSkip := false
-		for _, skipped := range *skippedStages {
-			for _, need := range needSplit {
-				if need == skipped {
-					toSkip = true
-				}
-			}
-		}
-		if toSkip {
-			*skippedStages = append(*skippedStages, stage.ID)
-			result.Skipped = true
-			LwCrossed.Println("Stage Skipped due to needed stage skipped")
-		} else {
-			// if stage.Clean {
-			// 	// volClean, claimClean := cli.CreateVolume(ctx, false)
-			// 	success := cli.RunStageKubernetes(stage, ctx, allEnvs, w.Image, "", nil, LwWhite, &result, allOutputs, LwRed)
-			// 	result.Result = success
-			// 	// defer cli.RemoveVolume(ctx, volClean, claimClean)
-			// } else {
-			// 	success := cli.RunStageKubernetes(stage, ctx, allEnvs, w.Image, vol, claim, LwWhite, &result, allOutputs, LwRed)
-			// 	result.Result = success
-			// }
-			cli.RunStageKubernetes(stage, ctx, allEnvs, w.Image, LwWhite, &result, allOutputs, LwRed, w, runid)
-		}
+func ToV1PullPolicy(policy string) v1.PullPolicy {
+	switch policy {
+	case internaltypes.PullAlways:
+		return v1.PullAlways
+	case internaltypes.PullNever:
+		return v1.PullNever
+	default:
+		return v1.PullIfNotPresent
+	}
+}
 
+func toV1Service(service internaltypes.Service) v1.Container {
+	return v1.Container{
+		Name:            serviceContainer(service),
+		Image:           service.Image,
+		ImagePullPolicy: ToV1PullPolicy(service.Pull),
+		Env:             *ToV1Env(service.Env),
+		Args:            service.Command,
 	}
-	results <- result
+}
+
+func serviceContainer(service internaltypes.Service) string {
+	return "service-" + strings.ToLower(clearString(service.Name))
 }
 
 func ToV1Env(envs []internaltypes.Env) *[]v1.EnvVar {
@@ -442,11 +613,12 @@ func (c *Client) waitPod(ctx context.Context, resName string, LwWhite *logger.My
 		select {
 		case event := <-watcher.ResultChan():
 			pod := event.Object.(*v1.Pod)
+			if err := waitingError(mainStatus(pod)); err != nil {
+				return err
+			}
 			if state == "Running" {
-				if len(pod.Status.InitContainerStatuses) > 0 {
-					if pod.Status.InitContainerStatuses[0].State.Waiting == nil {
-						return nil
-					}
+				if status := mainStatus(pod); status != nil && status.State.Waiting == nil {
+					return nil
 				}
 
 			} else if state == "Terminated" {
@@ -481,8 +653,9 @@ func (c *Client) getPodLogs(ctx context.Context, podName string, LwWhite *logger
 		Container: "main",
 	}
 
-	err := c.waitPod(ctx, podName, LwWhite, "Running")
-	logger.HandleErr(err)
+	if err := c.waitPod(ctx, podName, LwWhite, "Running"); err != nil {
+		return err
+	}
 
 	podLogRequest := c.k8s.CoreV1().
 		Pods(c.ns).
@@ -510,83 +683,270 @@ func (c *Client) getPodLogs(ctx context.Context, podName string, LwWhite *logger
 	return nil
 }
 
-// func (cli *Client) RunStageKubernetes(s internaltypes.Stage, ctx context.Context, envs []internaltypes.Env, globalImage string, volume string, claim *v1.PersistentVolumeClaim, LwWhite *logger.MyLogWriter, result *internaltypes.Result, allOutputs map[string][]internaltypes.Env, LwRed *logger.MyLogWriter) bool {
-func (cli *Client) RunStageKubernetes(s internaltypes.Stage, ctx context.Context, envs []internaltypes.Env, globalImage string, LwWhite *logger.MyLogWriter, result *internaltypes.Result, allOutputs map[string][]internaltypes.Env, LwRed *logger.MyLogWriter, w internaltypes.Workflow, runid string) {
-	LwWhite.Write([]byte(fmt.Sprintf("Running Stage with the following variables: %s\n", engine.GenEnv(envs))))
-	envs = append(envs, []internaltypes.Env{{Name: "OUTPUT", Value: "/output/output"}}...)
-	if s.Image != "" {
-		globalImage = s.Image
-	}
+func (cli *Client) Prepare(ctx context.Context, w internaltypes.Workflow, runid string) error {
+	return nil
+}
+
+// Finish does nothing, services are containers of the stage pods.
+func (cli *Client) Finish(ctx context.Context) {}
+
+func (cli *Client) RunStage(ctx context.Context, s *executor.StageRun) (int, error) {
+	envs := append(s.Env, []internaltypes.Env{{Name: "OUTPUT", Value: "/output/output"}, {Name: "OUTPUT_JSON", Value: "/output/output.json"}}...)
 
-	podName := toPodName(s)
+	podName := toPodName(s.Stage)
+	s.Workspace = podName
+	sources := []string{}
+	if s.Checkout != "" {
+		sources = append(sources, s.Checkout)
+	}
+	if len(s.Stage.Import) > 0 {
+		imports, err := os.MkdirTemp("", "imports")
+		if err != nil {
+			return -1, err
+		}
+		defer os.RemoveAll(imports)
+		if err := engine.LoadImportsIntoStage(ctx, s, imports); err != nil {
+			return -1, err
+		}
+		sources = append(sources, imports)
+	}
 	err, _ := cli.CreatePod(
 		ctx,
 		podName,
-		globalImage,
-		s,
+		s.Image(),
+		s.PullPolicy(s.Image()),
+		s.Resources(),
+		s.Services(),
+		sources,
+		s.Stage,
 		envs,
-		runid,
-		w,
-		LwWhite,
-		// volume,
-		// claim,
+		s.RunID,
+		s.Workflow,
+		s.LwWhite,
 	)
 	if err != nil {
-		logger.Error(err.Error())
+		return -1, err
+	}
+	if services := s.Services(); len(services) > 0 {
+		if err := cli.waitServices(ctx, podName, services, s.LwWhite); err != nil {
+			return -1, err
+		}
 	}
 
-	err = cli.getPodLogs(ctx, podName, LwWhite)
+	err = cli.getPodLogs(ctx, podName, s.LwWhite)
 	if err != nil {
 		logger.Error(err.Error())
 	}
 
-	err = cli.waitPod(ctx, podName, LwWhite, "Terminated")
+	err = cli.waitPod(ctx, podName, s.LwWhite, "Terminated")
 	if err != nil {
 		logger.Error(err.Error())
 	}
 
-	dirArt, err := os.MkdirTemp("", "artifacts")
+	exitCode, err := cli.GetPodExitCode(ctx, podName)
 	if err != nil {
-		logger.Error(err.Error())
+		return -1, err
+	}
+	s.ImageDigest = cli.GetPodImageDigest(ctx, podName)
+	if s.ImageDigest != "" {
+		s.LwWhite.Write([]byte(fmt.Sprintf("Used image %s\n", s.ImageDigest)))
 	}
-	// defer os.RemoveAll(dirArt)
+	return int(exitCode), nil
+}
 
-	// err = cli.waitPod(ctx, podName, LwWhite, v1.PodRunning)
-	// logger.HandleErr(err)
+func (cli *Client) Collect(ctx context.Context, s *executor.StageRun) ([]internaltypes.Env, error) {
+	podName, ok := s.Workspace.(string)
+	if !ok {
+		return []internaltypes.Env{}, nil
+	}
+	dirArt, err := os.MkdirTemp("", "artifacts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dirArt)
 
-	if len(s.Artifacts) > 0 {
-		err = copyFromPod(cli, "/app", dirArt, podName)
+	var artifactsErr error
+	if len(s.Stage.Artifacts) > 0 {
+		// Only extract the files the artifact patterns select, the
+		// workspace may be much larger than the artifacts.
+		err = copyFromPod(cli, "/app", dirArt, podName, artifacts.NewPatterns(s.Stage.Artifacts).Match)
 		if err != nil {
 			logger.Error(err.Error())
 		}
-		engine.ExtractArtifacts(path.Join(dirArt, "app"), s, runid, w)
+		artifactsErr = engine.ExtractArtifacts(ctx, s, path.Join(dirArt, "app"))
 	}
-	err = copyFromPod(cli, "/output", dirArt, podName)
+	err = copyFromPod(cli, "/output", dirArt, podName, nil)
 	if err != nil {
 		logger.Error(err.Error())
 	}
-	outputMap, err := engine.ReadPropertiesFile(path.Join(dirArt, "/output/output"))
-	if err != nil {
-		logger.Error(err.Error())
+	outputs, err := engine.ReadOutputs(path.Join(dirArt, "output"))
+	if artifactsErr != nil {
+		return outputs, artifactsErr
+	}
+	return outputs, err
+}
+
+func (cli *Client) Cleanup(ctx context.Context, s *executor.StageRun) {
+	podName, ok := s.Workspace.(string)
+	if !ok {
+		return
+	}
+	if err := cli.DeletePod(ctx, podName); err != nil {
+		log.Printf("Error deleting pod: %v", err)
+	}
+	err := cli.k8s.CoreV1().Secrets(cli.ns).Delete(ctx, pullSecretName(podName), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Printf("Error deleting image pull secret: %v", err)
 	}
-	allOutputs[s.ID] = outputMap
-	result.Outputs = outputMap
+}
 
-	// err = cli.waitPod(ctx, podName, LwWhite, v1.PodRunning)
-	// logger.HandleErr(err)
+// The stage container of a pod with services waits for gateDir/ready,
+// using the shell copied to gateShell. It runs the stage when the file holds
+// ok, and exits otherwise.
+const (
+	gateDir    = "/opsilon-gate"
+	gateShell  = gateDir + "/busybox"
+	gateScript = `while [ ! -f ` + gateDir + `/ready ]; do ` + gateShell + ` sleep 1; done; ` +
+		`[ "$(` + gateShell + ` cat ` + gateDir + `/ready)" = ok ] || exit 1; exec "$@"`
+)
 
-	exitCode, err := cli.GetPodExitCode(ctx, podName)
+// waitServices waits until the service containers of the pod run and pass
+// their health checks, then lets the stage container start. It fails with
+// the name and the health check output of a service that exited or did not
+// become healthy, and the stage container exits without running.
+func (cli *Client) waitServices(ctx context.Context, podName string, services []internaltypes.Service, LwWhite *logger.MyLogWriter) error {
+	err := cli.checkServices(ctx, podName, services, LwWhite)
+	ready := "ok"
 	if err != nil {
-		logger.Error(err.Error())
+		ready = "failed"
+	}
+	out, signalErr := cli.exec(ctx, podName, "keepalive", []string{"/bin/sh", "-c", "echo " + ready + " > " + gateDir + "/ready"}, 0)
+	if err == nil && signalErr != nil {
+		err = fmt.Errorf("starting the stage after its services: %w: %s", signalErr, out)
 	}
+	return err
+}
 
-	if err := cli.DeletePod(ctx, podName); err != nil {
-		log.Printf("Error deleting pod: %v", err)
+func (cli *Client) checkServices(ctx context.Context, podName string, services []internaltypes.Service, LwWhite *logger.MyLogWriter) error {
+	podCli := cli.k8s.CoreV1().Pods(cli.ns)
+	// The services have to run, and keepalive, which is used to start the
+	// stage.
+	err := wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		p, err := podCli.Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		running := 0
+		for _, status := range p.Status.ContainerStatuses {
+			if err := waitingError(&status); err != nil {
+				return false, err
+			}
+			if t := status.State.Terminated; t != nil && status.Name != "main" {
+				for _, service := range services {
+					if status.Name == serviceContainer(service) {
+						return false, fmt.Errorf("service %s exited with code %d: %s", service.Name, t.ExitCode, t.Message)
+					}
+				}
+			}
+			if status.State.Running != nil && status.Name != "main" {
+				running++
+			}
+		}
+		if p.Status.Phase == v1.PodFailed {
+			return false, errors.New("pod " + podName + " failed before its services started")
+		}
+		return running == len(services)+1, nil
+	}, ctx.Done())
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		if service.HealthCheck == nil {
+			continue
+		}
+		LwWhite.Write([]byte(fmt.Sprintf("Waiting for service %s\n", service.Name)))
+		interval, timeout, retries := service.HealthCheck.Settings()
+		var out string
+		var err error
+		for i := 0; i < retries; i++ {
+			if i > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(interval):
+				}
+			}
+			out, err = cli.exec(ctx, podName, serviceContainer(service), service.HealthCheck.Command, timeout)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("service %s is unhealthy after %d health checks: %v: %s", service.Name, retries, err, strings.TrimSpace(out))
+		}
+	}
+	return nil
+}
+
+// exec runs the command in a container of the pod and returns its output.
+// It fails when the command exits with another code than 0, or does not
+// finish within timeout, if timeout is not 0.
+func (cli *Client) exec(ctx context.Context, podName string, container string, command []string, timeout time.Duration) (string, error) {
+	restconfig := cli.config
+	req := cli.k8s.CoreV1().RESTClient().
+		Post().
+		Namespace(cli.ns).
+		Resource("pods").
+		Name(podName).
+		SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+			TTY:       false,
+		}, scheme.ParameterCodec)
+	exec, err := remotecommand.NewSPDYExecutor(&restconfig, "POST", req.URL())
+	if err != nil {
+		return "", err
+	}
+	out := &lockedBuffer{}
+	done := make(chan error, 1)
+	go func() {
+		done <- exec.Stream(remotecommand.StreamOptions{Stdout: out, Stderr: out, Tty: false})
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case err = <-done:
+	case <-expired:
+		err = fmt.Errorf("timed out after %s", timeout)
+	case <-ctx.Done():
+		err = ctx.Err()
 	}
+	return out.String(), err
+}
+
+// lockedBuffer is a buffer that a command can write to while it is read.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
 
-	result.Result = (exitCode == 0)
-	// logger.Info(fmt.Sprint(exitCode))
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
 }
+
 func getPrefix(file string) string {
 	return strings.TrimLeft(file, "/")
 }
@@ -632,8 +992,7 @@ func copyToPod(cli *Client, srcPath string, destPath string, podName string, ctx
 
 	exec, err := remotecommand.NewSPDYExecutor(&restconfig, "POST", req.URL())
 	if err != nil {
-		log.Fatalf("error %s\n", err)
-		return err
+		return fmt.Errorf("copying %s to pod %s: %w", srcPath, podName, err)
 	}
 	err = exec.Stream(remotecommand.StreamOptions{
 		Stdin:  reader,
@@ -642,13 +1001,15 @@ func copyToPod(cli *Client, srcPath string, destPath string, podName string, ctx
 		Tty:    false,
 	})
 	if err != nil {
-		log.Fatalf("error %s\n", err)
-		return err
+		return fmt.Errorf("copying %s to pod %s: %w", srcPath, podName, err)
 	}
 	return nil
 }
 
-func copyFromPod(cli *Client, srcPath string, destPath string, podName string) error {
+// copyFromPod copies srcPath from the pod into destPath. If keep is not nil,
+// only the files for which it returns true are written, with their path
+// relative to srcPath.
+func copyFromPod(cli *Client, srcPath string, destPath string, podName string, keep func(name string) bool) error {
 	restconfig := cli.config
 	reader, outStream := io.Pipe()
 	//todo some containers failed : tar: Refusing to write archive contents to terminal (missing -f option?) when execute `tar cf -` in container
@@ -684,14 +1045,14 @@ func copyFromPod(cli *Client, srcPath string, destPath string, podName string) e
 	prefix = path.Clean(prefix)
 	prefix = cpStripPathShortcuts(prefix)
 	destPath = path.Join(destPath, path.Base(prefix))
-	err = untarAll(reader, destPath, prefix)
+	err = untarAll(reader, destPath, prefix, keep)
 	return err
 }
 
 //go:linkname cpStripPathShortcuts k8s.io/kubectl/pkg/cmd/cp.stripPathShortcuts
 func cpStripPathShortcuts(p string) string
 
-func untarAll(reader io.Reader, destDir, prefix string) error {
+func untarAll(reader io.Reader, destDir, prefix string, keep func(name string) bool) error {
 	tarReader := tar.NewReader(reader)
 	for {
 		header, err := tarReader.Next()
@@ -707,6 +1068,10 @@ func untarAll(reader io.Reader, destDir, prefix string) error {
 		}
 
 		mode := header.FileInfo().Mode()
+		name := strings.TrimPrefix(header.Name[len(prefix):], "/")
+		if keep != nil && !header.FileInfo().IsDir() && !keep(name) {
+			continue
+		}
 		destFileName := filepath.Join(destDir, header.Name[len(prefix):])
 
 		baseName := filepath.Dir(destFileName)
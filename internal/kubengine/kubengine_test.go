@@ -0,0 +1,151 @@
+package kubengine
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"github.com/jatalocks/opsilon/internal/logger"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWaitingError(t *testing.T) {
+	waiting := func(reason string) *v1.ContainerStatus {
+		return &v1.ContainerStatus{Name: "main", State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: reason, Message: "details"}}}
+	}
+	tests := []struct {
+		name    string
+		status  *v1.ContainerStatus
+		wantErr bool
+	}{
+		{name: "no status", status: nil},
+		{name: "running", status: &v1.ContainerStatus{Name: "main", State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}}},
+		{name: "creating", status: waiting("ContainerCreating")},
+		{name: "pod initializing", status: waiting("PodInitializing")},
+		{name: "image pull back-off", status: waiting("ImagePullBackOff"), wantErr: true},
+		{name: "image pull error", status: waiting("ErrImagePull"), wantErr: true},
+		{name: "invalid image name", status: waiting("InvalidImageName"), wantErr: true},
+		{name: "missing secret or config map", status: waiting("CreateContainerConfigError"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := waitingError(tt.status); (err != nil) != tt.wantErr {
+				t.Errorf("waitingError() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestToV1Resources(t *testing.T) {
+	got, err := ToV1Resources(internaltypes.Resources{
+		Requests: internaltypes.ResourceList{CPU: "250m"},
+		Limits:   internaltypes.ResourceList{CPU: "1", Memory: "512Mi"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := v1.ResourceRequirements{
+		Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("250m")},
+		Limits:   v1.ResourceList{v1.ResourceCPU: resource.MustParse("1"), v1.ResourceMemory: resource.MustParse("512Mi")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ToV1Resources() = %+v, want %+v", got, want)
+	}
+	if got, err := ToV1Resources(internaltypes.Resources{}); err != nil || got.Requests != nil || got.Limits != nil {
+		t.Errorf("ToV1Resources() without resources = %+v, %v, want no requests or limits", got, err)
+	}
+	if _, err := ToV1Resources(internaltypes.Resources{Requests: internaltypes.ResourceList{Memory: "lots"}}); err == nil {
+		t.Error("ToV1Resources() with an invalid quantity succeeded")
+	}
+}
+
+func TestToV1Service(t *testing.T) {
+	got := toV1Service(internaltypes.Service{
+		Name:    "my_db",
+		Image:   "postgres:15",
+		Pull:    internaltypes.PullNever,
+		Env:     []internaltypes.Env{{Name: "POSTGRES_PASSWORD", Value: "secret"}},
+		Command: []string{"postgres", "-c", "fsync=off"},
+	})
+	want := v1.Container{
+		Name:            "service-mydb",
+		Image:           "postgres:15",
+		ImagePullPolicy: v1.PullNever,
+		Env:             []v1.EnvVar{{Name: "POSTGRES_PASSWORD", Value: "secret"}},
+		Args:            []string{"postgres", "-c", "fsync=off"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("toV1Service() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCheckServices(t *testing.T) {
+	services := []internaltypes.Service{{Name: "db", Image: "postgres"}, {Name: "cache", Image: "redis"}}
+	running := func(name string) v1.ContainerStatus {
+		return v1.ContainerStatus{Name: name, State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}}
+	}
+	tests := []struct {
+		name     string
+		statuses []v1.ContainerStatus
+		phase    v1.PodPhase
+		wantErr  string
+	}{
+		{
+			name:     "services and keepalive running",
+			statuses: []v1.ContainerStatus{running("service-db"), running("service-cache"), running("keepalive"), {Name: "main"}},
+			phase:    v1.PodRunning,
+		},
+		{
+			name: "service exited",
+			statuses: []v1.ContainerStatus{running("service-cache"), running("keepalive"), {
+				Name:  "service-db",
+				State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 1, Message: "bad config"}},
+			}},
+			phase:   v1.PodRunning,
+			wantErr: "service db exited with code 1: bad config",
+		},
+		{
+			name: "service image cannot be pulled",
+			statuses: []v1.ContainerStatus{running("service-db"), running("keepalive"), {
+				Name:  "service-cache",
+				State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ErrImagePull", Message: "not found"}},
+			}},
+			phase:   v1.PodPending,
+			wantErr: "container service-cache cannot start: ErrImagePull: not found",
+		},
+		{
+			name:    "pod failed",
+			phase:   v1.PodFailed,
+			wantErr: "failed before its services started",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "stage", Namespace: "default"},
+				Status:     v1.PodStatus{Phase: tt.phase, ContainerStatuses: tt.statuses},
+			}
+			cli := &Client{k8s: fake.NewSimpleClientset(pod), ns: "default"}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			w := logger.NewLogWriter(func(string, color.Attribute) {}, color.FgWhite)
+			err := cli.checkServices(ctx, "stage", services, w)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkServices() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkServices() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -3,9 +3,12 @@ package logger
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/fatih/color"
+	"golang.org/x/exp/slices"
 )
 
 // var LwInfo *MyLogWriter = NewLogWriter(func(str string, color color.Attribute) {
@@ -35,43 +38,131 @@ func HandleErr(err error) {
 }
 
 func Free(text ...string) {
-	fmt.Println(strings.Join(text[:], " "))
+	fmt.Println(maskActive(strings.Join(text[:], " ")))
 }
 
 func Custom(col color.Attribute, text ...string) {
 	c := color.New(col)
-	c.Println(strings.Join(text[:], " "))
+	c.Println(maskActive(strings.Join(text[:], " ")))
 }
 
 func Info(text ...string) {
 	c := color.New(color.FgCyan)
-	c.Println(strings.Join(text[:], " "))
+	c.Println(maskActive(strings.Join(text[:], " ")))
 }
 
 func Operation(text ...string) {
 	c := color.New(color.FgYellow)
-	c.Println(strings.Join(text[:], " "))
+	c.Println(maskActive(strings.Join(text[:], " ")))
 }
 
 func Success(text ...string) {
 	c := color.New(color.FgGreen)
-	c.Println(strings.Join(text[:], " "))
+	c.Println(maskActive(strings.Join(text[:], " ")))
 }
 
 func Error(text ...string) {
 	c := color.New(color.FgRed)
-	c.Println(strings.Join(text[:], " "))
+	c.Println(maskActive(strings.Join(text[:], " ")))
 }
 
 func Fatal(text error) {
 	c := color.New(color.FgRed)
-	c.Println(text)
+	c.Println(maskActive(fmt.Sprint(text)))
 }
 
 type MyLogWriter struct {
 	logFunc func(string, color.Attribute)
 	line    string
 	color   color.Attribute
+	masker  *Masker
+}
+
+// MinMaskLength is the length under which secret values are not masked,
+// as masking them would hide unrelated text.
+const MinMaskLength = 4
+
+// Masker replaces the secret values of a run by ***.
+type Masker struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+func NewMasker() *Masker {
+	return &Masker{}
+}
+
+// Add registers secret values. Every line of a multi-line value is masked
+// on its own, since lines are written one by one. Lines shorter than
+// MinMaskLength are ignored.
+func (m *Masker) Add(values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, v := range values {
+		for _, line := range strings.Split(v, "\n") {
+			line = strings.TrimSuffix(line, "\r")
+			if len(line) >= MinMaskLength && !slices.Contains(m.values, line) {
+				m.values = append(m.values, line)
+			}
+		}
+	}
+	// Longer values first, so that a value containing another is fully masked.
+	sort.Slice(m.values, func(i, j int) bool { return len(m.values[i]) > len(m.values[j]) })
+}
+
+// Values returns the registered secret values.
+func (m *Masker) Values() []string {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return slices.Clone(m.values)
+}
+
+// Mask replaces the registered secret values in s by ***. A nil Masker
+// masks nothing.
+func (m *Masker) Mask(s string) string {
+	if m == nil {
+		return s
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, v := range m.values {
+		s = strings.ReplaceAll(s, v, "***")
+	}
+	return s
+}
+
+var (
+	activeMu sync.Mutex
+	active   []*Masker
+)
+
+// Activate makes the functions of this package, such as Info and Error,
+// mask the values of m until the returned function is called at the end of
+// the run.
+func (m *Masker) Activate() func() {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	active = append(active, m)
+	return func() {
+		activeMu.Lock()
+		defer activeMu.Unlock()
+		if i := slices.Index(active, m); i != -1 {
+			active = slices.Delete(active, i, i+1)
+		}
+	}
+}
+
+// maskActive masks the values of the runs in progress.
+func maskActive(s string) string {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	for _, m := range active {
+		s = m.Mask(s)
+	}
+	return s
 }
 
 func (w *MyLogWriter) Write(b []byte) (int, error) {
@@ -82,7 +173,7 @@ func (w *MyLogWriter) Write(b []byte) (int, error) {
 			w.line += string(b)
 			break
 		} else {
-			w.logFunc(w.line+string(b[:i]), w.color)
+			w.logFunc(w.masker.Mask(w.line+string(b[:i])), w.color)
 			b = b[i+1:]
 			w.line = ""
 		}
@@ -97,3 +188,13 @@ func NewLogWriter(f func(string, color.Attribute), col color.Attribute) *MyLogWr
 		color:   col,
 	}
 }
+
+// NewMaskedLogWriter returns a MyLogWriter that masks the values of m in
+// every line before passing it to f.
+func NewMaskedLogWriter(f func(string, color.Attribute), col color.Attribute, m *Masker) *MyLogWriter {
+	return &MyLogWriter{
+		logFunc: f,
+		color:   col,
+		masker:  m,
+	}
+}
@@ -0,0 +1,78 @@
+package logger
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+func TestMasker(t *testing.T) {
+	m := NewMasker()
+	m.Add("abc", "password", "pass", "line one\nxy\r\nline two\r", "password")
+	// Values of the same length are in no particular order.
+	values := []string{"line one", "line two", "pass", "password"}
+	got := m.Values()
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, values) {
+		t.Errorf("Values() = %q, want %q", got, values)
+	}
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "nothing secret", want: "nothing secret"},
+		{in: "abc and xy are too short to be masked", want: "abc and xy are too short to be masked"},
+		{in: "password=password", want: "***=***"},
+		{in: "passport pass", want: "***port ***"},
+		{in: "line one, line two", want: "***, ***"},
+	}
+	for _, tt := range tests {
+		if got := m.Mask(tt.in); got != tt.want {
+			t.Errorf("Mask(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	var none *Masker
+	if got := none.Mask("password"); got != "password" {
+		t.Errorf("nil Masker Mask() = %q, want the text unchanged", got)
+	}
+	if got := none.Values(); got != nil {
+		t.Errorf("nil Masker Values() = %q, want nil", got)
+	}
+}
+
+func TestActivate(t *testing.T) {
+	run1, run2 := NewMasker(), NewMasker()
+	run1.Add("secret-one")
+	run2.Add("secret-two")
+	deactivate1 := run1.Activate()
+	deactivate2 := run2.Activate()
+	if got, want := maskActive("secret-one secret-two"), "*** ***"; got != want {
+		t.Errorf("maskActive() = %q, want %q", got, want)
+	}
+	deactivate1()
+	if got, want := maskActive("secret-one secret-two"), "secret-one ***"; got != want {
+		t.Errorf("maskActive() after the first run = %q, want %q", got, want)
+	}
+	deactivate2()
+	if got, want := maskActive("secret-one secret-two"), "secret-one secret-two"; got != want {
+		t.Errorf("maskActive() after both runs = %q, want %q", got, want)
+	}
+}
+
+func TestMaskedLogWriter(t *testing.T) {
+	m := NewMasker()
+	m.Add("hunter2")
+	lines := []string{}
+	w := NewMaskedLogWriter(func(str string, col color.Attribute) {
+		lines = append(lines, str)
+	}, color.FgWhite, m)
+	w.Write([]byte("password: hun"))
+	w.Write([]byte("ter2\nsecond line\nunfinished"))
+	want := []string{"password: ***", "second line"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+}
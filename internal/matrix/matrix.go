@@ -0,0 +1,198 @@
+package matrix
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"golang.org/x/exp/slices"
+)
+
+var invalidIDChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// IDError is the error of Expand when an instance of a matrix stage gets the
+// ID of another stage, or of another instance.
+type IDError struct {
+	ID    string
+	Stage string // The matrix stage of the instance.
+	// Other is the stage with the ID, or the matrix stage of the other
+	// instance with the ID when OtherIsInstance is set.
+	Other           string
+	OtherIsInstance bool
+}
+
+func (e *IDError) Error() string {
+	switch {
+	case e.OtherIsInstance && e.Other == e.Stage:
+		return fmt.Sprintf("matrix stage %s has two instances with the ID %s, their values only differ in characters IDs cannot hold", e.Stage, e.ID)
+	case e.OtherIsInstance:
+		return fmt.Sprintf("instances of matrix stages %s and %s have the same ID %s", e.Other, e.Stage, e.ID)
+	}
+	return fmt.Sprintf("instance %s of matrix stage %s has the ID of stage %s", e.ID, e.Stage, e.Other)
+}
+
+// Expand replaces every matrix stage of the workflow with one stage per
+// combination of its matrix values. Instances get the ID
+// <stage id>-<value>-<value>..., the matrix values as environment variables
+// and MatrixOf set to the original stage ID. Stages that need a matrix stage
+// keep needing it by its original ID, imports from a matrix stage are
+// expanded to import from every instance.
+// Matrix values of the form $name are read from the input with that name,
+// split on commas, so inputs must be set on the workflow before expanding.
+// An instance that gets the ID of another stage or instance is an *IDError.
+func Expand(w internaltypes.Workflow) (internaltypes.Workflow, error) {
+	stages := []internaltypes.Stage{}
+	instances := make(map[string][]string)
+	for _, s := range w.Stages {
+		if len(s.Matrix) == 0 {
+			stages = append(stages, s)
+			continue
+		}
+		axes := make([]string, 0, len(s.Matrix))
+		for axis := range s.Matrix {
+			axes = append(axes, axis)
+		}
+		sort.Strings(axes)
+		values := make([][]string, len(axes))
+		for i, axis := range axes {
+			v, err := resolve(s.Matrix[axis], w.Input)
+			if err != nil {
+				return w, fmt.Errorf("matrix %s of stage %s: %w", axis, s.ID, err)
+			}
+			if len(v) == 0 {
+				return w, fmt.Errorf("matrix %s of stage %s has no values", axis, s.ID)
+			}
+			values[i] = v
+		}
+		for _, combination := range combinations(values) {
+			instance := s
+			instance.Matrix = nil
+			instance.MatrixOf = s.ID
+			instance.Env = append([]internaltypes.Env{}, s.Env...)
+			labels := make([]string, len(axes))
+			for i, axis := range axes {
+				instance.Env = append(instance.Env, internaltypes.Env{Name: axis, Value: combination[i]})
+				labels[i] = axis + "=" + combination[i]
+			}
+			instance.ID = s.ID + "-" + invalidIDChars.ReplaceAllString(strings.Join(combination, "-"), "-")
+			instance.Stage = fmt.Sprintf("%s (%s)", s.Stage, strings.Join(labels, ", "))
+			stages = append(stages, instance)
+			instances[s.ID] = append(instances[s.ID], instance.ID)
+		}
+	}
+	if err := checkIDs(stages); err != nil {
+		return w, err
+	}
+	for i := range stages {
+		imports := []internaltypes.Import{}
+		for _, imp := range stages[i].Import {
+			ids, ok := instances[imp.From]
+			if !ok {
+				imports = append(imports, imp)
+				continue
+			}
+			for _, id := range ids {
+				imports = append(imports, internaltypes.Import{From: id, Artifacts: imp.Artifacts})
+			}
+		}
+		stages[i].Import = imports
+	}
+	w.Stages = stages
+	return w, nil
+}
+
+// checkIDs returns an *IDError when an instance has the ID of another stage
+// or instance. Stages that are not instances are left to validation.
+func checkIDs(stages []internaltypes.Stage) error {
+	byID := make(map[string]internaltypes.Stage, len(stages))
+	for _, s := range stages {
+		other, ok := byID[s.ID]
+		if !ok {
+			byID[s.ID] = s
+			continue
+		}
+		switch {
+		case s.MatrixOf != "" && other.MatrixOf != "":
+			return &IDError{ID: s.ID, Stage: s.MatrixOf, Other: other.MatrixOf, OtherIsInstance: true}
+		case s.MatrixOf != "":
+			return &IDError{ID: s.ID, Stage: s.MatrixOf, Other: other.ID}
+		case other.MatrixOf != "":
+			return &IDError{ID: s.ID, Stage: other.MatrixOf, Other: s.ID}
+		}
+	}
+	return nil
+}
+
+// Instances returns the IDs of the stages that were expanded from the given
+// matrix stage, in the order they were expanded.
+func Instances(w internaltypes.Workflow, id string) []string {
+	ids := []string{}
+	if id == "" {
+		return ids
+	}
+	for _, s := range w.Stages {
+		if s.MatrixOf == id {
+			ids = append(ids, s.ID)
+		}
+	}
+	return ids
+}
+
+// Aggregate merges the outputs of matrix instances into the outputs of the
+// matrix stage. Every output becomes a comma separated list of the values
+// the instances produced, in instance order.
+func Aggregate(outputs [][]internaltypes.Env) []internaltypes.Env {
+	names := []string{}
+	values := make(map[string][]string)
+	for _, instance := range outputs {
+		for _, env := range instance {
+			if _, ok := values[env.Name]; !ok {
+				names = append(names, env.Name)
+			}
+			values[env.Name] = append(values[env.Name], env.Value)
+		}
+	}
+	aggregated := []internaltypes.Env{}
+	for _, name := range names {
+		aggregated = append(aggregated, internaltypes.Env{Name: name, Value: strings.Join(values[name], ",")})
+	}
+	return aggregated
+}
+
+func resolve(values internaltypes.MatrixValues, inputs []internaltypes.Input) ([]string, error) {
+	resolved := []string{}
+	for _, v := range values {
+		if !strings.HasPrefix(v, "$") {
+			resolved = append(resolved, v)
+			continue
+		}
+		name := strings.TrimPrefix(v, "$")
+		idx := slices.IndexFunc(inputs, func(i internaltypes.Input) bool { return i.Name == name })
+		if idx == -1 {
+			return nil, fmt.Errorf("%s does not reference an input", v)
+		}
+		for _, part := range strings.Split(inputs[idx].Default, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				resolved = append(resolved, part)
+			}
+		}
+	}
+	return resolved, nil
+}
+
+func combinations(values [][]string) [][]string {
+	result := [][]string{{}}
+	for _, axis := range values {
+		next := [][]string{}
+		for _, prefix := range result {
+			for _, v := range axis {
+				combination := append(append([]string{}, prefix...), v)
+				next = append(next, combination)
+			}
+		}
+		result = next
+	}
+	return result
+}
@@ -0,0 +1,244 @@
+package matrix
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+)
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		name    string
+		w       internaltypes.Workflow
+		ids     []string
+		imports []internaltypes.Import // Imports of the last stage.
+		wantErr bool
+	}{
+		{
+			name: "stages without matrix are kept",
+			w:    internaltypes.Workflow{Stages: []internaltypes.Stage{{ID: "a"}, {ID: "b"}}},
+			ids:  []string{"a", "b"},
+		},
+		{
+			name: "one instance per combination, axes sorted",
+			w: internaltypes.Workflow{Stages: []internaltypes.Stage{{
+				ID:     "build",
+				Matrix: map[string]internaltypes.MatrixValues{"os": {"linux", "darwin"}, "arch": {"amd64", "arm64"}},
+			}}},
+			ids: []string{"build-amd64-linux", "build-amd64-darwin", "build-arm64-linux", "build-arm64-darwin"},
+		},
+		{
+			name: "values are sanitised for IDs",
+			w: internaltypes.Workflow{Stages: []internaltypes.Stage{{
+				ID:     "test",
+				Matrix: map[string]internaltypes.MatrixValues{"image": {"golang:1.19", "node 18/alpine"}},
+			}}},
+			ids: []string{"test-golang-1.19", "test-node-18-alpine"},
+		},
+		{
+			name: "values are read from inputs",
+			w: internaltypes.Workflow{
+				Input:  []internaltypes.Input{{Name: "versions", Default: "1, 2,,3"}},
+				Stages: []internaltypes.Stage{{ID: "v", Matrix: map[string]internaltypes.MatrixValues{"version": {"$versions"}}}},
+			},
+			ids: []string{"v-1", "v-2", "v-3"},
+		},
+		{
+			name: "imports from a matrix stage import from every instance",
+			w: internaltypes.Workflow{Stages: []internaltypes.Stage{
+				{ID: "build", Matrix: map[string]internaltypes.MatrixValues{"os": {"linux", "darwin"}}},
+				{ID: "release", Needs: "build", Import: []internaltypes.Import{{From: "build", Artifacts: []string{"bin/*"}}}},
+			}},
+			ids: []string{"build-linux", "build-darwin", "release"},
+			imports: []internaltypes.Import{
+				{From: "build-linux", Artifacts: []string{"bin/*"}},
+				{From: "build-darwin", Artifacts: []string{"bin/*"}},
+			},
+		},
+		{
+			name: "unknown input",
+			w: internaltypes.Workflow{Stages: []internaltypes.Stage{{
+				ID:     "v",
+				Matrix: map[string]internaltypes.MatrixValues{"version": {"$missing"}},
+			}}},
+			wantErr: true,
+		},
+		{
+			name: "input without values",
+			w: internaltypes.Workflow{
+				Input:  []internaltypes.Input{{Name: "versions", Optional: true}},
+				Stages: []internaltypes.Stage{{ID: "v", Matrix: map[string]internaltypes.MatrixValues{"version": {"$versions"}}}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Expand(tt.w)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			ids := []string{}
+			for _, s := range got.Stages {
+				ids = append(ids, s.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.ids) {
+				t.Errorf("Expand() IDs = %v, want %v", ids, tt.ids)
+			}
+			if tt.imports != nil {
+				last := got.Stages[len(got.Stages)-1]
+				if !reflect.DeepEqual(last.Import, tt.imports) {
+					t.Errorf("Expand() imports = %v, want %v", last.Import, tt.imports)
+				}
+			}
+		})
+	}
+}
+
+func TestExpandInstance(t *testing.T) {
+	w := internaltypes.Workflow{Stages: []internaltypes.Stage{{
+		ID:     "build",
+		Stage:  "Build",
+		Env:    []internaltypes.Env{{Name: "CGO_ENABLED", Value: "0"}},
+		Matrix: map[string]internaltypes.MatrixValues{"os": {"linux"}, "arch": {"arm64"}},
+	}}}
+	got, err := Expand(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance := got.Stages[0]
+	if instance.MatrixOf != "build" || instance.Matrix != nil {
+		t.Errorf("MatrixOf = %q, Matrix = %v, want build and nil", instance.MatrixOf, instance.Matrix)
+	}
+	if want := "Build (arch=arm64, os=linux)"; instance.Stage != want {
+		t.Errorf("Stage = %q, want %q", instance.Stage, want)
+	}
+	env := []internaltypes.Env{{Name: "CGO_ENABLED", Value: "0"}, {Name: "arch", Value: "arm64"}, {Name: "os", Value: "linux"}}
+	if !reflect.DeepEqual(instance.Env, env) {
+		t.Errorf("Env = %v, want %v", instance.Env, env)
+	}
+	if len(w.Stages[0].Env) != 1 {
+		t.Errorf("Expand() changed the env of the matrix stage: %v", w.Stages[0].Env)
+	}
+}
+
+func TestExpandIDCollisions(t *testing.T) {
+	tests := []struct {
+		name   string
+		stages []internaltypes.Stage
+		want   *IDError
+	}{
+		{
+			name: "instance with the ID of a stage after it",
+			stages: []internaltypes.Stage{
+				{ID: "build", Matrix: map[string]internaltypes.MatrixValues{"os": {"linux"}}},
+				{ID: "build-linux"},
+			},
+			want: &IDError{ID: "build-linux", Stage: "build", Other: "build-linux"},
+		},
+		{
+			name: "instance with the ID of a stage before it",
+			stages: []internaltypes.Stage{
+				{ID: "build-linux"},
+				{ID: "build", Matrix: map[string]internaltypes.MatrixValues{"os": {"linux"}}},
+			},
+			want: &IDError{ID: "build-linux", Stage: "build", Other: "build-linux"},
+		},
+		{
+			name: "instances of the same stage",
+			stages: []internaltypes.Stage{
+				{ID: "test", Matrix: map[string]internaltypes.MatrixValues{"image": {"node:18", "node/18"}}},
+			},
+			want: &IDError{ID: "test-node-18", Stage: "test", Other: "test", OtherIsInstance: true},
+		},
+		{
+			name: "instances of different stages",
+			stages: []internaltypes.Stage{
+				{ID: "a", Matrix: map[string]internaltypes.MatrixValues{"v": {"b-c"}}},
+				{ID: "a-b", Matrix: map[string]internaltypes.MatrixValues{"v": {"c"}}},
+			},
+			want: &IDError{ID: "a-b-c", Stage: "a-b", Other: "a", OtherIsInstance: true},
+		},
+		{
+			name: "stages that are not instances are left to validation",
+			stages: []internaltypes.Stage{
+				{ID: "a"},
+				{ID: "a"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Expand(internaltypes.Workflow{Stages: tt.stages})
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("Expand() error = %v, want nil", err)
+				}
+				return
+			}
+			var idErr *IDError
+			if !errors.As(err, &idErr) {
+				t.Fatalf("Expand() error = %v, want an *IDError", err)
+			}
+			if *idErr != *tt.want {
+				t.Errorf("Expand() error = %+v, want %+v", *idErr, *tt.want)
+			}
+		})
+	}
+}
+
+func TestInstances(t *testing.T) {
+	w := internaltypes.Workflow{Stages: []internaltypes.Stage{
+		{ID: "build-linux", MatrixOf: "build"},
+		{ID: "other"},
+		{ID: "build-darwin", MatrixOf: "build"},
+	}}
+	tests := []struct {
+		id   string
+		want []string
+	}{
+		{id: "build", want: []string{"build-linux", "build-darwin"}},
+		{id: "other", want: []string{}},
+		{id: "", want: []string{}},
+	}
+	for _, tt := range tests {
+		if got := Instances(w, tt.id); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Instances(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		name    string
+		outputs [][]internaltypes.Env
+		want    []internaltypes.Env
+	}{
+		{
+			name:    "no outputs",
+			outputs: nil,
+			want:    []internaltypes.Env{},
+		},
+		{
+			name: "values in instance order",
+			outputs: [][]internaltypes.Env{
+				{{Name: "tag", Value: "a"}, {Name: "size", Value: "1"}},
+				{{Name: "tag", Value: "b"}},
+				{{Name: "size", Value: "3"}, {Name: "tag", Value: "c"}},
+			},
+			want: []internaltypes.Env{{Name: "tag", Value: "a,b,c"}, {Name: "size", Value: "1,3"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Aggregate(tt.outputs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Aggregate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package plan
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jatalocks/opsilon/internal/condition"
+	"github.com/jatalocks/opsilon/internal/config"
+	"github.com/jatalocks/opsilon/internal/engine"
+	"github.com/jatalocks/opsilon/internal/executor"
+	"github.com/jatalocks/opsilon/internal/graph"
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"github.com/jatalocks/opsilon/internal/interpolate"
+	"github.com/jatalocks/opsilon/internal/matrix"
+	"golang.org/x/exp/slices"
+)
+
+// masked replaces the values of secrets and secret inputs in a plan.
+const masked = "***"
+
+// Whether a stage will run, as far as it is known before the run.
+const (
+	ConditionRun     = "run"
+	ConditionSkip    = "skip"
+	ConditionFail    = "fail"
+	ConditionUnknown = "unknown" // Decided when the stage starts.
+)
+
+// Image is an image a run uses, with its pull policy.
+type Image struct {
+	Image string `json:"image"`
+	Pull  string `json:"pull"`
+}
+
+func (i Image) String() string {
+	return fmt.Sprintf("%s (pull: %s)", i.Image, i.Pull)
+}
+
+// Stage is what a stage of the run will do.
+type Stage struct {
+	ID    string   `json:"id"`
+	Stage string   `json:"stage"`
+	Needs []string `json:"needs,omitempty"`
+	// Image is unset for stages that use a workflow.
+	Image    *Image            `json:"image,omitempty"`
+	Services []Image           `json:"services,omitempty"`
+	Uses     string            `json:"uses,omitempty"`
+	With     map[string]string `json:"with,omitempty"`
+	// Env are the variables the stage receives, before the outputs of the
+	// stages it needs are added. References to outputs are left as written.
+	Env []internaltypes.Env `json:"env"`
+	If  string              `json:"if,omitempty"`
+	// Condition is whether the stage will run, from its if condition and
+	// the stages it needs: run, skip, fail, or unknown when it reads the
+	// stages it needs or secrets. Reason says why.
+	Condition string                 `json:"condition"`
+	Reason    string                 `json:"reason,omitempty"`
+	Import    []internaltypes.Import `json:"import,omitempty"`
+	Artifacts []string               `json:"artifacts,omitempty"`
+}
+
+// Plan is what a run of a workflow will do, worked out without running
+// anything.
+type Plan struct {
+	Workflow string `json:"workflow"`
+	// Images are the images of all the stages and services, in the order
+	// they are first used.
+	Images []Image    `json:"images"`
+	Layers [][]string `json:"layers"`
+	Stages []Stage    `json:"stages"`
+	// Problems will make the run fail before it starts a stage.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// New returns the plan of a run of the workflow, whose inputs are set.
+// Secrets are not read, their values and the values of secret inputs are
+// masked.
+func New(w internaltypes.Workflow) Plan {
+	p := Plan{Workflow: w.Repo + "/" + w.ID, Images: []Image{}, Stages: []Stage{}}
+	expanded, err := matrix.Expand(w)
+	if err != nil {
+		p.Problems = append(p.Problems, err.Error())
+		expanded = w
+	}
+	w = expanded
+	p.Layers = graph.Layers(w)
+
+	secretNames := []string{}
+	secretEnv := []internaltypes.Env{}
+	definitions := config.Secrets(w.Repo)
+	for _, name := range w.Secrets {
+		if slices.IndexFunc(definitions, func(s internaltypes.Secret) bool { return s.Name == name }) == -1 {
+			p.Problems = append(p.Problems, fmt.Sprintf("secret %s is not defined in the config", name))
+		}
+		secretNames = append(secretNames, name)
+		secretEnv = append(secretEnv, internaltypes.Env{Name: name, Value: masked})
+	}
+	inputs := make([]internaltypes.Input, len(w.Input))
+	for i, in := range w.Input {
+		if in.Secret {
+			in.Default = masked
+			secretNames = append(secretNames, in.Name)
+		}
+		inputs[i] = in
+	}
+	w.Input = inputs
+
+	addImage := func(i Image) {
+		if !slices.Contains(p.Images, i) {
+			p.Images = append(p.Images, i)
+		}
+	}
+	decided := make(map[string]string)
+	for _, layer := range p.Layers {
+		for _, id := range layer {
+			s := w.Stages[slices.IndexFunc(w.Stages, func(s internaltypes.Stage) bool { return s.ID == id })]
+			// Outputs are unknown, so references to them are left as they
+			// are written.
+			resolvedW, resolved, _ := interpolate.Resolve(w, s, map[string][]internaltypes.Env{})
+			env := engine.MergeEnv(engine.MergeEnv(w.Env, secretEnv), resolved.Env, engine.GenEnvFromArgs(w.Input))
+			stage := Stage{ID: s.ID, Stage: s.Stage, Needs: graph.Needs(w, s), Env: env, If: s.If, Import: resolved.Import, Artifacts: resolved.Artifacts}
+			if s.Uses != "" {
+				stage.Uses = s.Uses
+				stage.With = resolved.With
+			} else {
+				run := executor.StageRun{Stage: resolved, Workflow: resolvedW}
+				stage.Image = &Image{Image: run.Image(), Pull: run.PullPolicy(run.Image())}
+				addImage(*stage.Image)
+				for _, service := range run.Services() {
+					stage.Services = append(stage.Services, Image{Image: service.Image, Pull: service.Pull})
+					addImage(Image{Image: service.Image, Pull: service.Pull})
+				}
+			}
+			stage.Condition, stage.Reason = decide(s, env, secretNames)
+			// Like when running, a stage is skipped after a needed stage was
+			// skipped or failed, unless its condition handles it.
+			for _, need := range stage.Needs {
+				if decided[need] != ConditionSkip && decided[need] != ConditionFail {
+					continue
+				}
+				if !condition.HandlesFailure(s.If) {
+					stage.Condition, stage.Reason = ConditionSkip, fmt.Sprintf("needed stage %s will %s", need, decided[need])
+				}
+			}
+			decided[s.ID] = stage.Condition
+			p.Stages = append(p.Stages, stage)
+		}
+	}
+	return p
+}
+
+// decide evaluates the if condition of a stage when it does not depend on
+// the stages it needs or on secrets.
+func decide(s internaltypes.Stage, env []internaltypes.Env, secretNames []string) (string, string) {
+	if s.If == "" {
+		return ConditionRun, ""
+	}
+	known := []internaltypes.Env{}
+	for _, e := range env {
+		if !slices.Contains(secretNames, e.Name) {
+			known = append(known, e)
+		}
+	}
+	if !condition.Static(s.If, known) {
+		if condition.Static(s.If, env) {
+			return ConditionUnknown, "reads secrets"
+		}
+		if s.Needs != "" {
+			return ConditionUnknown, "depends on the stages it needs"
+		}
+	}
+	ok, err := condition.Evaluate(s.If, condition.Context{Values: known})
+	switch {
+	case err != nil:
+		return ConditionFail, err.Error()
+	case !ok:
+		return ConditionSkip, ""
+	}
+	return ConditionRun, ""
+}
+
+// String describes the plan for the console.
+func (p Plan) String() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Plan of %s\n", p.Workflow)
+	for _, problem := range p.Problems {
+		fmt.Fprintf(b, "Problem: %s\n", problem)
+	}
+	fmt.Fprintln(b, "Images:")
+	for _, i := range p.Images {
+		fmt.Fprintf(b, "  %s\n", i)
+	}
+	for n, layer := range p.Layers {
+		fmt.Fprintf(b, "Layer %d, in parallel: %s\n", n+1, strings.Join(layer, ", "))
+		for _, s := range p.Stages {
+			if !slices.Contains(layer, s.ID) {
+				continue
+			}
+			fmt.Fprintf(b, "  %s (%s)\n", s.ID, s.Stage)
+			if len(s.Needs) > 0 {
+				fmt.Fprintf(b, "    needs: %s\n", strings.Join(s.Needs, ", "))
+			}
+			if s.Uses != "" {
+				fmt.Fprintf(b, "    uses: %s\n", s.Uses)
+				for _, name := range sortedKeys(s.With) {
+					fmt.Fprintf(b, "      %s=%s\n", name, s.With[name])
+				}
+			} else {
+				fmt.Fprintf(b, "    image: %s\n", s.Image)
+			}
+			for _, service := range s.Services {
+				fmt.Fprintf(b, "    service: %s\n", service)
+			}
+			if s.If != "" {
+				decision := s.Condition
+				if s.Reason != "" {
+					decision += ", " + s.Reason
+				}
+				fmt.Fprintf(b, "    if: %s -> %s\n", s.If, decision)
+			} else if s.Condition != ConditionRun {
+				fmt.Fprintf(b, "    %s, %s\n", s.Condition, s.Reason)
+			}
+			if len(s.Env) == 0 {
+				fmt.Fprintln(b, "    env: none")
+			} else {
+				fmt.Fprintln(b, "    env:")
+			}
+			for _, e := range s.Env {
+				fmt.Fprintf(b, "      %s=%s\n", e.Name, e.Value)
+			}
+			for _, i := range s.Import {
+				fmt.Fprintf(b, "    import from %s: %s\n", i.From, strings.Join(i.Artifacts, " "))
+			}
+			if len(s.Artifacts) > 0 {
+				fmt.Fprintf(b, "    artifacts: %s\n", strings.Join(s.Artifacts, " "))
+			}
+		}
+	}
+	return b.String()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,98 @@
+package plan
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"github.com/spf13/viper"
+)
+
+func TestDecide(t *testing.T) {
+	env := []internaltypes.Env{{Name: "target", Value: "prod"}, {Name: "token", Value: masked}}
+	secrets := []string{"token"}
+	tests := []struct {
+		name      string
+		stage     internaltypes.Stage
+		condition string
+		reason    string
+	}{
+		{name: "no condition", stage: internaltypes.Stage{}, condition: ConditionRun},
+		{name: "true", stage: internaltypes.Stage{If: `$target == "prod"`}, condition: ConditionRun},
+		{name: "false", stage: internaltypes.Stage{If: `$target == "dev"`}, condition: ConditionSkip},
+		{name: "reads secrets", stage: internaltypes.Stage{If: `$token != ""`}, condition: ConditionUnknown, reason: "reads secrets"},
+		{name: "reads outputs", stage: internaltypes.Stage{If: `$tag != ""`, Needs: "build"}, condition: ConditionUnknown, reason: "depends on the stages it needs"},
+		{name: "reads status", stage: internaltypes.Stage{If: `success()`, Needs: "build"}, condition: ConditionUnknown, reason: "depends on the stages it needs"},
+		{name: "unknown variable without needs", stage: internaltypes.Stage{If: `$tag != ""`}, condition: ConditionFail, reason: `condition $tag != "" uses undefined variables $tag`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition, reason := decide(tt.stage, env, secrets)
+			if condition != tt.condition || reason != tt.reason {
+				t.Errorf("decide() = %s, %q, want %s, %q", condition, reason, tt.condition, tt.reason)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	viper.Set("secrets", []map[string]string{{"name": "token", "env": "OPSILON_TEST_TOKEN"}})
+	t.Cleanup(viper.Reset)
+	w := internaltypes.Workflow{
+		Repo:    "repo",
+		ID:      "deploy",
+		Image:   "alpine",
+		Env:     []internaltypes.Env{{Name: "target", Value: "prod"}},
+		Secrets: []string{"token", "undefined"},
+		Input:   []internaltypes.Input{{Name: "password", Default: "hunter2", Secret: true}, {Name: "region", Default: "eu"}},
+		Stages: []internaltypes.Stage{
+			{ID: "build", Stage: "Build", Image: "golang:1.19", Script: []string{"make"}, Services: []internaltypes.Service{{Name: "db", Image: "postgres"}}},
+			{ID: "dev", Stage: "Dev", If: `$target == "dev"`, Script: []string{"deploy"}},
+			{ID: "after-dev", Stage: "After dev", Needs: "dev", Script: []string{"notify"}},
+			{ID: "cleanup", Stage: "Cleanup", Needs: "dev", If: `always()`, Script: []string{"clean"}},
+			{ID: "prod", Stage: "Prod", Needs: "build", If: `$token != ""`, Uses: "repo/release", With: map[string]string{"region": "${{ inputs.region }}", "password": "${{ inputs.password }}"}},
+		},
+	}
+	p := New(w)
+
+	if want := []string{"secret undefined is not defined in the config"}; !reflect.DeepEqual(p.Problems, want) {
+		t.Errorf("Problems = %q, want %q", p.Problems, want)
+	}
+	images := []Image{
+		{Image: "golang:1.19", Pull: internaltypes.PullIfNotPresent},
+		{Image: "postgres", Pull: internaltypes.PullAlways},
+		{Image: "alpine", Pull: internaltypes.PullAlways},
+	}
+	if !reflect.DeepEqual(p.Images, images) {
+		t.Errorf("Images = %v, want %v", p.Images, images)
+	}
+	stages := make(map[string]Stage)
+	for _, s := range p.Stages {
+		stages[s.ID] = s
+	}
+	env := []internaltypes.Env{
+		{Name: "target", Value: "prod"},
+		{Name: "token", Value: masked},
+		{Name: "undefined", Value: masked},
+		{Name: "password", Value: masked},
+		{Name: "region", Value: "eu"},
+	}
+	if got := stages["build"].Env; !reflect.DeepEqual(got, env) {
+		t.Errorf("env = %v, want %v", got, env)
+	}
+	decisions := map[string][2]string{
+		"build":     {ConditionRun, ""},
+		"dev":       {ConditionSkip, ""},
+		"after-dev": {ConditionSkip, "needed stage dev will skip"},
+		"cleanup":   {ConditionRun, ""},
+		"prod":      {ConditionUnknown, "reads secrets"},
+	}
+	for id, want := range decisions {
+		if got := [2]string{stages[id].Condition, stages[id].Reason}; got != want {
+			t.Errorf("stage %s = %q, want %q", id, got, want)
+		}
+	}
+	if want := map[string]string{"region": "eu", "password": masked}; !reflect.DeepEqual(stages["prod"].With, want) || stages["prod"].Image != nil {
+		t.Errorf("stage prod with = %v, image = %v, want %v and no image", stages["prod"].With, stages["prod"].Image, want)
+	}
+}
@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+)
+
+// DockerHub is the server of images without a registry in their name.
+const DockerHub = "docker.io"
+
+// Find returns the credentials for the registry hosting the image. The given
+// registries are checked first, with username and password expanded with
+// environment variables, then the auths of the docker config file.
+func Find(registries []internaltypes.Registry, image string) (internaltypes.Registry, bool) {
+	server := Server(image)
+	for _, r := range registries {
+		if Normalize(r.Server) == server {
+			r.Username = os.ExpandEnv(r.Username)
+			r.Password = os.ExpandEnv(r.Password)
+			return r, true
+		}
+	}
+	for _, r := range dockerConfig() {
+		if Normalize(r.Server) == server {
+			return r, true
+		}
+	}
+	return internaltypes.Registry{}, false
+}
+
+// Server returns the registry hosting the image, e.g. ghcr.io or docker.io.
+func Server(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return ""
+	}
+	return Normalize(reference.Domain(named))
+}
+
+// Normalize strips the scheme and path of a registry server, and maps every
+// Docker Hub address to docker.io.
+func Normalize(server string) string {
+	server = strings.TrimPrefix(server, "https://")
+	server = strings.TrimPrefix(server, "http://")
+	server = strings.SplitN(server, "/", 2)[0]
+	switch server {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return DockerHub
+	}
+	return server
+}
+
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+}
+
+// dockerConfig reads the auths of $DOCKER_CONFIG/config.json, or
+// ~/.docker/config.json. Credential helpers are not supported.
+func dockerConfig() []internaltypes.Registry {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return nil
+	}
+	file := dockerConfigFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil
+	}
+	registries := []internaltypes.Registry{}
+	for server, auth := range file.Auths {
+		r := internaltypes.Registry{Server: server, Username: auth.Username, Password: auth.Password}
+		if decoded, err := base64.StdEncoding.DecodeString(auth.Auth); err == nil && auth.Auth != "" {
+			r.Username, r.Password, _ = strings.Cut(string(decoded), ":")
+		}
+		if r.Username != "" || r.Password != "" {
+			registries = append(registries, r)
+		}
+	}
+	return registries
+}
@@ -0,0 +1,86 @@
+package registry
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		server string
+		want   string
+	}{
+		{server: "ghcr.io", want: "ghcr.io"},
+		{server: "https://ghcr.io/v2/", want: "ghcr.io"},
+		{server: "http://localhost:5000", want: "localhost:5000"},
+		{server: "registry.example.com/team/project", want: "registry.example.com"},
+		{server: "docker.io", want: DockerHub},
+		{server: "index.docker.io", want: DockerHub},
+		{server: "https://index.docker.io/v1/", want: DockerHub},
+		{server: "registry-1.docker.io", want: DockerHub},
+		{server: "registry.hub.docker.com", want: DockerHub},
+		{server: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.server); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.server, got, tt.want)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{image: "alpine", want: DockerHub},
+		{image: "library/alpine:3.17", want: DockerHub},
+		{image: "docker.io/bitnami/redis", want: DockerHub},
+		{image: "ghcr.io/org/app:v1", want: "ghcr.io"},
+		{image: "localhost:5000/app@sha256:" + sha, want: "localhost:5000"},
+		{image: "Invalid Image", want: ""},
+	}
+	for _, tt := range tests {
+		if got := Server(tt.image); got != tt.want {
+			t.Errorf("Server(%q) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+}
+
+const sha = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func TestFind(t *testing.T) {
+	dir := t.TempDir()
+	auth := base64.StdEncoding.EncodeToString([]byte("hub-user:hub:pass"))
+	config := `{"auths": {"https://index.docker.io/v1/": {"auth": "` + auth + `"}, "quay.io": {"username": "q", "password": "p"}, "empty.io": {}}}`
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DOCKER_CONFIG", dir)
+	t.Setenv("GHCR_TOKEN", "secret")
+	registries := []internaltypes.Registry{
+		{Server: "https://ghcr.io", Username: "bot", Password: "$GHCR_TOKEN"},
+		{Server: "quay.io", Username: "config", Password: "wins"},
+	}
+	tests := []struct {
+		image string
+		want  internaltypes.Registry
+		found bool
+	}{
+		{image: "ghcr.io/org/app", want: internaltypes.Registry{Server: "https://ghcr.io", Username: "bot", Password: "secret"}, found: true},
+		{image: "quay.io/org/app", want: internaltypes.Registry{Server: "quay.io", Username: "config", Password: "wins"}, found: true},
+		{image: "alpine", want: internaltypes.Registry{Server: "https://index.docker.io/v1/", Username: "hub-user", Password: "hub:pass"}, found: true},
+		{image: "empty.io/app"},
+		{image: "gcr.io/app"},
+	}
+	for _, tt := range tests {
+		got, found := Find(registries, tt.image)
+		if found != tt.found || got != tt.want {
+			t.Errorf("Find(%q) = %+v, %v, want %+v, %v", tt.image, got, found, tt.want, tt.found)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+)
+
+// Provider reads secret values from an external secret store.
+type Provider interface {
+	// Get returns the value of the secret at key, in the format of the provider.
+	Get(ctx context.Context, key string) (string, error)
+}
+
+var (
+	providersMu sync.Mutex
+	providers   = map[string]func() (Provider, error){
+		"vault": func() (Provider, error) { return VaultFromConfig() },
+	}
+)
+
+// Register makes a provider available to the secrets with provider: name.
+// The provider is created every time secrets are resolved.
+func Register(name string, provider func() (Provider, error)) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[name] = provider
+}
+
+// Resolve reads the secrets named in names from their definitions, and
+// returns them as env variables in the order of names.
+func Resolve(ctx context.Context, definitions []internaltypes.Secret, names []string) ([]internaltypes.Env, error) {
+	envs := []internaltypes.Env{}
+	created := make(map[string]Provider)
+	for _, name := range names {
+		found := false
+		for _, s := range definitions {
+			if s.Name != name {
+				continue
+			}
+			found = true
+			value, err := read(ctx, s, created)
+			if err != nil {
+				return nil, fmt.Errorf("secret %s: %w", name, err)
+			}
+			envs = append(envs, internaltypes.Env{Name: name, Value: value})
+			break
+		}
+		if !found {
+			return nil, fmt.Errorf("secret %s is not defined in the config", name)
+		}
+	}
+	return envs, nil
+}
+
+func read(ctx context.Context, s internaltypes.Secret, created map[string]Provider) (string, error) {
+	switch {
+	case s.Env != "":
+		value, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("env variable %s is not set", s.Env)
+		}
+		return value, nil
+	case s.File != "":
+		b, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(string(b), "\n"), nil
+	case s.Provider != "":
+		p, ok := created[s.Provider]
+		if !ok {
+			providersMu.Lock()
+			newProvider, registered := providers[s.Provider]
+			providersMu.Unlock()
+			if !registered {
+				return "", fmt.Errorf("unknown provider %s", s.Provider)
+			}
+			var err error
+			if p, err = newProvider(); err != nil {
+				return "", err
+			}
+			created[s.Provider] = p
+		}
+		return p.Get(ctx, s.Key)
+	}
+	return "", errors.New("needs one of env, file or provider")
+}
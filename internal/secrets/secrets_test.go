@@ -0,0 +1,75 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+)
+
+// fakeProvider returns the keys it is asked for, prefixed by its name.
+type fakeProvider struct {
+	name string
+}
+
+func (p fakeProvider) Get(ctx context.Context, key string) (string, error) {
+	if key == "missing" {
+		return "", errors.New("not found")
+	}
+	return p.name + ":" + key, nil
+}
+
+func TestResolve(t *testing.T) {
+	created := 0
+	Register("fake", func() (Provider, error) {
+		created++
+		return fakeProvider{name: "fake"}, nil
+	})
+	Register("broken", func() (Provider, error) {
+		return nil, errors.New("no credentials")
+	})
+	t.Setenv("OPSILON_TEST_TOKEN", "from-env")
+	file := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	definitions := []internaltypes.Secret{
+		{Name: "token", Env: "OPSILON_TEST_TOKEN"},
+		{Name: "key", File: file},
+		{Name: "db", Provider: "fake", Key: "db#password"},
+		{Name: "api", Provider: "fake", Key: "api#token"},
+		{Name: "unset", Env: "OPSILON_TEST_UNSET"},
+		{Name: "nofile", File: filepath.Join(t.TempDir(), "missing")},
+		{Name: "unknown", Provider: "unknown", Key: "k"},
+		{Name: "broken", Provider: "broken", Key: "k"},
+		{Name: "lost", Provider: "fake", Key: "missing"},
+		{Name: "empty"},
+	}
+
+	got, err := Resolve(context.Background(), definitions, []string{"api", "token", "key", "db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []internaltypes.Env{
+		{Name: "api", Value: "fake:api#token"},
+		{Name: "token", Value: "from-env"},
+		{Name: "key", Value: "from-file"},
+		{Name: "db", Value: "fake:db#password"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Resolve() = %v, want %v", got, want)
+	}
+	if created != 1 {
+		t.Errorf("the provider was created %d times, want once per Resolve", created)
+	}
+
+	for _, name := range []string{"undefined", "unset", "nofile", "unknown", "broken", "lost", "empty"} {
+		if _, err := Resolve(context.Background(), definitions, []string{"token", name}); err == nil {
+			t.Errorf("Resolve(%s) succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Vault reads secrets from a HashiCorp Vault KV version 2 secrets engine.
+// Keys are <mount>/<path>#<field>, such as secret/myapp#password.
+type Vault struct {
+	address string
+	token   string
+	client  *http.Client
+}
+
+// NewVault returns a provider for the Vault server at address, such as
+// http://127.0.0.1:8200, authenticated with token.
+func NewVault(address, token string) (*Vault, error) {
+	if address == "" || token == "" {
+		return nil, errors.New("the vault provider needs vault_address and vault_token")
+	}
+	return &Vault{
+		address: strings.TrimSuffix(address, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// VaultFromConfig returns a provider configured by vault_address and
+// vault_token, defaulting to VAULT_ADDR and VAULT_TOKEN.
+func VaultFromConfig() (*Vault, error) {
+	address := viper.GetString("vault_address")
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	token := viper.GetString("vault_token")
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	return NewVault(address, token)
+}
+
+func (v *Vault) Get(ctx context.Context, key string) (string, error) {
+	secretPath, field, ok := strings.Cut(key, "#")
+	mount, name, hasName := strings.Cut(secretPath, "/")
+	if !ok || !hasName || field == "" || name == "" {
+		return "", fmt.Errorf("vault key %s must be <mount>/<path>#<field>", key)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.address+"/v1/"+mount+"/data/"+name, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Errors []string `json:"errors"`
+		Data   struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("vault %s: %w", secretPath, err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", fmt.Errorf("vault %s not found", secretPath)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("vault %s: %s %s", secretPath, resp.Status, strings.Join(body.Errors, ", "))
+	}
+	value, ok := body.Data.Data[field]
+	if !ok {
+		return "", fmt.Errorf("vault %s has no field %s", secretPath, field)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(value)
+	return string(b), err
+}
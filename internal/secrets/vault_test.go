@@ -0,0 +1,68 @@
+package secrets
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVault(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/myapp":
+			w.Write([]byte(`{"data": {"data": {"password": "s3cret", "port": 5432, "tls": {"ca": "pem"}}, "metadata": {"version": 2}}}`))
+		case "/v1/kv/data/team/app":
+			w.Write([]byte(`{"data": {"data": {"token": "nested"}}}`))
+		case "/v1/secret/data/invalid":
+			w.Write([]byte(`not json`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors": []}`))
+		}
+	}))
+	defer server.Close()
+
+	v, err := NewVault(server.URL+"/", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{key: "secret/myapp#password", want: "s3cret"},
+		{key: "secret/myapp#port", want: "5432"},
+		{key: "secret/myapp#tls", want: `{"ca":"pem"}`},
+		{key: "kv/team/app#token", want: "nested"},
+		{key: "secret/myapp#missing", wantErr: true},
+		{key: "secret/other#password", wantErr: true},
+		{key: "secret/invalid#password", wantErr: true},
+		{key: "secret/myapp", wantErr: true},
+		{key: "secret#password", wantErr: true},
+		{key: "secret/myapp#", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := v.Get(context.Background(), tt.key)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("Get(%q) = %q, %v, want %q, error %v", tt.key, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	denied, err := NewVault(server.URL, "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := denied.Get(context.Background(), "secret/myapp#password"); err == nil {
+		t.Error("Get() with a wrong token succeeded")
+	}
+	if _, err := NewVault("", "token"); err == nil {
+		t.Error("NewVault() without an address succeeded")
+	}
+}
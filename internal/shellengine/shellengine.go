@@ -0,0 +1,127 @@
+package shellengine
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path"
+	"syscall"
+
+	"github.com/jatalocks/opsilon/internal/artifacts"
+	"github.com/jatalocks/opsilon/internal/engine"
+	"github.com/jatalocks/opsilon/internal/executor"
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+)
+
+// Executor runs stages as processes on the host, inside a temporary
+// workspace directory. Stage images are ignored.
+type Executor struct{}
+
+type workspace struct {
+	dir       string
+	dirOutput string
+}
+
+func NewExecutor() *Executor {
+	return &Executor{}
+}
+
+func (e *Executor) Prepare(ctx context.Context, w internaltypes.Workflow, runid string) error {
+	return nil
+}
+
+func (e *Executor) RunStage(ctx context.Context, s *executor.StageRun) (int, error) {
+	if len(s.Stage.Script) == 0 {
+		return -1, errors.New("stage " + s.Stage.ID + " has no script")
+	}
+	ws := &workspace{}
+	s.Workspace = ws
+	dir, err := os.MkdirTemp("", "temp")
+	if err != nil {
+		return -1, err
+	}
+	ws.dir = dir
+	dirOutput, err := os.MkdirTemp("", "output")
+	if err != nil {
+		return -1, err
+	}
+	ws.dirOutput = dirOutput
+	outputPath := path.Join(dirOutput, "output")
+	err = os.WriteFile(outputPath, nil, 0o644)
+	if err != nil {
+		return -1, err
+	}
+
+	if s.Checkout != "" {
+		if err := artifacts.Copy(s.Checkout, ws.dir); err != nil {
+			return -1, err
+		}
+	}
+	if err := engine.LoadImportsIntoStage(ctx, s, ws.dir); err != nil {
+		return -1, err
+	}
+	if len(s.Services()) > 0 {
+		s.LwRed.Write([]byte("Services are not started by the shell executor\n"))
+	}
+
+	cmd := exec.Command(s.Stage.Script[0], s.Stage.Script[1:]...)
+	cmd.Dir = ws.dir
+	cmd.Env = append(os.Environ(), engine.GenEnv(s.Env)...)
+	cmd.Env = append(cmd.Env, "OUTPUT="+outputPath, "OUTPUT_JSON="+path.Join(ws.dirOutput, "output.json"))
+	cmd.Stdout = s.LwWhite
+	cmd.Stderr = s.LwRed
+	// Run the script in its own process group so that everything it started
+	// can be killed together when the context is done.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return -1, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return -1, ctx.Err()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+func (e *Executor) Collect(ctx context.Context, s *executor.StageRun) ([]internaltypes.Env, error) {
+	ws, ok := s.Workspace.(*workspace)
+	if !ok {
+		return []internaltypes.Env{}, nil
+	}
+	artifactsErr := engine.ExtractArtifacts(ctx, s, ws.dir)
+	outputs, err := engine.ReadOutputs(ws.dirOutput)
+	if artifactsErr != nil {
+		return outputs, artifactsErr
+	}
+	return outputs, err
+}
+
+func (e *Executor) Finish(ctx context.Context) {}
+
+func (e *Executor) Cleanup(ctx context.Context, s *executor.StageRun) {
+	ws, ok := s.Workspace.(*workspace)
+	if !ok {
+		return
+	}
+	os.RemoveAll(ws.dir)
+	os.RemoveAll(ws.dirOutput)
+}
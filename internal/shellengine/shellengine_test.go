@@ -0,0 +1,177 @@
+package shellengine
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/jatalocks/opsilon/internal/artifacts"
+	"github.com/jatalocks/opsilon/internal/executor"
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"github.com/jatalocks/opsilon/internal/logger"
+)
+
+// newRun returns a run of the stage that saves its artifacts to store, with
+// its logs appended to logs.
+func newRun(stage internaltypes.Stage, store artifacts.Store, logs *[]string) *executor.StageRun {
+	w := logger.NewLogWriter(func(str string, col color.Attribute) {
+		*logs = append(*logs, str)
+	}, color.FgWhite)
+	return &executor.StageRun{
+		Stage:     stage,
+		RunID:     "run",
+		Env:       []internaltypes.Env{{Name: "GREETING", Value: "hello"}},
+		LwWhite:   w,
+		LwRed:     w,
+		Artifacts: store,
+		Scope:     artifacts.Scope{Repo: "r", Workflow: "w", RunID: "run"},
+	}
+}
+
+func setup(t *testing.T) artifacts.Store {
+	t.Helper()
+	t.Setenv("TMPDIR", t.TempDir())
+	store, err := artifacts.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// run runs the stage and collects it like the runner does.
+func run(t *testing.T, ctx context.Context, s *executor.StageRun) (int, []internaltypes.Env, error) {
+	t.Helper()
+	e := NewExecutor()
+	exitCode, err := e.RunStage(ctx, s)
+	outputs, collectErr := e.Collect(context.Background(), s)
+	e.Cleanup(context.Background(), s)
+	if err == nil {
+		err = collectErr
+	}
+	return exitCode, outputs, err
+}
+
+func TestRunStage(t *testing.T) {
+	store := setup(t)
+	tests := []struct {
+		name     string
+		script   string
+		exitCode int
+		outputs  []internaltypes.Env
+		logs     []string
+	}{
+		{
+			name:     "outputs written to $OUTPUT and $OUTPUT_JSON",
+			script:   `echo "$GREETING"; echo tag=v1 >> "$OUTPUT"; echo '{"size": 3}' > "$OUTPUT_JSON"`,
+			outputs:  []internaltypes.Env{{Name: "tag", Value: "v1"}, {Name: "size", Value: "3"}},
+			logs:     []string{"hello"},
+			exitCode: 0,
+		},
+		{
+			name:     "exit code",
+			script:   `echo failing >&2; exit 3`,
+			outputs:  []internaltypes.Env{},
+			logs:     []string{"failing"},
+			exitCode: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs []string
+			s := newRun(internaltypes.Stage{ID: "s", Script: []string{"sh", "-c", tt.script}}, store, &logs)
+			exitCode, outputs, err := run(t, context.Background(), s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exitCode != tt.exitCode {
+				t.Errorf("exit code = %d, want %d", exitCode, tt.exitCode)
+			}
+			if !reflect.DeepEqual(outputs, tt.outputs) {
+				t.Errorf("outputs = %v, want %v", outputs, tt.outputs)
+			}
+			if !reflect.DeepEqual(logs, tt.logs) {
+				t.Errorf("logs = %q, want %q", logs, tt.logs)
+			}
+		})
+	}
+}
+
+func TestRunStageArtifacts(t *testing.T) {
+	store := setup(t)
+	var logs []string
+	build := newRun(internaltypes.Stage{
+		ID:        "build",
+		Script:    []string{"sh", "-c", "mkdir dist && echo app > dist/app && echo src > main.go"},
+		Artifacts: []string{"dist/*"},
+	}, store, &logs)
+	if _, _, err := run(t, context.Background(), build); err != nil {
+		t.Fatal(err)
+	}
+	objects, err := store.List(context.Background(), "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Stage != "build" || objects[0].Path != "dist/app" {
+		t.Fatalf("saved artifacts = %+v, want build dist/app", objects)
+	}
+
+	release := newRun(internaltypes.Stage{
+		ID:     "release",
+		Script: []string{"sh", "-c", `echo "imported=$(cat dist/app)" >> "$OUTPUT"; test ! -e main.go`},
+		Import: []internaltypes.Import{{From: "build", Artifacts: []string{"dist/app"}}},
+	}, store, &logs)
+	exitCode, outputs, err := run(t, context.Background(), release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []internaltypes.Env{{Name: "imported", Value: "app"}}; exitCode != 0 || !reflect.DeepEqual(outputs, want) {
+		t.Errorf("release = %d, %v, want 0, %v", exitCode, outputs, want)
+	}
+}
+
+func TestRunStageNoFiles(t *testing.T) {
+	store := setup(t)
+	var logs []string
+	s := newRun(internaltypes.Stage{
+		ID:             "build",
+		Script:         []string{"true"},
+		Artifacts:      []string{"dist/*"},
+		IfNoFilesFound: "error",
+	}, store, &logs)
+	if _, _, err := run(t, context.Background(), s); !errors.Is(err, artifacts.ErrNoFiles) {
+		t.Errorf("error = %v, want %v", err, artifacts.ErrNoFiles)
+	}
+}
+
+func TestRunStageCancel(t *testing.T) {
+	store := setup(t)
+	var logs []string
+	// The background sleep keeps the output open, so the stage only ends
+	// early if every process it started is killed.
+	s := newRun(internaltypes.Stage{ID: "slow", Script: []string{"sh", "-c", "sleep 30 & sleep 30"}}, store, &logs)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	exitCode, _, err := run(t, ctx, s)
+	if !errors.Is(err, context.DeadlineExceeded) || exitCode != -1 {
+		t.Errorf("RunStage() = %d, %v, want -1, %v", exitCode, err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("RunStage() returned after %s, the stage processes were not killed", elapsed)
+	}
+	if entries, err := os.ReadDir(os.Getenv("TMPDIR")); err != nil || len(entries) != 0 {
+		t.Errorf("workspace not removed: %v, %v", entries, err)
+	}
+}
+
+func TestRunStageWithoutScript(t *testing.T) {
+	var logs []string
+	s := newRun(internaltypes.Stage{ID: "empty"}, nil, &logs)
+	if _, err := NewExecutor().RunStage(context.Background(), s); err == nil {
+		t.Error("RunStage() without a script succeeded")
+	}
+}
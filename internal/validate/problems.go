@@ -0,0 +1,283 @@
+package validate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"gopkg.in/validator.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is something wrong with a workflow, at a line of the file it was
+// read from. Line is 0 when it is not known. Workflow is the ID of the
+// workflow in the file, when the file could be read.
+type Problem struct {
+	File     string `json:"file"`
+	Workflow string `json:"workflow,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message"`
+}
+
+func (p Problem) String() string {
+	switch {
+	case p.File == "":
+		return p.Message
+	case p.Line == 0:
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+}
+
+// Problems is the error of workflows that have problems, one per line.
+type Problems []Problem
+
+func (p Problems) Error() string {
+	lines := make([]string, len(p))
+	for i, problem := range p {
+		lines[i] = problem.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Sort orders the problems by file and line.
+func (p Problems) Sort() {
+	sort.SliceStable(p, func(a, b int) bool {
+		if p[a].File != p[b].File {
+			return p[a].File < p[b].File
+		}
+		return p[a].Line < p[b].Line
+	})
+}
+
+var (
+	yamlLine     = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	unknownField = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+	errorField   = regexp.MustCompile(`^\[(\d+)\]\.?(.*)$`)
+	pathPart     = regexp.MustCompile(`^(\w*)(?:\[(.*)\])?$`)
+)
+
+// Decode reads the workflow in the file data, refusing keys that are not
+// fields of a workflow. The workflow is nil when the file is not YAML;
+// otherwise it holds the keys that could be read, even with problems.
+func Decode(file string, data []byte) (*internaltypes.Workflow, Problems) {
+	w := &internaltypes.Workflow{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(w)
+	if err == nil || errors.Is(err, io.EOF) {
+		return w, nil
+	}
+	messages := []string{err.Error()}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	} else {
+		w = nil
+	}
+	problems := Problems{}
+	for _, m := range messages {
+		p := Problem{File: file, Message: m}
+		if match := yamlLine.FindStringSubmatch(m); match != nil {
+			p.Line, _ = strconv.Atoi(match[1])
+			p.Message = match[2]
+		}
+		if match := unknownField.FindStringSubmatch(p.Message); match != nil {
+			p.Message = "unknown key " + match[1]
+		}
+		problems = append(problems, p)
+	}
+	return w, problems
+}
+
+// Locate turns the error of ValidateWorkflows for the workflows w into
+// problems at the lines of the files the workflows were read from. sources
+// holds the content of the files by name.
+func Locate(err error, w []internaltypes.Workflow, sources map[string][]byte) Problems {
+	errs, ok := err.(validator.ErrorMap)
+	if !ok {
+		return Problems{{Message: err.Error()}}
+	}
+	fields := make([]string, 0, len(errs))
+	for f := range errs {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	problems := Problems{}
+	for _, f := range fields {
+		p := Problem{}
+		label := f
+		if match := errorField.FindStringSubmatch(f); match != nil {
+			i, _ := strconv.Atoi(match[1])
+			if i < len(w) {
+				root := &yaml.Node{}
+				_ = yaml.Unmarshal(sources[w[i].File], root)
+				p.File = w[i].File
+				p.Line, label = locate(root, w[i], match[2])
+			}
+		}
+		for _, e := range errs[f] {
+			p.Message = strings.TrimSpace(e.Error())
+			if label != "" {
+				p.Message = label + ": " + p.Message
+			}
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+// locate returns the line of the field at path, such as Stages[2].Env[0],
+// of the workflow w read from the document root, and the path with the
+// keys of the file. Elements of lists are found by their id or name, since
+// extends and templates change their positions.
+func locate(root *yaml.Node, w internaltypes.Workflow, path string) (int, string) {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := node.Line
+	value := reflect.ValueOf(w)
+	labels := []string{}
+	for _, part := range strings.Split(path, ".") {
+		match := pathPart.FindStringSubmatch(part)
+		if match == nil {
+			break
+		}
+		if match[1] != "" {
+			for value.Kind() == reflect.Ptr && !value.IsNil() {
+				value = value.Elem()
+			}
+			if value.Kind() != reflect.Struct {
+				break
+			}
+			field, ok := value.Type().FieldByName(match[1])
+			if !ok {
+				break
+			}
+			value = value.FieldByIndex(field.Index)
+			labels = append(labels, yamlKey(field))
+			if node != nil {
+				if key, v := mappingValue(node, yamlKey(field)); v != nil {
+					line, node = key.Line, v
+				} else {
+					node = nil
+				}
+			}
+		}
+		if strings.HasSuffix(part, "]") {
+			var label string
+			var occurrence int
+			value, label, occurrence = element(value, match[2])
+			if !value.IsValid() {
+				break
+			}
+			if len(labels) == 0 {
+				labels = append(labels, "")
+			}
+			labels[len(labels)-1] += "[" + label + "]"
+			if node != nil {
+				if node = findElement(node, value, match[2], occurrence); node != nil {
+					line = node.Line
+				}
+			}
+		}
+	}
+	return line, strings.Join(labels, ".")
+}
+
+func yamlKey(field reflect.StructField) string {
+	if name, _, _ := strings.Cut(field.Tag.Get("yaml"), ","); name != "" {
+		return name
+	}
+	return strings.ToLower(field.Name)
+}
+
+func mappingValue(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// element returns the element of a list or a map at index, and its label:
+// its id or name when it has one. occurrence counts the elements before it
+// with the same id or name.
+func element(value reflect.Value, index string) (reflect.Value, string, int) {
+	switch value.Kind() {
+	case reflect.Slice:
+		i, err := strconv.Atoi(index)
+		if err != nil || i >= value.Len() {
+			return reflect.Value{}, "", 0
+		}
+		item := value.Index(i)
+		id := identity(item)
+		if id == "" {
+			return item, index, 0
+		}
+		occurrence := 0
+		for j := 0; j < i; j++ {
+			if identity(value.Index(j)) == id {
+				occurrence++
+			}
+		}
+		return item, id, occurrence
+	case reflect.Map:
+		return value.MapIndex(reflect.ValueOf(index)), index, 0
+	}
+	return reflect.Value{}, "", 0
+}
+
+// findElement returns the node of the element of the list or map node.
+func findElement(node *yaml.Node, item reflect.Value, index string, occurrence int) *yaml.Node {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		if id := identity(item); id != "" {
+			for _, n := range node.Content {
+				for _, key := range []string{"id", "name"} {
+					if _, v := mappingValue(n, key); v != nil && v.Value == id {
+						if occurrence == 0 {
+							return n
+						}
+						occurrence--
+					}
+				}
+			}
+			return nil
+		}
+		if i, err := strconv.Atoi(index); err == nil && i < len(node.Content) {
+			return node.Content[i]
+		}
+	case yaml.MappingNode:
+		if _, v := mappingValue(node, index); v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// identity returns the id or the name of a stage, an input, an env variable
+// or a service.
+func identity(item reflect.Value) string {
+	if item.Kind() != reflect.Struct {
+		return ""
+	}
+	for _, name := range []string{"ID", "Name"} {
+		if f := item.FieldByName(name); f.IsValid() && f.Kind() == reflect.String && f.String() != "" {
+			return f.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,96 @@
+package validate
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		workflow bool
+		want     Problems
+	}{
+		{
+			name:     "valid",
+			data:     "id: app\nimage: alpine\nstages:\n  - id: a\n    stage: A\n    script: [x]\n",
+			workflow: true,
+			want:     nil,
+		},
+		{
+			name:     "unknown keys and wrong types",
+			data:     "id: app\nimage: alpine\nunknown: 1\nstages:\n  - id: a\n    stage: A\n    scrpt: [x]\n    clean: maybe\n",
+			workflow: true,
+			want: Problems{
+				{File: "app.ops.yaml", Line: 3, Message: "unknown key unknown"},
+				{File: "app.ops.yaml", Line: 7, Message: "unknown key scrpt"},
+				{File: "app.ops.yaml", Line: 8, Message: "cannot unmarshal !!str `maybe` into bool"},
+			},
+		},
+		{
+			name: "not YAML",
+			data: "id: [\n",
+			want: Problems{{File: "app.ops.yaml", Line: 1, Message: "did not find expected node content"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, problems := Decode("app.ops.yaml", []byte(tt.data))
+			if (w != nil) != tt.workflow {
+				t.Errorf("Decode() workflow = %v, want one: %v", w, tt.workflow)
+			}
+			if !reflect.DeepEqual(problems, tt.want) {
+				t.Errorf("Decode() problems = %#v, want %#v", problems, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocate(t *testing.T) {
+	sources := map[string][]byte{
+		"app.ops.yaml": []byte(`id: app
+image: alpine
+stages:
+  - id: build
+    stage: Build
+    script: [make]
+  - id: test
+    stage: Test
+    needs: build,lint
+    script: [make, test]
+    env:
+      - name: ok
+        value: "1"
+      - name: has space
+        value: "2"
+`),
+		"other.ops.yaml": []byte("id: other\nimage: alpine\nstages:\n  - id: a\n    stage: A\n    script: [x]\n"),
+	}
+	workflows := []internaltypes.Workflow{}
+	for _, file := range []string{"other.ops.yaml", "app.ops.yaml"} {
+		w, problems := Decode(file, sources[file])
+		if len(problems) > 0 {
+			t.Fatal(problems)
+		}
+		w.File = file
+		workflows = append(workflows, *w)
+	}
+	// Stages merged from a workflow that is extended come first, the
+	// stages are found by ID rather than position.
+	workflows[1].Stages = append([]internaltypes.Stage{{ID: "base", Stage: "Base", Script: []string{"x"}}}, workflows[1].Stages...)
+
+	err := ValidateWorkflows(&workflows)
+	if err == nil {
+		t.Fatal("ValidateWorkflows() succeeded")
+	}
+	want := Problems{
+		{File: "app.ops.yaml", Line: 14, Message: "stages[test].env[has space].name: value cannot contain spaces"},
+		{File: "app.ops.yaml", Line: 9, Message: "stages[test].needs: needs unknown stage lint"},
+	}
+	if got := Locate(err, workflows, sources); !reflect.DeepEqual(got, want) {
+		t.Errorf("Locate() = %#v, want %#v", got, want)
+	}
+}
@@ -2,13 +2,22 @@ package validate
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
+	"regexp"
 	"strings"
+	"time"
 
+	"github.com/jatalocks/opsilon/internal/artifacts"
+	"github.com/jatalocks/opsilon/internal/condition"
 	"github.com/jatalocks/opsilon/internal/config"
 	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"github.com/jatalocks/opsilon/internal/interpolate"
 	"github.com/jatalocks/opsilon/internal/logger"
+	"github.com/jatalocks/opsilon/internal/matrix"
+	"golang.org/x/exp/slices"
 	"gopkg.in/validator.v2"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 func noWhiteSpace(v interface{}, param string) error {
@@ -22,6 +31,53 @@ func noWhiteSpace(v interface{}, param string) error {
 	return nil
 }
 
+// image is nowhitespace for fields that may hold ${{ }} references, whose
+// expressions can be surrounded by spaces.
+func image(v interface{}, param string) error {
+	st := reflect.ValueOf(v)
+	if st.Kind() != reflect.String {
+		return errors.New("image only validates strings")
+	}
+	return noWhiteSpace(interpolate.Strip(st.String()), param)
+}
+
+func duration(v interface{}, param string) error {
+	st := reflect.ValueOf(v)
+	if st.Kind() != reflect.String {
+		return errors.New("duration only validates strings")
+	}
+	if st.String() == "" {
+		return nil
+	}
+	if _, err := time.ParseDuration(st.String()); err != nil {
+		return errors.New("value must be a duration such as 90s, 10m or 1h30m")
+	}
+	return nil
+}
+
+func quantity(v interface{}, param string) error {
+	st := reflect.ValueOf(v)
+	if st.Kind() != reflect.String {
+		return errors.New("quantity only validates strings")
+	}
+	if st.String() == "" {
+		return nil
+	}
+	q, err := resource.ParseQuantity(st.String())
+	if err != nil || q.Sign() <= 0 {
+		return errors.New("value must be a positive quantity such as 500m, 2, 256Mi or 1Gi")
+	}
+	return nil
+}
+
+func globs(v interface{}, param string) error {
+	patterns, ok := v.([]string)
+	if !ok {
+		return errors.New("globs only validates lists of strings")
+	}
+	return artifacts.NewPatterns(patterns).Validate()
+}
+
 func ValidateRepoFile(w *config.RepoFile) error {
 	validator.SetValidationFunc("nowhitespace", noWhiteSpace)
 	if errs := validator.Validate(&w); errs != nil {
@@ -42,13 +98,186 @@ func ValidateRepo(w *config.Repo) error {
 
 func ValidateWorkflows(w *[]internaltypes.Workflow) error {
 	validator.SetValidationFunc("nowhitespace", noWhiteSpace)
-	if errs := validator.Validate(&w); errs != nil {
+	validator.SetValidationFunc("duration", duration)
+	validator.SetValidationFunc("quantity", quantity)
+	validator.SetValidationFunc("globs", globs)
+	validator.SetValidationFunc("image", image)
+	errs := validator.ErrorMap{}
+	if err := validator.Validate(&w); err != nil {
+		if m, ok := err.(validator.ErrorMap); ok {
+			errs = m
+		} else {
+			return err
+		}
+	}
+	for i, wf := range *w {
+		for k, in := range wf.Input {
+			field := fmt.Sprintf("[%d].Input[%d]", i, k)
+			if in.Type == internaltypes.InputChoice && len(in.Choices) == 0 {
+				errs[field] = append(errs[field], errors.New("a choice input needs choices"))
+			}
+			if _, err := regexp.Compile(in.Pattern); err != nil {
+				errs[field] = append(errs[field], fmt.Errorf("invalid pattern %s: %w", in.Pattern, err))
+			} else if in.Default != "" {
+				if _, err := in.Check(in.Default); err != nil {
+					errs[field] = append(errs[field], fmt.Errorf("default: %w", err))
+				}
+			}
+		}
+		for j, s := range wf.Stages {
+			if err := checkUses(s); err != nil {
+				field := fmt.Sprintf("[%d].Stages[%d].Uses", i, j)
+				errs[field] = append(errs[field], err)
+			}
+			if err := condition.Check(s.If, strings.Split(s.Needs, ","), knownVariables(wf, s)); err != nil {
+				field := fmt.Sprintf("[%d].Stages[%d].If", i, j)
+				errs[field] = append(errs[field], err)
+			}
+		}
+		for f, fieldErrs := range checkNeeds(wf) {
+			field := fmt.Sprintf("[%d].%s", i, f)
+			errs[field] = append(errs[field], fieldErrs...)
+		}
+		for f, err := range interpolate.Check(wf) {
+			field := fmt.Sprintf("[%d].%s", i, f)
+			errs[field] = append(errs[field], err)
+		}
+	}
+	if len(errs) > 0 {
 		logger.Operation("Your Workflows have Problems:")
 		return errs
 	}
 	return nil
 }
 
+// knownVariables returns the names of the variables the if condition of a
+// stage can read without needs: the workflow env, the secrets, the inputs,
+// the stage env and the matrix axes.
+func knownVariables(w internaltypes.Workflow, s internaltypes.Stage) []string {
+	known := append([]string{}, w.Secrets...)
+	for _, e := range append(append([]internaltypes.Env{}, w.Env...), s.Env...) {
+		known = append(known, e.Name)
+	}
+	for _, in := range w.Input {
+		known = append(known, in.Name)
+	}
+	for axis := range s.Matrix {
+		known = append(known, axis)
+	}
+	return known
+}
+
+// checkNeeds reports the stages with the same ID, the instances of matrix
+// stages with the ID of another stage, the needs that are not stages of the
+// workflow, the stages that need each other in a cycle and the imports from
+// stages that are not needed, by field.
+func checkNeeds(w internaltypes.Workflow) map[string][]error {
+	stages := w.Stages
+	errs := make(map[string][]error)
+	index := make(map[string]int)
+	for j, s := range stages {
+		if _, ok := index[s.ID]; ok {
+			field := fmt.Sprintf("Stages[%d].ID", j)
+			errs[field] = append(errs[field], fmt.Errorf("duplicate stage ID %s", s.ID))
+			continue
+		}
+		index[s.ID] = j
+	}
+	// Matrix stages are expanded with the defaults of the inputs. Values only
+	// known at run time are checked when the run starts.
+	var idErr *matrix.IDError
+	if _, err := matrix.Expand(w); errors.As(err, &idErr) {
+		j := slices.IndexFunc(stages, func(s internaltypes.Stage) bool { return s.ID == idErr.Stage && len(s.Matrix) > 0 })
+		field := fmt.Sprintf("Stages[%d].Matrix", j)
+		errs[field] = append(errs[field], idErr)
+	}
+	needs := func(s internaltypes.Stage) []string {
+		if s.Needs == "" {
+			return nil
+		}
+		return strings.Split(s.Needs, ",")
+	}
+	for j, s := range stages {
+		for _, need := range needs(s) {
+			if _, ok := index[need]; !ok {
+				field := fmt.Sprintf("Stages[%d].Needs", j)
+				errs[field] = append(errs[field], fmt.Errorf("needs unknown stage %s", need))
+			}
+		}
+		for k, imp := range s.Import {
+			if imp.From != "" && !slices.Contains(needs(s), imp.From) {
+				field := fmt.Sprintf("Stages[%d].Import[%d].From", j, k)
+				errs[field] = append(errs[field], fmt.Errorf("imports from stage %s, which is not in needs", imp.From))
+			}
+		}
+	}
+
+	const visiting, visited = 1, 2
+	state := make(map[string]int)
+	var visit func(id string, path []string)
+	visit = func(id string, path []string) {
+		j, ok := index[id]
+		if !ok || state[id] == visited {
+			return
+		}
+		if state[id] == visiting {
+			field := fmt.Sprintf("Stages[%d].Needs", j)
+			cycle := append(path[slices.Index(path, id):], id)
+			errs[field] = append(errs[field], fmt.Errorf("stages need each other in a cycle: %s", strings.Join(cycle, " -> ")))
+			return
+		}
+		state[id] = visiting
+		for _, need := range needs(stages[j]) {
+			visit(need, append(path, id))
+		}
+		state[id] = visited
+	}
+	for _, s := range stages {
+		visit(s.ID, nil)
+	}
+	return errs
+}
+
+// checkUses verifies that a stage either runs a script or uses a workflow,
+// without the fields that only apply to scripts.
+func checkUses(s internaltypes.Stage) error {
+	if s.Uses == "" {
+		if len(s.Script) == 0 {
+			return errors.New("a stage needs a script or uses")
+		}
+		if len(s.With) > 0 {
+			return errors.New("with needs uses")
+		}
+		return nil
+	}
+	if i := strings.LastIndex(s.Uses, "/"); i <= 0 || i == len(s.Uses)-1 {
+		return fmt.Errorf("uses %s must be <repo>/<workflow id>", s.Uses)
+	}
+	ignored := []string{}
+	if len(s.Script) > 0 {
+		ignored = append(ignored, "script")
+	}
+	if s.Image != "" {
+		ignored = append(ignored, "image")
+	}
+	if len(s.Artifacts) > 0 {
+		ignored = append(ignored, "artifacts")
+	}
+	if len(s.Import) > 0 {
+		ignored = append(ignored, "import")
+	}
+	if s.Retry != nil {
+		ignored = append(ignored, "retry")
+	}
+	if len(s.Services) > 0 {
+		ignored = append(ignored, "services")
+	}
+	if len(ignored) > 0 {
+		return fmt.Errorf("a stage with uses cannot have %s", strings.Join(ignored, ", "))
+	}
+	return nil
+}
+
 func ValidateWorkflowsArgs(w []internaltypes.WorkflowArgument) error {
 	validator.SetValidationFunc("nowhitespace", noWhiteSpace)
 	if errs := validator.Validate(&w); errs != nil {
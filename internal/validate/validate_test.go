@@ -0,0 +1,76 @@
+package validate
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+)
+
+func TestCheckNeeds(t *testing.T) {
+	tests := []struct {
+		name   string
+		stages []internaltypes.Stage
+		want   map[string][]string
+	}{
+		{
+			name: "valid",
+			stages: []internaltypes.Stage{
+				{ID: "build"},
+				{ID: "test", Needs: "build"},
+				{ID: "release", Needs: "build,test", Import: []internaltypes.Import{{From: "build"}}},
+			},
+			want: map[string][]string{},
+		},
+		{
+			name:   "duplicate IDs",
+			stages: []internaltypes.Stage{{ID: "a"}, {ID: "b"}, {ID: "a"}},
+			want:   map[string][]string{"Stages[2].ID": {"duplicate stage ID a"}},
+		},
+		{
+			name:   "unknown needs",
+			stages: []internaltypes.Stage{{ID: "a", Needs: "b,c"}, {ID: "b"}},
+			want:   map[string][]string{"Stages[0].Needs": {"needs unknown stage c"}},
+		},
+		{
+			name:   "cycle",
+			stages: []internaltypes.Stage{{ID: "a", Needs: "c"}, {ID: "b", Needs: "a"}, {ID: "c", Needs: "b"}, {ID: "d", Needs: "a"}},
+			want:   map[string][]string{"Stages[0].Needs": {"stages need each other in a cycle: a -> c -> b -> a"}},
+		},
+		{
+			name:   "stage that needs itself",
+			stages: []internaltypes.Stage{{ID: "a", Needs: "a"}},
+			want:   map[string][]string{"Stages[0].Needs": {"stages need each other in a cycle: a -> a"}},
+		},
+		{
+			name: "imports from stages that are not needed",
+			stages: []internaltypes.Stage{
+				{ID: "build"},
+				{ID: "lint"},
+				{ID: "release", Needs: "build", Import: []internaltypes.Import{{From: "build"}, {From: "lint"}}},
+			},
+			want: map[string][]string{"Stages[2].Import[1].From": {"imports from stage lint, which is not in needs"}},
+		},
+		{
+			name: "matrix instance with the ID of another stage",
+			stages: []internaltypes.Stage{
+				{ID: "build", Matrix: map[string]internaltypes.MatrixValues{"os": {"linux"}}},
+				{ID: "build-linux"},
+			},
+			want: map[string][]string{"Stages[0].Matrix": {"instance build-linux of matrix stage build has the ID of stage build-linux"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string][]string{}
+			for field, errs := range checkNeeds(internaltypes.Workflow{Stages: tt.stages}) {
+				for _, err := range errs {
+					got[field] = append(got[field], err.Error())
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("checkNeeds() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
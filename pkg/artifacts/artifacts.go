@@ -0,0 +1,114 @@
+package artifacts
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/jatalocks/opsilon/internal/artifacts"
+	"github.com/jatalocks/opsilon/internal/concurrency"
+	"github.com/jatalocks/opsilon/internal/logger"
+	"github.com/olekukonko/tablewriter"
+)
+
+// List returns the artifact files of a run, with their checksums, grouped
+// by stage.
+func List(ctx context.Context, runID string) (map[string][]artifacts.Object, error) {
+	store, err := artifacts.FromConfig()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := store.List(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+	if err := artifacts.Checksums(ctx, store, runID, objects); err != nil {
+		return nil, err
+	}
+	byStage := make(map[string][]artifacts.Object)
+	for _, o := range objects {
+		byStage[o.Stage] = append(byStage[o.Stage], o)
+	}
+	return byStage, nil
+}
+
+// Download loads the artifact at name, a file or a directory saved by the
+// stage, into a temporary directory. Directories are zipped. It returns the
+// file to send and a function removing the temporary directory.
+func Download(ctx context.Context, runID, stage, name string) (string, func(), error) {
+	store, err := artifacts.FromConfig()
+	if err != nil {
+		return "", nil, err
+	}
+	name = artifacts.CleanName(name)
+	found, err := artifacts.Find(ctx, store, runID, stage, name)
+	if err != nil {
+		return "", nil, err
+	}
+	dir, err := os.MkdirTemp("", "opsilon-artifact")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	key := found[0].Key(runID)
+	key.Name = name
+	to := filepath.Join(dir, path.Base(name))
+	if name == "" {
+		to = filepath.Join(dir, stage)
+	}
+	if err := store.Load(ctx, key, to); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if len(found) == 1 && found[0].Path == name {
+		return to, cleanup, nil
+	}
+	if err := concurrency.ZipSource(to, to+".zip"); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return to + ".zip", cleanup, nil
+}
+
+// Ls prints the artifact files of a run.
+func Ls(runID string) {
+	store, err := artifacts.FromConfig()
+	logger.HandleErr(err)
+	objects, err := store.List(context.Background(), runID)
+	logger.HandleErr(err)
+	logger.HandleErr(artifacts.Checksums(context.Background(), store, runID, objects))
+	if len(objects) == 0 {
+		logger.Info("Run", runID, "has no artifacts")
+		return
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Stage", "Path", "Size", "Checksum"})
+	for _, o := range objects {
+		table.Append([]string{o.Stage, o.Path, fmt.Sprint(o.Size), o.Checksum})
+	}
+	table.Render()
+}
+
+// Get copies the artifact at name, a file or a directory saved by the stage,
+// to dst. An empty dst is the base name of the artifact in the working
+// directory.
+func Get(runID, stage, name, dst string) {
+	ctx := context.Background()
+	store, err := artifacts.FromConfig()
+	logger.HandleErr(err)
+	name = artifacts.CleanName(name)
+	found, err := artifacts.Find(ctx, store, runID, stage, name)
+	logger.HandleErr(err)
+	if dst == "" {
+		dst = path.Base(name)
+		if name == "" {
+			dst = stage
+		}
+	}
+	key := found[0].Key(runID)
+	key.Name = name
+	logger.HandleErr(store.Load(ctx, key, dst))
+	logger.Success("Saved", key.Path(), "to", dst)
+}
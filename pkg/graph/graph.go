@@ -0,0 +1,36 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/jatalocks/opsilon/internal/get"
+	internalgraph "github.com/jatalocks/opsilon/internal/graph"
+	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"github.com/jatalocks/opsilon/internal/logger"
+)
+
+// Workflow returns the workflow with the ID workflowName of the repository
+// repoName.
+func Workflow(repoName string, workflowName string) (internaltypes.Workflow, error) {
+	if repoName == "" || workflowName == "" {
+		return internaltypes.Workflow{}, errors.New("a repository and a workflow are required")
+	}
+	return get.GetWorkflow(repoName + "/" + workflowName)
+}
+
+// Graph prints the stage graph of a workflow in format: ascii, dot or
+// mermaid, or writes it to the file output when it is set.
+func Graph(repoName string, workflowName string, format string, output string) {
+	w, err := Workflow(repoName, workflowName)
+	logger.HandleErr(err)
+	out, err := internalgraph.Render(w, format)
+	logger.HandleErr(err)
+	if output == "" {
+		fmt.Print(out)
+		return
+	}
+	logger.HandleErr(os.WriteFile(output, []byte(out), 0o644))
+	logger.Success("Graph written to", output)
+}
@@ -1,10 +1,14 @@
 package run
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"html/template"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	"github.com/fatih/color"
 	"github.com/jatalocks/opsilon/internal/concurrency"
@@ -12,12 +16,19 @@ import (
 	"github.com/jatalocks/opsilon/internal/get"
 	"github.com/jatalocks/opsilon/internal/internaltypes"
 	"github.com/jatalocks/opsilon/internal/logger"
+	"github.com/jatalocks/opsilon/internal/plan"
 	"github.com/jatalocks/opsilon/internal/utils"
+	"github.com/jatalocks/opsilon/internal/validate"
 	"github.com/manifoldco/promptui"
 	"golang.org/x/exp/slices"
+	"gopkg.in/validator.v2"
 )
 
-func ValidateWorkflowArgs(repoName string, workflowName string, args map[string]string) ([]string, internaltypes.Workflow) {
+// ValidateWorkflowArgs finds the workflow and sets its inputs from args. It
+// returns what is missing or invalid among repo, workflow and args, and the
+// per input errors of args, or the problems of the workflow when it was left
+// out of its repository because of them.
+func ValidateWorkflowArgs(repoName string, workflowName string, args map[string]string) ([]string, internaltypes.Workflow, error) {
 	missing := []string{}
 	wArgs := internaltypes.WorkflowArgument{Repo: repoName, Workflow: workflowName, Args: args}
 	repoList := config.GetRepoList()
@@ -36,18 +47,37 @@ func ValidateWorkflowArgs(repoName string, workflowName string, args map[string]
 		}
 	}
 	if !wFound {
+		if refusedErr := get.Refused(repoName + "/" + workflowName); refusedErr != nil {
+			logger.Error(fmt.Sprint("Workflow ", workflowName, " has problems and cannot run - To check them, run opsilon validate ", repoName, "."))
+			return append(missing, "workflow"), chosenAct, fmt.Errorf("workflow %s has problems:\n%w", workflowName, refusedErr)
+		}
 		logger.Error(fmt.Sprint("Worklow ", workflowName, "not found in repository", repoName, " - To view all, run opsilon list."))
 		missing = append(missing, "workflow")
 	}
-	err = InputArgsIntoWorklow(args, &chosenAct)
-	if err != nil {
+	argsErr := InputArgsIntoWorklow(args, &chosenAct)
+	if argsErr != nil {
 		missing = append(missing, "args")
 	}
-	return missing, chosenAct
+	return missing, chosenAct, argsErr
+}
+
+// Problems describes what ValidateWorkflowArgs found missing or invalid.
+func Problems(missing []string, argsErr error) string {
+	problems := fmt.Sprint("You have a problem in the following fields:", missing)
+	if argsErr != nil {
+		problems += " (" + argsErr.Error() + ")"
+	}
+	return problems
 }
 
-func Select(repoName string, workflowName string, args map[string]string, confirm bool) {
-	missing, chosenAct := ValidateWorkflowArgs(repoName, workflowName, args)
+// Select runs a workflow, prompting for what is missing. With dryRun, it
+// prints the plan of the run instead.
+func Select(repoName string, workflowName string, args map[string]string, confirm bool, dryRun bool) {
+	missing, chosenAct, err := ValidateWorkflowArgs(repoName, workflowName, args)
+	var problems validate.Problems
+	if errors.As(err, &problems) {
+		logger.HandleErr(err)
+	}
 	fmt.Println("Missing", missing)
 	chosenRepo := repoName
 	if slices.Contains(missing, "repo") {
@@ -89,28 +119,59 @@ func Select(repoName string, workflowName string, args map[string]string, confir
 	if slices.Contains(missing, "args") || slices.Contains(missing, "workflow") || slices.Contains(missing, "repo") {
 		PromptArguments(&chosenAct)
 	}
+	if dryRun {
+		fmt.Print(plan.New(chosenAct))
+		return
+	}
 	if !confirm {
 		confirm, _ = utils.Confirm(chosenAct)
 	}
 	if confirm {
-		concurrency.ToGraph(chosenAct, nil, internaltypes.SlackMesseger{})
+		// Ctrl-C cancels the run, running containers and pods are cleaned up.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		success := concurrency.ToGraph(ctx, chosenAct, nil, internaltypes.SlackMesseger{})
+		stop()
+		if !success {
+			os.Exit(1)
+		}
 	} else {
 		fmt.Println("Run Canceled")
 	}
 }
 
+// InputArgsIntoWorklow sets the values of the workflow inputs from m. It
+// returns a validator.ErrorMap by input name for mandatory inputs without a
+// value and values that do not match the type, choices or pattern of their
+// input.
 func InputArgsIntoWorklow(m map[string]string, act *internaltypes.Workflow) error {
+	errs := validator.ErrorMap{}
 	argsWithValues := act.Input
 	for i, input := range argsWithValues {
 		if val, ok := m[input.Name]; ok {
+			if val != "" {
+				checked, err := input.Check(val)
+				if err != nil {
+					logger.Error("Input", input.Name, "is invalid:", err.Error())
+					errs[input.Name] = append(errs[input.Name], err)
+					continue
+				}
+				val = checked
+			}
 			argsWithValues[i].Default = val
 		} else {
+			if input.Default != "" {
+				// Defaults are validated with the workflow, only normalize them.
+				argsWithValues[i].Default, _ = input.Check(input.Default)
+			}
 			if !input.Optional {
 				logger.Error("Input", input.Name, "is mandatory but none was provided.")
-				return errors.New("is mandatory but none was provided.")
+				errs[input.Name] = append(errs[input.Name], errors.New("is mandatory but none was provided"))
 			}
 		}
 	}
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
@@ -118,28 +179,64 @@ func PromptArguments(act *internaltypes.Workflow) {
 	argsWithValues := act.Input
 	// Each template displays the data received from the prompt with some formatting.
 	templates := &promptui.PromptTemplates{
-		Prompt:  "{{ .Name }} ({{ .Default | faint }}): ",
-		Valid:   "{{ .Name | green }} ({{ .Default | faint }}): ",
-		Invalid: "{{ .Name | red }} ({{ .Default | faint }}): ",
-		Success: "{{ .Name | bold }} ({{ .Default | faint }}): ",
+		Prompt:  "{{ .Name }}{{ if .Description }} - {{ .Description }}{{ end }} ({{ if not .Secret }}{{ .Default | faint }}{{ end }}): ",
+		Valid:   "{{ .Name | green }}{{ if .Description }} - {{ .Description }}{{ end }} ({{ if not .Secret }}{{ .Default | faint }}{{ end }}): ",
+		Invalid: "{{ .Name | red }}{{ if .Description }} - {{ .Description }}{{ end }} ({{ if not .Secret }}{{ .Default | faint }}{{ end }}): ",
+		Success: "{{ .Name | bold }} ({{ if not .Secret }}{{ .Default | faint }}{{ end }}): ",
+		Confirm: "{{ .Name }}{{ if .Description }} - {{ .Description }}{{ end }} {{ if eq .Default \"true\" }}[Y/n]{{ else }}[y/N]{{ end }}: ",
 	}
 
 	for i, v := range argsWithValues {
-		// The validate function follows the required validator signature.
-		validate := func(input string) error {
-			if input == "" && !v.Optional && v.Default == "" {
-				return fmt.Errorf("This argument is mandatory")
+		var result string
+		var err error
+		switch v.Type {
+		case internaltypes.InputChoice:
+			prompt := promptui.Select{
+				Label: v.Name,
+				Items: v.Choices,
+			}
+			if pos := slices.Index(v.Choices, v.Default); pos > 0 {
+				prompt.CursorPos = pos
+			}
+			_, result, err = prompt.Run()
+		case internaltypes.InputBoolean:
+			prompt := promptui.Prompt{
+				Label:     v,
+				Templates: templates,
+				IsConfirm: true,
+			}
+			if v.Default == "true" {
+				prompt.Default = "y"
+			}
+			// A confirm prompt returns ErrAbort for no.
+			_, err = prompt.Run()
+			result = strconv.FormatBool(err == nil)
+			if errors.Is(err, promptui.ErrAbort) {
+				err = nil
+			}
+		default:
+			// The validate function follows the required validator signature.
+			validate := func(input string) error {
+				if input == "" {
+					if !v.Optional && v.Default == "" {
+						return fmt.Errorf("This argument is mandatory")
+					}
+					return nil
+				}
+				_, err := v.Check(input)
+				return err
 			}
-			return nil
-		}
 
-		prompt := promptui.Prompt{
-			Label:     v,
-			Templates: templates,
-			Validate:  validate,
+			prompt := promptui.Prompt{
+				Label:     v,
+				Templates: templates,
+				Validate:  validate,
+			}
+			if v.Secret {
+				prompt.Mask = '*'
+			}
+			result, err = prompt.Run()
 		}
-
-		result, err := prompt.Run()
 		if err != nil {
 			fmt.Printf("Prompt failed %v\n", err)
 			return
@@ -151,11 +248,13 @@ func PromptArguments(act *internaltypes.Workflow) {
 
 		// The result of the prompt, if valid, is displayed in a formatted message.
 		argsWithValues[i].Default = result
-		fmt.Printf("%s\n", result)
+		if !v.Secret {
+			fmt.Printf("%s\n", result)
+		}
 	}
 	tmpl := `--------- Running "{{.ID}}" with: ----------
 {{range .Input}}
-{{ .Name }}: {{ .Default }}
+{{ .Name }}: {{ if .Secret }}***{{ else }}{{ .Default }}{{ end }}
 {{end}}
 	`
 
@@ -143,7 +143,7 @@ var workflowDialog = func(obj slack.OptionBlockObject) slack.Dialog {
 	for _, v := range w {
 		if v.ID == name {
 			for _, input := range v.Input {
-				elements = append(elements, slack.NewTextInput(input.Name, input.Name, input.Default))
+				elements = append(elements, inputElement(input))
 			}
 		}
 	}
@@ -157,6 +157,37 @@ var workflowDialog = func(obj slack.OptionBlockObject) slack.Dialog {
 	return dialog
 }
 
+// inputElement renders a workflow input as a dropdown for choices and
+// booleans and as a text field otherwise.
+func inputElement(input internaltypes.Input) slack.DialogElement {
+	choices := input.Choices
+	if input.Type == internaltypes.InputBoolean {
+		choices = []string{"true", "false"}
+	}
+	if input.Type == internaltypes.InputChoice || input.Type == internaltypes.InputBoolean {
+		options := make([]slack.DialogSelectOption, 0, len(choices))
+		for _, c := range choices {
+			options = append(options, slack.DialogSelectOption{Label: c, Value: c})
+		}
+		element := slack.NewStaticSelectDialogInput(input.Name, input.Name, options)
+		element.Value = input.Default
+		element.Optional = input.Optional
+		element.Hint = input.Description
+		return element
+	}
+	text := input.Default
+	if input.Secret {
+		text = ""
+	}
+	element := slack.NewTextInput(input.Name, input.Name, text)
+	element.Optional = input.Optional
+	element.Hint = input.Description
+	if input.Type == internaltypes.InputNumber {
+		element.Subtype = slack.InputSubtypeNumber
+	}
+	return element
+}
+
 var interactive = func(s *slacker.Slacker, event *socketmode.Event, callback *slack.InteractionCallback) {
 	fmt.Println(callback.Type)
 	switch callback.Type {
@@ -166,24 +197,31 @@ var interactive = func(s *slacker.Slacker, event *socketmode.Event, callback *sl
 		u.Args = callback.Submission
 		u.Workflow = strings.Split(callback.CallbackID, "&")[0]
 		u.Repo = strings.Split(callback.CallbackID, "&")[1]
-		missing, chosenAct := run.ValidateWorkflowArgs(u.Repo, u.Workflow, u.Args)
+		missing, chosenAct, argsErr := run.ValidateWorkflowArgs(u.Repo, u.Workflow, u.Args)
 
 		if len(missing) > 0 {
-			_, _, _ = s.Client().PostMessage(callback.Channel.ID, slack.MsgOptionText(fmt.Sprint("You have a problem in the following fields:", missing), false),
+			_, _, _ = s.Client().PostMessage(callback.Channel.ID, slack.MsgOptionText(run.Problems(missing, argsErr), false),
 				slack.MsgOptionReplaceOriginal(callback.ResponseURL))
 		} else {
 			_, _, _ = s.Client().PostMessage(callback.Channel.ID, slack.MsgOptionText("Running "+u.Workflow, false),
 				slack.MsgOptionReplaceOriginal(callback.ResponseURL))
+			go concurrency.ToGraph(context.Background(), chosenAct, nil, internaltypes.SlackMesseger{Callback: callback, Slacker: s})
 		}
 
-		go concurrency.ToGraph(chosenAct, nil, internaltypes.SlackMesseger{Callback: callback, Slacker: s})
-
 	case slack.InteractionTypeBlockActions:
 		if len(callback.ActionCallback.BlockActions) != 1 {
 			return
 		}
 		action := callback.ActionCallback.BlockActions[0]
-		s.Client().OpenDialog(callback.TriggerID, workflowDialog(action.SelectedOption))
+		if action.ActionID == concurrency.CancelRunAction {
+			text := "Cancelling run " + action.Value
+			if !concurrency.Cancel(action.Value) {
+				text = "Run " + action.Value + " is not in progress"
+			}
+			_, _, _ = s.Client().PostMessage(callback.Channel.ID, slack.MsgOptionText(text, false))
+		} else {
+			s.Client().OpenDialog(callback.TriggerID, workflowDialog(action.SelectedOption))
+		}
 	}
 
 	// if action.BlockID != "mood-block" {
@@ -0,0 +1,78 @@
+package validate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jatalocks/opsilon/internal/config"
+	"github.com/jatalocks/opsilon/internal/get"
+	"github.com/jatalocks/opsilon/internal/logger"
+	"github.com/jatalocks/opsilon/internal/validate"
+	"golang.org/x/exp/slices"
+)
+
+// Repos returns the repositories to validate: the configured repository
+// named target, or a folder repository for the folder or workflow file at
+// the path target, named after its folder. All the configured repositories
+// when target is empty.
+func Repos(target string) ([]config.Repo, error) {
+	repos := config.GetConfig()
+	if target == "" {
+		return repos, nil
+	}
+	if idx := slices.IndexFunc(repos, func(r config.Repo) bool { return r.Name == target }); idx != -1 {
+		return repos[idx : idx+1], nil
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither a repository nor a path", target)
+	}
+	dir, err := filepath.Abs(target)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+	return []config.Repo{{Name: filepath.Base(dir), Location: config.Location{Type: "folder", Path: target}}}, nil
+}
+
+// Check returns the problems of the workflows of the repositories, by
+// repository name. Repositories without problems are left out.
+func Check(repos []config.Repo) (map[string]validate.Problems, error) {
+	problems := make(map[string]validate.Problems)
+	for _, r := range repos {
+		p, err := get.Check(r.Location, r.Name)
+		if err != nil {
+			return nil, fmt.Errorf("repository %s: %w", r.Name, err)
+		}
+		if len(p) > 0 {
+			problems[r.Name] = p
+		}
+	}
+	return problems, nil
+}
+
+// Validate prints the problems of the workflows of target, a repository or
+// a path, and exits with 1 when there are any.
+func Validate(target string) {
+	repos, err := Repos(target)
+	logger.HandleErr(err)
+	problems, err := Check(repos)
+	logger.HandleErr(err)
+	if len(problems) == 0 {
+		logger.Success("All workflows are valid")
+		return
+	}
+	for _, r := range repos {
+		if len(problems[r.Name]) == 0 {
+			continue
+		}
+		logger.Info("Repository", r.Name)
+		for _, p := range problems[r.Name] {
+			logger.Error(p.String())
+		}
+	}
+	os.Exit(1)
+}
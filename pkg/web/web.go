@@ -1,21 +1,30 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
+	internalartifacts "github.com/jatalocks/opsilon/internal/artifacts"
 	"github.com/jatalocks/opsilon/internal/concurrency"
 	"github.com/jatalocks/opsilon/internal/config"
 	"github.com/jatalocks/opsilon/internal/db"
 	"github.com/jatalocks/opsilon/internal/get"
+	internalgraph "github.com/jatalocks/opsilon/internal/graph"
 	"github.com/jatalocks/opsilon/internal/internaltypes"
+	"github.com/jatalocks/opsilon/internal/plan"
+	"github.com/jatalocks/opsilon/pkg/artifacts"
+	"github.com/jatalocks/opsilon/pkg/graph"
 	"github.com/jatalocks/opsilon/pkg/repo"
 	"github.com/jatalocks/opsilon/pkg/run"
+	"github.com/jatalocks/opsilon/pkg/validate"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/mitchellh/hashstructure/v2"
@@ -52,6 +61,17 @@ func App(port int64, v string) {
 		AddResponse(http.StatusOK, "list of available workflows", nil, nil).
 		AddParamQuery("", "repos", "comma seperated list of repositories", false)
 
+	e.GET("/api/v1/validate", wvalidate).
+		AddResponse(http.StatusOK, "the workflows have no problems", nil, nil).
+		AddResponse(http.StatusUnprocessableEntity, "problems of the workflows, with their files and lines, by repository", nil, nil).
+		AddParamQuery("", "repos", "comma seperated list of repositories, omit to validate all", false)
+
+	e.GET("/api/v1/graph", wgraph).
+		AddResponse(http.StatusOK, "the stage graph of a workflow, as text", nil, nil).
+		AddParamQuery("", "repo", "repository of the workflow", true).
+		AddParamQuery("", "workflow", "workflow id", true).
+		AddParamQuery("", "format", "ascii (default), dot or mermaid", false)
+
 	rg := e.Group("repo", "/api/v1/repo")
 	rg.GET("/list", rlist).
 		AddResponse(http.StatusOK, "list of added repositories", nil, nil)
@@ -82,13 +102,29 @@ func App(port int64, v string) {
 		AddResponse(http.StatusOK, "get history of workflow runs", nil, nil).
 		AddParamQuery("", "workflow", "workflow id", false).
 		AddParamQuery("", "repo", "workflow name", false)
+	rrgw.POST("/:id/cancel", wrcancel).
+		AddResponse(http.StatusOK, "cancel a running workflow", nil, nil).
+		AddResponse(http.StatusNotFound, "run is not in progress", nil, nil).
+		AddParamPath("", "id", "run id (returned in the X-Run-Id header of /api/v1/run)")
+	rrgw.GET("/:id/artifacts", wrartifacts).
+		AddResponse(http.StatusOK, "list the artifact files of a run by stage, with sizes and checksums", nil, nil).
+		AddResponse(http.StatusBadRequest, "invalid run id", nil, nil).
+		AddParamPath("", "id", "run id")
+	rrgw.GET("/:id/artifacts/:stage/*", wrartifact).
+		AddResponse(http.StatusOK, "download an artifact file, or a zip of an artifact directory", nil, nil).
+		AddResponse(http.StatusNotFound, "artifact not found", nil, nil).
+		AddResponse(http.StatusBadRequest, "invalid run id", nil, nil).
+		AddParamPath("", "id", "run id").
+		AddParamPath("", "stage", "stage id").
+		AddParamPath("", "*", "path of the file or directory in the stage workspace")
 	rrgw.DELETE("/delete/:run", rrdelete).
 		AddResponse(http.StatusOK, "delete a run", nil, nil).
 		AddParamPath("", "run", "run to delete")
 
 	e.POST("/api/v1/run", wrun).
 		AddResponse(http.StatusOK, "run a workflow", nil, nil).
-		AddParamBody(internaltypes.WorkflowArgument{}, "workflow", "workflow to run", true)
+		AddParamBody(internaltypes.WorkflowArgument{}, "workflow", "workflow to run", true).
+		AddParamQuery("", "dry_run", "true to get the plan of the run (images, env, conditions and artifacts of every stage) without running it", false)
 	// e.GET("/api/v1/swagger/*", echoSwagger.WrapHandler)
 	// Start server
 	e.GET("/api/v1/ws", runstream)
@@ -145,6 +181,41 @@ func list(c echo.Context) error {
 	}
 }
 
+// Handler
+func wvalidate(c echo.Context) error {
+	repos := config.GetConfig()
+	if names := c.QueryParam("repos"); names != "" {
+		selected := []config.Repo{}
+		for _, r := range repos {
+			if config.StringInSlice(r.Name, strings.Split(names, ",")) {
+				selected = append(selected, r)
+			}
+		}
+		repos = selected
+	}
+	problems, err := validate.Check(repos)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	if len(problems) > 0 {
+		return c.JSON(http.StatusUnprocessableEntity, problems)
+	}
+	return c.JSON(http.StatusOK, problems)
+}
+
+// Handler
+func wgraph(c echo.Context) error {
+	w, err := graph.Workflow(c.QueryParam("repo"), c.QueryParam("workflow"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	out, err := internalgraph.Render(w, c.QueryParam("format"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	return c.String(http.StatusOK, out)
+}
+
 // Handler
 func wlist(c echo.Context) error {
 	workflow := c.QueryParam("workflow")
@@ -255,7 +326,7 @@ func getHistory(workflow, repo string) (error, []internaltypes.RunResult) {
 					}
 				}(),
 				FailedStages: func() uint32 {
-					if !d.Skipped && !d.Result {
+					if !d.Skipped && !d.Result && d.Status != internaltypes.StatusCancelled {
 						return 1
 					} else {
 						return 0
@@ -268,16 +339,17 @@ func getHistory(workflow, repo string) (error, []internaltypes.RunResult) {
 						return 0
 					}
 				}(),
-				Logs:     d.Logs,
-				Workflow: d.Workflow,
-				RunID:    d.RunID,
-				Result: func() bool {
-					if !d.Skipped && !d.Result {
-						return false
+				CancelledStages: func() uint32 {
+					if d.Status == internaltypes.StatusCancelled {
+						return 1
 					} else {
-						return true
+						return 0
 					}
 				}(),
+				Logs:      d.Logs,
+				Workflow:  d.Workflow,
+				RunID:     d.RunID,
+				Result:    !concurrency.FailsRun(d),
 				RunTime:   time.Duration(d.UpdatedDate.Sub(d.CreatedDate).Seconds()),
 				StartTime: d.CreatedDate,
 				EndTime:   d.UpdatedDate,
@@ -311,7 +383,7 @@ func getHistory(workflow, repo string) (error, []internaltypes.RunResult) {
 						}
 					}()
 					p.FailedStages += func() uint32 {
-						if !d.Skipped && !d.Result {
+						if !d.Skipped && !d.Result && d.Status != internaltypes.StatusCancelled {
 							return 1
 						} else {
 							return 0
@@ -324,7 +396,14 @@ func getHistory(workflow, repo string) (error, []internaltypes.RunResult) {
 							return 0
 						}
 					}()
-					p.Result = (p.FailedStages == 0)
+					p.CancelledStages += func() uint32 {
+						if d.Status == internaltypes.StatusCancelled {
+							return 1
+						} else {
+							return 0
+						}
+					}()
+					p.Result = p.Result && !concurrency.FailsRun(d)
 
 				}
 			}
@@ -396,15 +475,52 @@ func wrun(c echo.Context) error {
 	if err := c.Bind(u); err != nil {
 		return c.String(http.StatusBadRequest, err.Error())
 	}
-	missing, chosenAct := run.ValidateWorkflowArgs(u.Repo, u.Workflow, u.Args)
+	missing, chosenAct, argsErr := run.ValidateWorkflowArgs(u.Repo, u.Workflow, u.Args)
 	if len(missing) > 0 {
-		return c.String(http.StatusBadRequest, fmt.Sprint("You have a problem in the following fields:", missing))
+		return c.String(http.StatusBadRequest, run.Problems(missing, argsErr))
+	}
+
+	if c.QueryParam("dry_run") == "true" {
+		return c.JSON(http.StatusOK, plan.New(chosenAct))
 	}
 
 	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
-	c.Response().WriteHeader(http.StatusOK)
 
-	concurrency.ToGraph(chosenAct, c, internaltypes.SlackMesseger{Callback: nil})
+	concurrency.ToGraph(context.Background(), chosenAct, c, internaltypes.SlackMesseger{Callback: nil})
 
 	return nil
 }
+
+func wrartifacts(c echo.Context) error {
+	byStage, err := artifacts.List(c.Request().Context(), c.Param("id"))
+	if errors.Is(err, internalartifacts.ErrInvalidRunID) {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, byStage)
+}
+
+func wrartifact(c echo.Context) error {
+	file, cleanup, err := artifacts.Download(c.Request().Context(), c.Param("id"), c.Param("stage"), c.Param("*"))
+	if errors.Is(err, internalartifacts.ErrNotFound) {
+		return c.String(http.StatusNotFound, err.Error())
+	}
+	if errors.Is(err, internalartifacts.ErrInvalidRunID) {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	defer cleanup()
+	return c.Attachment(file, filepath.Base(file))
+}
+
+func wrcancel(c echo.Context) error {
+	id := c.Param("id")
+	if !concurrency.Cancel(id) {
+		return c.String(http.StatusNotFound, fmt.Sprint("Run ", id, " is not in progress"))
+	}
+	return c.String(http.StatusOK, id)
+}